@@ -3,23 +3,34 @@ package cmd
 import (
 	"context"
 	"fmt"
-	"os"
-	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/spf13/cobra"
-	gmailv1 "google.golang.org/api/gmail/v1"
 
-	"github.com/perarneng/getgmail/pkg/gmail"
+	"github.com/perarneng/getgmail/pkg/interfaces"
 	"github.com/perarneng/getgmail/pkg/logger"
 	"github.com/perarneng/getgmail/pkg/output"
 )
 
 var (
-	mailbox   string
-	outputDir string
-	count     int
+	mailboxes   []string
+	labelMatch  string
+	outputDir   string
+	count       int
+	concurrency int
+	threads     bool
+	outputOpts  outputFlags
+
+	query         string
+	fromFilter    string
+	afterDate     string
+	beforeDate    string
+	hasAttachment bool
+	largerThan    string
+	smallerThan   string
 )
 
 var downloadCmd = &cobra.Command{
@@ -30,11 +41,22 @@ var downloadCmd = &cobra.Command{
 }
 
 func init() {
-	downloadCmd.Flags().StringVarP(&mailbox, "mailbox", "m", "INBOX", "Gmail mailbox/label to download from")
+	downloadCmd.Flags().StringArrayVarP(&mailboxes, "mailbox", "m", []string{"INBOX"}, "Gmail mailbox/label name or ID to download from (repeatable)")
+	downloadCmd.Flags().StringVar(&labelMatch, "label-match", "all", "With several --mailbox labels, download emails matching \"all\" or \"any\" of them")
 	downloadCmd.Flags().StringVarP(&outputDir, "output-dir", "d", "", "Output directory for downloaded emails (required)")
-	downloadCmd.Flags().IntVarP(&count, "count", "c", 100, "Maximum number of emails to download")
+	downloadCmd.Flags().IntVarP(&count, "count", "c", 100, "Maximum number of emails, or threads with --threads, to download")
+	downloadCmd.Flags().IntVarP(&concurrency, "concurrency", "j", 4, "Number of messages to fetch in parallel")
+	addOutputFlags(downloadCmd, &outputOpts)
+	downloadCmd.Flags().BoolVar(&threads, "threads", false, "Group emails by conversation: one folder per thread with a combined thread.html (files output only)")
+	downloadCmd.Flags().StringVarP(&query, "query", "q", "", "Gmail search query, e.g. \"from:billing@vendor.com has:attachment\"")
+	downloadCmd.Flags().StringVar(&fromFilter, "from", "", "Only download emails from this sender")
+	downloadCmd.Flags().StringVar(&afterDate, "after", "", "Only download emails received on or after this date (YYYY-MM-DD)")
+	downloadCmd.Flags().StringVar(&beforeDate, "before", "", "Only download emails received before this date (YYYY-MM-DD)")
+	downloadCmd.Flags().BoolVar(&hasAttachment, "has-attachment", false, "Only download emails with attachments")
+	downloadCmd.Flags().StringVar(&largerThan, "larger", "", "Only download emails larger than this size (e.g. 500K, 10M)")
+	downloadCmd.Flags().StringVar(&smallerThan, "smaller", "", "Only download emails smaller than this size (e.g. 500K, 10M)")
 	downloadCmd.MarkFlagRequired("output-dir")
-	
+
 	rootCmd.AddCommand(downloadCmd)
 }
 
@@ -47,114 +69,207 @@ func runDownload(cmd *cobra.Command, args []string) error {
 	// Initialize logger
 	log := logger.NewLogger()
 
+	filter, err := buildMessageFilter(cmd)
+	if err != nil {
+		return err
+	}
+
 	// Validate output directory
-	writer := output.NewFileWriter(log)
+	writer, fetchFormat, err := outputOpts.newWriter(log, outputDir)
+	if err != nil {
+		return err
+	}
 	if err := writer.ValidateOutputDir(outputDir); err != nil {
 		return err
 	}
 
-	// Initialize Gmail client
-	gmailClient := gmail.NewClient()
-	
-	log.Info("Connecting to Gmail API...")
-	// Create context with overall timeout for entire operation
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
-	defer cancel()
-	
-	if err := gmailClient.Connect(ctx); err != nil {
-		log.Error(fmt.Sprintf("Failed to connect to Gmail: %v", err))
+	// Load the index of already downloaded emails
+	if err := writer.LoadIndex(outputDir); err != nil {
 		return err
 	}
 
-	log.Info(fmt.Sprintf("Connected successfully, downloading from mailbox: %s (max %d emails)", mailbox, count))
+	var threadWriter interfaces.ThreadWriter
+	if threads {
+		var ok bool
+		if threadWriter, ok = writer.(interfaces.ThreadWriter); !ok {
+			return fmt.Errorf("--threads can only be used with the %s output format", output.OutputFiles)
+		}
+	}
 
-	// List messages
-	log.Info(fmt.Sprintf("Fetching message list (max %d messages)...", count))
-	messages, err := gmailClient.ListMessages(ctx, mailbox, int64(count))
+	ctx, cancel := runContext()
+	defer cancel()
+
+	gmailClient, err := connectGmail(ctx, log)
 	if err != nil {
-		log.Error(fmt.Sprintf("Failed to list messages: %v", err))
 		return err
 	}
 
-	log.Info(fmt.Sprintf("Found %d messages to process", len(messages)))
+	log.Info(fmt.Sprintf("Connected successfully, downloading from %s (max %d emails)", describeFilter(filter), count))
 
-	// Download each message
-	processedCount := 0
-	skippedCount := 0
-	failedCount := 0
-	
-	// Special debug mode for problematic email
-	debugEmailID := os.Getenv("DEBUG_EMAIL_ID")
-	if debugEmailID != "" {
-		log.Info(fmt.Sprintf("DEBUG MODE: Looking for email %s", debugEmailID))
-		var found bool
-		for _, msg := range messages {
-			if msg.Id == debugEmailID {
-				log.Info(fmt.Sprintf("Found target email %s, processing only this one", debugEmailID))
-				messages = []*gmailv1.Message{msg}
-				found = true
-				break
-			}
-		}
-		if !found {
-			log.Error(fmt.Sprintf("Email %s not found in first %d messages", debugEmailID, len(messages)))
-			return fmt.Errorf("target email not found")
-		}
+	opts := downloadOptions{
+		outputDir:   outputDir,
+		concurrency: concurrency,
+		format:      fetchFormat,
 	}
-	
-	for i, msg := range messages {
-		// Add rate limiting delay between emails (except for first one)
-		if i > 0 {
-			time.Sleep(100 * time.Millisecond)
-		}
-		
-		log.Info(fmt.Sprintf("Processing message %d/%d (ID: %s)", i+1, len(messages), msg.Id))
-
-		// Check for context cancellation
-		select {
-		case <-ctx.Done():
-			log.Error("Operation timeout or cancelled")
-			return ctx.Err()
-		default:
-		}
 
-		email, err := gmailClient.GetMessage(ctx, msg.Id)
+	var stats downloadStats
+	if threadWriter != nil {
+		ids, err := listThreadIDs(ctx, log, gmailClient, filter)
 		if err != nil {
-			log.Error(fmt.Sprintf("Failed to get message %s: %v", msg.Id, err))
-			failedCount++
-			continue
+			return err
 		}
-
-		// Check if email was already downloaded by looking for existing folder with metadata
-		// Generate expected folder name without creating it first
-		folderName := writer.GenerateFolderName(email)
-		folderPath := filepath.Join(outputDir, folderName)
-		
-		// Check if metadata file exists in expected folder
-		metadataPattern := filepath.Join(folderPath, "*_metadata.txt")
-		matches, _ := filepath.Glob(metadataPattern)
-		if len(matches) > 0 {
-			log.Info(fmt.Sprintf("Email %s already downloaded, skipping", msg.Id))
-			skippedCount++
-			continue
+		stats, err = downloadThreads(ctx, log, gmailClient, threadWriter, ids, opts)
+		if err != nil {
+			return err
 		}
-
-		// Write email to disk
-		if err := writer.WriteEmail(ctx, email, outputDir); err != nil {
-			log.Error(fmt.Sprintf("Failed to write message %s: %v", msg.Id, err))
-			failedCount++
-			continue
+	} else {
+		ids, err := listMessageIDs(ctx, log, gmailClient, filter)
+		if err != nil {
+			return err
+		}
+		stats, err = downloadMessages(ctx, log, gmailClient, writer, ids, opts)
+		if err != nil {
+			return err
 		}
-		processedCount++
 	}
 
-	log.Info(fmt.Sprintf("Download completed. Processed: %d, Skipped: %d, Failed: %d. Emails saved to: %s", 
-		processedCount, skippedCount, failedCount, outputDir))
-	
+	log.Info(fmt.Sprintf("Download completed. Processed: %d, Skipped: %d, Failed: %d. Emails saved to: %s",
+		stats.processed, stats.skipped, stats.failed, outputDir))
+
 	// Return error if all downloads failed
-	if processedCount == 0 && skippedCount == 0 && failedCount > 0 {
+	if stats.allFailed() {
 		return fmt.Errorf("all email downloads failed")
 	}
-	
+
 	return nil
-}
\ No newline at end of file
+}
+
+// listMessageIDs lists the IDs of the messages matching the filter
+func listMessageIDs(ctx context.Context, log interfaces.Logger, gmailClient interfaces.GmailClient, filter interfaces.MessageFilter) ([]string, error) {
+	log.Info(fmt.Sprintf("Fetching message list (max %d messages)...", count))
+	messages, err := gmailClient.SearchMessages(ctx, filter)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to list messages: %v", err))
+		return nil, err
+	}
+
+	log.Info(fmt.Sprintf("Found %d messages to process", len(messages)))
+
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.Id
+	}
+	return ids, nil
+}
+
+// listThreadIDs lists the IDs of the conversations matching the filter
+func listThreadIDs(ctx context.Context, log interfaces.Logger, gmailClient interfaces.GmailClient, filter interfaces.MessageFilter) ([]string, error) {
+	log.Info(fmt.Sprintf("Fetching thread list (max %d threads)...", count))
+	threadList, err := gmailClient.SearchThreads(ctx, filter)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to list threads: %v", err))
+		return nil, err
+	}
+
+	log.Info(fmt.Sprintf("Found %d threads to process", len(threadList)))
+
+	ids := make([]string, len(threadList))
+	for i, thread := range threadList {
+		ids[i] = thread.Id
+	}
+	return ids, nil
+}
+
+// buildMessageFilter collects the listing flags of the download command. The
+// mailbox only restricts a search when it is given explicitly, so that a query
+// on its own searches all mail like the Gmail search box does.
+func buildMessageFilter(cmd *cobra.Command) (interfaces.MessageFilter, error) {
+	if labelMatch != "all" && labelMatch != "any" {
+		return interfaces.MessageFilter{}, fmt.Errorf("invalid --label-match %q, expected \"all\" or \"any\"", labelMatch)
+	}
+
+	filter := interfaces.MessageFilter{
+		AnyLabel:      labelMatch == "any",
+		Query:         query,
+		From:          fromFilter,
+		HasAttachment: hasAttachment,
+		MaxResults:    int64(count),
+	}
+
+	var err error
+	if filter.After, err = parseDateFlag("after", afterDate); err != nil {
+		return filter, err
+	}
+	if filter.Before, err = parseDateFlag("before", beforeDate); err != nil {
+		return filter, err
+	}
+	if filter.LargerThan, err = parseSizeFlag("larger", largerThan); err != nil {
+		return filter, err
+	}
+	if filter.SmallerThan, err = parseSizeFlag("smaller", smallerThan); err != nil {
+		return filter, err
+	}
+
+	searching := filter.Query != "" || filter.From != "" || filter.HasAttachment ||
+		!filter.After.IsZero() || !filter.Before.IsZero() || filter.LargerThan > 0 || filter.SmallerThan > 0
+	if !searching || cmd.Flags().Changed("mailbox") {
+		filter.LabelIDs = mailboxes
+	}
+
+	return filter, nil
+}
+
+// describeFilter renders a filter for log messages
+func describeFilter(filter interfaces.MessageFilter) string {
+	var parts []string
+	if len(filter.LabelIDs) > 0 {
+		separator := " and "
+		if filter.AnyLabel {
+			separator = " or "
+		}
+		parts = append(parts, fmt.Sprintf("mailbox: %s", strings.Join(filter.LabelIDs, separator)))
+	} else {
+		parts = append(parts, "all mail")
+	}
+	if filter.Query != "" {
+		parts = append(parts, fmt.Sprintf("query: %s", filter.Query))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseDateFlag parses a YYYY-MM-DD flag value in local time
+func parseDateFlag(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --%s date %q, expected YYYY-MM-DD", name, value)
+	}
+	return t, nil
+}
+
+// parseSizeFlag parses a size such as 2048, 500K or 10M into bytes
+func parseSizeFlag(name, value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	number := strings.ToUpper(strings.TrimSpace(value))
+	switch {
+	case strings.HasSuffix(number, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(number, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(number, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	number = strings.TrimRight(number, "KMG")
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid --%s size %q, expected bytes or a K/M/G suffix", name, value)
+	}
+	return n * multiplier, nil
+}
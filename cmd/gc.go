@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/perarneng/getgmail/pkg/logger"
+	"github.com/perarneng/getgmail/pkg/output"
+)
+
+var (
+	gcOutputDir string
+	gcDryRun    bool
+)
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove unreferenced files from the attachment store",
+	Long: `Remove attachments from the content-addressed store of an output directory
+that no email metadata refers to any more, for example after email folders
+were deleted. Only used with --attachment-store.`,
+	RunE: runGC,
+}
+
+func init() {
+	gcCmd.Flags().StringVarP(&gcOutputDir, "output-dir", "d", "", "Output directory holding the attachment store (required)")
+	gcCmd.Flags().BoolVar(&gcDryRun, "dry-run", false, "Only report what would be removed")
+	gcCmd.MarkFlagRequired("output-dir")
+
+	rootCmd.AddCommand(gcCmd)
+}
+
+func runGC(cmd *cobra.Command, args []string) error {
+	log := logger.NewLogger()
+
+	writer := output.NewFileWriter(log, output.Options{})
+	if err := writer.ValidateOutputDir(gcOutputDir); err != nil {
+		return err
+	}
+
+	result, err := output.CollectGarbage(gcOutputDir, gcDryRun)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to clean attachment store: %v", err))
+		return err
+	}
+
+	action := "Removed"
+	if gcDryRun {
+		action = "Would remove"
+	}
+	log.Info(fmt.Sprintf("%s %d unreferenced attachments (%d bytes). %d attachments are still referenced.",
+		action, result.Removed, result.FreedBytes, result.Referenced))
+	return nil
+}
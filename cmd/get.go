@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/spf13/cobra"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+	"github.com/perarneng/getgmail/pkg/logger"
+)
+
+var (
+	getOutputDir   string
+	getIDsFrom     string
+	getThreads     bool
+	getConcurrency int
+	getOutputOpts  outputFlags
+)
+
+var getCmd = &cobra.Command{
+	Use:   "get [id...]",
+	Short: "Download specific emails or threads by ID",
+	Long: `Download emails by their Gmail message ID, or whole conversations by thread ID
+with --threads, without listing a mailbox first. IDs are taken from the
+arguments and from the file given with --ids-from, one per line. Emails that
+are already downloaded are skipped.`,
+	RunE: runGet,
+}
+
+func init() {
+	getCmd.Flags().StringVarP(&getOutputDir, "output-dir", "d", "", "Output directory for downloaded emails (required)")
+	getCmd.Flags().StringVar(&getIDsFrom, "ids-from", "", "Read IDs from this file, one per line (\"-\" for stdin)")
+	getCmd.Flags().BoolVar(&getThreads, "threads", false, "Treat the IDs as thread IDs and download every message of each conversation")
+	getCmd.Flags().IntVarP(&getConcurrency, "concurrency", "j", 4, "Number of messages to fetch in parallel")
+	addOutputFlags(getCmd, &getOutputOpts)
+	getCmd.MarkFlagRequired("output-dir")
+
+	rootCmd.AddCommand(getCmd)
+}
+
+func runGet(cmd *cobra.Command, args []string) error {
+	// Load .env file if it exists
+	if err := godotenv.Load(); err != nil {
+		// Don't fail if .env doesn't exist, just continue
+	}
+
+	log := logger.NewLogger()
+
+	ids := uniqueIDs(args)
+	if getIDsFrom != "" {
+		fileIDs, err := readIDsFile(getIDsFrom)
+		if err != nil {
+			return err
+		}
+		ids = uniqueIDs(append(ids, fileIDs...))
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("no IDs given, pass them as arguments or with --ids-from")
+	}
+
+	writer, fetchFormat, err := getOutputOpts.newWriter(log, getOutputDir)
+	if err != nil {
+		return err
+	}
+	if err := writer.ValidateOutputDir(getOutputDir); err != nil {
+		return err
+	}
+
+	if err := writer.LoadIndex(getOutputDir); err != nil {
+		return err
+	}
+
+	ctx, cancel := runContext()
+	defer cancel()
+
+	gmailClient, err := connectGmail(ctx, log)
+	if err != nil {
+		return err
+	}
+
+	opts := downloadOptions{
+		outputDir:   getOutputDir,
+		concurrency: getConcurrency,
+		format:      fetchFormat,
+	}
+
+	var stats downloadStats
+	switch threadWriter, ok := writer.(interfaces.ThreadWriter); {
+	case getThreads && ok:
+		log.Info(fmt.Sprintf("Downloading %d threads", len(ids)))
+		stats, err = downloadThreads(ctx, log, gmailClient, threadWriter, ids, opts)
+	case getThreads:
+		// Writers without thread folders store the messages one by one
+		var messageIDs []string
+		if messageIDs, err = threadMessageIDs(ctx, log, gmailClient, ids); err != nil {
+			return err
+		}
+		log.Info(fmt.Sprintf("Downloading %d messages from %d threads", len(messageIDs), len(ids)))
+		stats, err = downloadMessages(ctx, log, gmailClient, writer, messageIDs, opts)
+	default:
+		log.Info(fmt.Sprintf("Downloading %d messages", len(ids)))
+		stats, err = downloadMessages(ctx, log, gmailClient, writer, ids, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Info(fmt.Sprintf("Get completed. Processed: %d, Skipped: %d, Failed: %d. Emails saved to: %s",
+		stats.processed, stats.skipped, stats.failed, getOutputDir))
+
+	if stats.failed > 0 {
+		return fmt.Errorf("%d of %d downloads failed", stats.failed, stats.processed+stats.skipped+stats.failed)
+	}
+	return nil
+}
+
+// threadMessageIDs expands thread IDs into the IDs of their messages
+func threadMessageIDs(ctx context.Context, log interfaces.Logger, gmailClient interfaces.GmailClient, threadIDs []string) ([]string, error) {
+	var ids []string
+	for _, threadID := range threadIDs {
+		thread, err := gmailClient.GetThread(ctx, threadID)
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to get thread %s: %v", threadID, err))
+			return nil, err
+		}
+		ids = append(ids, thread.MessageIDs...)
+	}
+	return uniqueIDs(ids), nil
+}
+
+// readIDsFile reads one ID per line from a file, or from stdin for "-".
+// Blank lines and lines starting with # are ignored.
+func readIDsFile(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open ID file: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var ids []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids = append(ids, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ID file: %v", err)
+	}
+	return ids, nil
+}
+
+// uniqueIDs drops empty and repeated IDs, keeping the first occurrence
+func uniqueIDs(ids []string) []string {
+	var unique []string
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		unique = append(unique, id)
+	}
+	return unique
+}
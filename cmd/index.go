@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/perarneng/getgmail/pkg/logger"
+	"github.com/perarneng/getgmail/pkg/output"
+	"github.com/perarneng/getgmail/pkg/search"
+)
+
+var indexOutputDir string
+
+var indexCmd = &cobra.Command{
+	Use:   "index",
+	Short: "Build the full-text search index of downloaded emails",
+	Long: `Index the subject, sender, recipients, body text, labels and attachment names
+of every email in the output directory for the search command. Once the index
+exists, download, sync and get add each email they save to it. Run it again to
+rebuild the index from scratch, e.g. after deleting emails.`,
+	RunE: runIndex,
+}
+
+func init() {
+	indexCmd.Flags().StringVarP(&indexOutputDir, "output-dir", "d", "", "Output directory holding the downloaded emails (required)")
+	indexCmd.MarkFlagRequired("output-dir")
+
+	rootCmd.AddCommand(indexCmd)
+}
+
+func runIndex(cmd *cobra.Command, args []string) error {
+	log := logger.NewLogger()
+
+	writer := output.NewFileWriter(log, output.Options{})
+	if err := writer.ValidateOutputDir(indexOutputDir); err != nil {
+		return err
+	}
+
+	result, err := search.Build(log, indexOutputDir)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to build search index: %v", err))
+		return err
+	}
+
+	log.Info(fmt.Sprintf("Indexed %d emails with %d distinct terms", result.Emails, result.Terms))
+	return nil
+}
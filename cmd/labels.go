@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/joho/godotenv"
+	"github.com/spf13/cobra"
+
+	"github.com/perarneng/getgmail/pkg/logger"
+)
+
+var labelsCmd = &cobra.Command{
+	Use:   "labels",
+	Short: "List Gmail labels with their message counts",
+	Long:  `List all system and user labels of the Gmail account with their IDs and message counts. Any of the names or IDs can be passed to --mailbox.`,
+	RunE:  runLabels,
+}
+
+func init() {
+	rootCmd.AddCommand(labelsCmd)
+}
+
+func runLabels(cmd *cobra.Command, args []string) error {
+	// Load .env file if it exists
+	if err := godotenv.Load(); err != nil {
+		// Don't fail if .env doesn't exist, just continue
+	}
+
+	log := logger.NewLogger()
+
+	ctx, cancel := runContext()
+	defer cancel()
+
+	gmailClient, err := connectGmail(ctx, log)
+	if err != nil {
+		return err
+	}
+
+	labels, err := gmailClient.ListLabels(ctx)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to list labels: %v", err))
+		return err
+	}
+
+	// System labels first, then user labels by name so nested labels line up
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].Type != labels[j].Type {
+			return labels[i].Type == "system"
+		}
+		return labels[i].Name < labels[j].Name
+	})
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tID\tTYPE\tMESSAGES\tUNREAD")
+	for _, l := range labels {
+		// Users.Labels.List does not return counts, so fetch each label
+		detail, err := gmailClient.GetLabel(ctx, l.ID)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Failed to get counts for label %s: %v", l.Name, err))
+			fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\n", l.Name, l.ID, l.Type)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\n", detail.Name, detail.ID, detail.Type, detail.MessagesTotal, detail.MessagesUnread)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,354 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"github.com/perarneng/getgmail/pkg/gmail"
+	"github.com/perarneng/getgmail/pkg/interfaces"
+	"github.com/perarneng/getgmail/pkg/output"
+	"github.com/perarneng/getgmail/pkg/pdf"
+	"github.com/perarneng/getgmail/pkg/search"
+)
+
+// connectGmail creates a Gmail client and connects it to the API
+func connectGmail(ctx context.Context, log interfaces.Logger) (interfaces.GmailClient, error) {
+	gmailClient := gmail.NewClient(log)
+
+	log.Info("Connecting to Gmail API...")
+	if err := gmailClient.Connect(ctx); err != nil {
+		log.Error(fmt.Sprintf("Failed to connect to Gmail: %v", err))
+		return nil, err
+	}
+	return gmailClient, nil
+}
+
+// runContext returns the context of a command run. It is cancelled on Ctrl-C
+// or SIGTERM rather than after a fixed time, since a large mailbox can take
+// hours; every API request and attachment download has its own timeout.
+func runContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// outputFlags are the flags get, download and sync share to choose how emails
+// are saved. Flags that map straight to a writer option are bound to options.
+type outputFlags struct {
+	options           output.Options
+	outputFormat      string
+	maxAttachmentSize string
+	printTemplate     string
+	pdf               bool
+}
+
+// addOutputFlags registers the output flags on a command
+func addOutputFlags(cmd *cobra.Command, f *outputFlags) {
+	flags := cmd.Flags()
+	flags.StringVarP(&f.options.Format, "format", "f", output.FormatHTML, "Email format to save: html, eml or both")
+	flags.StringVarP(&f.outputFormat, "output-format", "o", output.OutputFiles, "Output layout: files (one folder per email), mbox or maildir")
+	flags.BoolVar(&f.options.MboxPerLabel, "mbox-per-label", false, "With --output-format mbox, write one mbox file per Gmail label")
+	flags.StringVar(&f.options.FilenamePolicy, "filenames", output.FilenamesUnicode, "File name policy: unicode, ascii (transliterated) or windows")
+	flags.StringVar(&f.options.Layout, "layout", "", "Folder layout template, e.g. \"{{.Year}}/{{.Month}}/{{.Date}}_{{.From}}_{{.Subject}}\" (files output only)")
+	flags.StringVar(&f.maxAttachmentSize, "max-attachment-size", "", "Skip attachments larger than this size (e.g. 25M), recording them in the metadata; unlimited by default")
+	flags.StringVar(&f.options.AttachmentStore, "attachment-store", output.AttachmentStoreNone, "Save attachments once in a content-addressed store under attachments/sha256 and hardlink, symlink or reference them from each email: none, hardlink, symlink or reference (files output only)")
+	flags.StringVar(&f.options.InlineImages, "inline-images", output.InlineImagesLink, "Rewrite cid: image references in the HTML body to \"link\" the saved images or \"embed\" them as data: URIs for a self-contained file")
+	flags.StringVar(&f.options.SanitizeHTML, "sanitize-html", output.HTMLSanitizeOff, "Sanitize the saved HTML body, keeping the original as _body.orig.html: off, block (strip scripts and remote resources) or localize (also download remote images)")
+	flags.BoolVar(&f.options.Print, "print", false, "Also write a printable {prefix}_print.html with a header table, attachment list and body")
+	flags.StringVar(&f.printTemplate, "print-template", "", "html/template file for the printable page (implies --print)")
+	flags.BoolVar(&f.pdf, "pdf", false, "Also convert the printable page to {prefix}.pdf with headless Chrome or Chromium (implies --print)")
+}
+
+// newWriter creates the writer the output flags select for outputDir and
+// returns the Gmail message format that has to be fetched for it
+func (f *outputFlags) newWriter(log interfaces.Logger, outputDir string) (interfaces.OutputWriter, string, error) {
+	options := f.options
+	attachmentLimit, err := parseSizeFlag("max-attachment-size", f.maxAttachmentSize)
+	if err != nil {
+		return nil, "", err
+	}
+	options.MaxAttachmentSize = attachmentLimit
+
+	if err := setPrintOptions(&options, f.printTemplate, f.pdf); err != nil {
+		return nil, "", err
+	}
+	setSearchIndexer(&options, outputDir, f.outputFormat)
+	return newOutputWriter(log, f.outputFormat, options)
+}
+
+// setPrintOptions fills in the printable page options from the
+// --print-template and --pdf flags
+func setPrintOptions(options *output.Options, templatePath string, toPDF bool) error {
+	if templatePath != "" {
+		data, err := os.ReadFile(templatePath)
+		if err != nil {
+			return fmt.Errorf("failed to read print template: %v", err)
+		}
+		options.PrintTemplate = string(data)
+	}
+	if toPDF {
+		renderer, err := pdf.NewChromeRenderer()
+		if err != nil {
+			return err
+		}
+		options.PDFRenderer = renderer
+	}
+	return nil
+}
+
+// setSearchIndexer keeps the search index of the output directory current
+// while downloading, once `getgmail index` has created one
+func setSearchIndexer(options *output.Options, outputDir, outputFormat string) {
+	if outputFormat == output.OutputFiles && search.Exists(outputDir) {
+		options.SearchIndexer = search.NewIndexer(outputDir)
+	}
+}
+
+// newOutputWriter creates the writer for the chosen output format and returns
+// the Gmail message format that has to be fetched for it
+func newOutputWriter(log interfaces.Logger, outputFormat string, options output.Options) (interfaces.OutputWriter, string, error) {
+	if err := output.ValidateFormat(options.Format); err != nil {
+		return nil, "", err
+	}
+
+	writer, err := output.NewWriter(log, outputFormat, options)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fetchFormat := options.Format
+	if output.RequiresRaw(outputFormat) {
+		fetchFormat = output.FormatEML
+	}
+	return writer, fetchFormat, nil
+}
+
+// downloadStats counts the outcome of a batch of message downloads
+type downloadStats struct {
+	processed int
+	skipped   int
+	failed    int
+}
+
+func (s downloadStats) allFailed() bool {
+	return s.processed == 0 && s.skipped == 0 && s.failed > 0
+}
+
+// fetchResult is the outcome of fetching one message or thread in the worker pool
+type fetchResult struct {
+	email   *interfaces.EmailMessage
+	thread  *interfaces.EmailThread
+	skipped bool
+	err     error
+}
+
+// downloadOptions controls how downloadMessages fetches and stores emails
+type downloadOptions struct {
+	outputDir   string
+	concurrency int
+	format      string
+}
+
+// downloadMessages fetches the given message IDs with a pool of workers and
+// writes them in listing order, skipping emails the writer's message index
+// already knows. Emails are identified by their message ID only, so distinct
+// messages whose folder names would be equal are all written.
+func downloadMessages(ctx context.Context, log interfaces.Logger, gmailClient interfaces.GmailClient, writer interfaces.OutputWriter, ids []string, opts downloadOptions) (downloadStats, error) {
+	fetch := func(id string) fetchResult {
+		return fetchMessage(ctx, gmailClient, writer, id, opts.format, opts.outputDir)
+	}
+	write := func(res fetchResult) error {
+		defer output.DiscardStaged(res.email)
+		return writer.WriteEmail(ctx, res.email, opts.outputDir)
+	}
+	return runDownloads(ctx, log, "message", ids, opts.concurrency, fetch, write)
+}
+
+// downloadThreads fetches the given conversations with a pool of workers and
+// writes each into its own thread folder, skipping threads whose messages
+// are all stored already
+func downloadThreads(ctx context.Context, log interfaces.Logger, gmailClient interfaces.GmailClient, writer interfaces.ThreadWriter, threadIDs []string, opts downloadOptions) (downloadStats, error) {
+	fetch := func(id string) fetchResult {
+		return fetchThread(ctx, gmailClient, writer, id, opts.format, opts.outputDir)
+	}
+	write := func(res fetchResult) error {
+		defer discardThread(res.thread)
+		return writer.WriteThread(ctx, res.thread, opts.outputDir)
+	}
+	return runDownloads(ctx, log, "thread", threadIDs, opts.concurrency, fetch, write)
+}
+
+// runDownloads fetches ids with a pool of workers and writes the results in
+// listing order. kind names the fetched items in log messages.
+func runDownloads(ctx context.Context, log interfaces.Logger, kind string, ids []string, concurrency int, fetch func(id string) fetchResult, write func(res fetchResult) error) (downloadStats, error) {
+	var stats downloadStats
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]chan fetchResult, len(ids))
+	for i := range results {
+		results[i] = make(chan fetchResult, 1)
+	}
+
+	// The window bounds how far the workers may run ahead of the writer so
+	// that a slow message does not make fetched emails pile up in memory
+	window := make(chan struct{}, concurrency*2)
+	jobs := make(chan int)
+
+	go func() {
+		defer close(jobs)
+		for i := range ids {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			for i := range jobs {
+				log.Info(fmt.Sprintf("Processing %s %d/%d (ID: %s)", kind, i+1, len(ids), ids[i]))
+				results[i] <- fetch(ids[i])
+			}
+		}()
+	}
+
+	for i, id := range ids {
+		var res fetchResult
+		select {
+		case res = <-results[i]:
+		case <-ctx.Done():
+			log.Error("Operation cancelled")
+			return stats, ctx.Err()
+		}
+		<-window
+
+		if res.skipped {
+			log.Info(fmt.Sprintf("Skipping already downloaded %s %s", kind, id))
+			stats.skipped++
+			continue
+		}
+
+		if res.err != nil {
+			log.Error(fmt.Sprintf("Failed to get %s %s: %v", kind, id, res.err))
+			stats.failed++
+			continue
+		}
+
+		// Write email to disk
+		if err := write(res); err != nil {
+			log.Error(fmt.Sprintf("Failed to write %s %s: %v", kind, id, err))
+			stats.failed++
+			continue
+		}
+		stats.processed++
+	}
+
+	return stats, nil
+}
+
+// fetchMessage runs in a worker and downloads a single message in the
+// requested format unless it is already known to the writer's index
+func fetchMessage(ctx context.Context, gmailClient interfaces.GmailClient, writer interfaces.OutputWriter, id string, format, outputDir string) fetchResult {
+	// Skip known emails before spending any API quota on them
+	if writer.IsDownloaded(id) {
+		return fetchResult{skipped: true}
+	}
+
+	email, err := getEmail(ctx, gmailClient, id, format)
+	if err != nil {
+		return fetchResult{err: err}
+	}
+	if err := stageAttachments(ctx, writer, email, outputDir); err != nil {
+		return fetchResult{err: err}
+	}
+	return fetchResult{email: email}
+}
+
+// fetchThread runs in a worker and downloads every message of a
+// conversation. All messages are fetched once any of them is new, since the
+// thread page is rendered from the whole conversation.
+func fetchThread(ctx context.Context, gmailClient interfaces.GmailClient, writer interfaces.ThreadWriter, id string, format, outputDir string) fetchResult {
+	thread, err := gmailClient.GetThread(ctx, id)
+	if err != nil {
+		return fetchResult{err: err}
+	}
+	if writer.IsThreadDownloaded(thread) {
+		return fetchResult{skipped: true}
+	}
+
+	emailThread := &interfaces.EmailThread{ID: thread.ID}
+	for _, messageID := range thread.MessageIDs {
+		email, err := getEmail(ctx, gmailClient, messageID, format)
+		if err == nil && !writer.IsDownloaded(messageID) {
+			// Messages already in the thread folder are only needed for the thread page
+			err = stageAttachments(ctx, writer, email, outputDir)
+		}
+		if err != nil {
+			discardThread(emailThread)
+			return fetchResult{err: err}
+		}
+		emailThread.Messages = append(emailThread.Messages, email)
+	}
+	return fetchResult{thread: emailThread}
+}
+
+// stageAttachments downloads the email's attachments to disk in the worker
+// when the writer saves attachments
+func stageAttachments(ctx context.Context, writer interfaces.OutputWriter, email *interfaces.EmailMessage, outputDir string) error {
+	stager, ok := writer.(interfaces.AttachmentStager)
+	if !ok {
+		return nil
+	}
+	if err := stager.StageAttachments(ctx, email, outputDir); err != nil {
+		output.DiscardStaged(email)
+		return err
+	}
+	return nil
+}
+
+// discardThread removes staged attachments of every message in a thread
+func discardThread(thread *interfaces.EmailThread) {
+	for _, email := range thread.Messages {
+		output.DiscardStaged(email)
+	}
+}
+
+// getEmail downloads a message in the requested format
+func getEmail(ctx context.Context, gmailClient interfaces.GmailClient, id string, format string) (*interfaces.EmailMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// The raw message carries all headers, so eml alone needs a single call
+	if format == output.FormatEML {
+		return gmailClient.GetRawMessage(ctx, id)
+	}
+
+	email, err := gmailClient.GetMessage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == output.FormatBoth {
+		raw, err := gmailClient.GetRawMessage(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		email.Raw = raw.Raw
+	}
+
+	return email, nil
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Info(string)  {}
+func (nopLogger) Error(string) {}
+func (nopLogger) Warn(string)  {}
+func (nopLogger) Debug(string) {}
+
+func TestRunDownloads(t *testing.T) {
+	ids := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	fetch := func(id string) fetchResult {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+
+		// Earlier IDs take longer, so fetches finish out of order
+		time.Sleep(time.Duration('h'-id[0]) * 2 * time.Millisecond)
+		switch id {
+		case "c":
+			return fetchResult{skipped: true}
+		case "e":
+			return fetchResult{err: errors.New("not found")}
+		}
+		return fetchResult{email: &interfaces.EmailMessage{ID: id}}
+	}
+
+	var written []string
+	write := func(res fetchResult) error {
+		written = append(written, res.email.ID)
+		if res.email.ID == "g" {
+			return errors.New("disk full")
+		}
+		return nil
+	}
+
+	stats, err := runDownloads(context.Background(), nopLogger{}, "message", ids, 3, fetch, write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "d", "f", "g", "h"}; !reflect.DeepEqual(written, want) {
+		t.Errorf("written in order %v, want %v", written, want)
+	}
+	if want := (downloadStats{processed: 5, skipped: 1, failed: 2}); stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+	if maxRunning > 3 {
+		t.Errorf("%d fetches ran at once with a concurrency of 3", maxRunning)
+	}
+}
+
+func TestRunDownloadsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fetch := func(id string) fetchResult {
+		if id == "b" {
+			cancel()
+		}
+		return fetchResult{email: &interfaces.EmailMessage{ID: id}}
+	}
+	var written []string
+	write := func(res fetchResult) error {
+		written = append(written, res.email.ID)
+		return nil
+	}
+
+	ids := make([]string, 100)
+	for i := range ids {
+		ids[i] = string(rune('a' + i%26))
+	}
+	stats, err := runDownloads(ctx, nopLogger{}, "message", ids, 1, fetch, write)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("runDownloads returned %v, want the context error", err)
+	}
+	if stats.processed != len(written) || len(written) >= len(ids) {
+		t.Errorf("processed %d, wrote %v after cancelling", stats.processed, written)
+	}
+}
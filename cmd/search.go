@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/perarneng/getgmail/pkg/search"
+)
+
+var (
+	searchOutputDir string
+	searchLimit     int
+)
+
+var searchCmd = &cobra.Command{
+	Use:   "search [query]",
+	Short: "Search downloaded emails",
+	Long: `Search the index built by the index command and print the folder and a
+snippet of each matching email, newest first.
+
+Words match any field and all of them have to match. Field filters narrow a
+word to one field: from:, to:, subject:, body:, attachment: (or filename:) and
+label: (or in:). before: and after: take a YYYY-MM-DD date, has:attachment
+matches emails with attachments. A leading - excludes matches, a trailing *
+matches word prefixes and "quoted values" may contain spaces.
+
+  getgmail search -d ./emails 'invoice from:billing@example.com after:2024-01-01'`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: runSearch,
+}
+
+func init() {
+	searchCmd.Flags().StringVarP(&searchOutputDir, "output-dir", "d", "", "Output directory holding the downloaded emails (required)")
+	searchCmd.Flags().IntVarP(&searchLimit, "limit", "n", 50, "Maximum number of results to print (0 for all)")
+	searchCmd.MarkFlagRequired("output-dir")
+
+	rootCmd.AddCommand(searchCmd)
+}
+
+func runSearch(cmd *cobra.Command, args []string) error {
+	query, err := search.ParseQuery(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	index, err := search.Load(searchOutputDir)
+	if err != nil {
+		return err
+	}
+
+	hits, err := index.Search(query)
+	if err != nil {
+		return err
+	}
+	shown := 0
+	for _, doc := range hits {
+		if searchLimit > 0 && shown == searchLimit {
+			break
+		}
+		folder := filepath.Join(searchOutputDir, filepath.FromSlash(doc.Folder))
+		if _, err := os.Stat(folder); err != nil {
+			// Deleted since it was indexed
+			continue
+		}
+		shown++
+
+		subject := doc.Subject
+		if subject == "" {
+			subject = "(no subject)"
+		}
+		fmt.Printf("%s  %s  %s\n", doc.Time().Local().Format("2006-01-02 15:04"), doc.From, subject)
+		fmt.Printf("  %s\n", folder)
+		if snippet := search.Snippet(searchOutputDir, doc, query); snippet != "" {
+			fmt.Printf("  %s\n", snippet)
+		}
+		fmt.Println()
+	}
+
+	if shown < len(hits) && searchLimit > 0 && shown == searchLimit {
+		fmt.Printf("Showing %d of %d matches, use --limit to see more\n", shown, len(hits))
+	} else {
+		fmt.Printf("%d matches\n", shown)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/perarneng/getgmail/pkg/logger"
+	"github.com/perarneng/getgmail/pkg/output"
+)
+
+var siteOutputDir string
+
+var siteCmd = &cobra.Command{
+	Use:   "site",
+	Short: "Generate a static HTML browser for downloaded emails",
+	Long: `Generate index.html in the output directory, listing every downloaded email
+with links to its body and attachments, plus pages per label, per month and per
+conversation. The pages work when opened straight from disk, no server needed.
+Run it again after downloading to update the pages.`,
+	RunE: runSite,
+}
+
+func init() {
+	siteCmd.Flags().StringVarP(&siteOutputDir, "output-dir", "d", "", "Output directory holding the downloaded emails (required)")
+	siteCmd.MarkFlagRequired("output-dir")
+
+	rootCmd.AddCommand(siteCmd)
+}
+
+func runSite(cmd *cobra.Command, args []string) error {
+	log := logger.NewLogger()
+
+	writer := output.NewFileWriter(log, output.Options{})
+	if err := writer.ValidateOutputDir(siteOutputDir); err != nil {
+		return err
+	}
+
+	result, err := output.GenerateSite(log, siteOutputDir)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to generate site: %v", err))
+		return err
+	}
+
+	log.Info(fmt.Sprintf("Generated site for %d emails with %d label, %d month and %d thread pages. Open %s",
+		result.Emails, result.Labels, result.Months, result.Threads, filepath.Join(siteOutputDir, output.SiteIndexFileName)))
+	return nil
+}
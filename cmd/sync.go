@@ -0,0 +1,277 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/spf13/cobra"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+	"github.com/perarneng/getgmail/pkg/logger"
+	"github.com/perarneng/getgmail/pkg/state"
+)
+
+var (
+	syncMailbox     string
+	syncOutputDir   string
+	syncCount       int
+	syncConcurrency int
+	syncOutputOpts  outputFlags
+)
+
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Incrementally sync a Gmail mailbox to a local folder",
+	Long: `Sync a Gmail mailbox to a local directory. The first run lists the mailbox and
+records Gmail's history ID in the output directory. Later runs only fetch the
+messages added or relabeled into the mailbox since then, update the labels of
+saved emails that were relabeled and mark saved emails that were deleted in
+Gmail. If the saved history ID has expired, sync falls back to a full listing.`,
+	RunE: runSync,
+}
+
+func init() {
+	syncCmd.Flags().StringVarP(&syncMailbox, "mailbox", "m", "INBOX", "Gmail mailbox/label to sync")
+	syncCmd.Flags().StringVarP(&syncOutputDir, "output-dir", "d", "", "Output directory for downloaded emails (required)")
+	syncCmd.Flags().IntVarP(&syncCount, "count", "c", 0, "Maximum number of emails to list when a full sync is needed, 0 for the whole mailbox. A capped listing does not save the sync state")
+	syncCmd.Flags().IntVarP(&syncConcurrency, "concurrency", "j", 4, "Number of messages to fetch in parallel")
+	addOutputFlags(syncCmd, &syncOutputOpts)
+	syncCmd.MarkFlagRequired("output-dir")
+
+	rootCmd.AddCommand(syncCmd)
+}
+
+func runSync(cmd *cobra.Command, args []string) error {
+	// Load .env file if it exists
+	if err := godotenv.Load(); err != nil {
+		// Don't fail if .env doesn't exist, just continue
+	}
+
+	log := logger.NewLogger()
+
+	writer, fetchFormat, err := syncOutputOpts.newWriter(log, syncOutputDir)
+	if err != nil {
+		return err
+	}
+	if err := writer.ValidateOutputDir(syncOutputDir); err != nil {
+		return err
+	}
+
+	if err := writer.LoadIndex(syncOutputDir); err != nil {
+		return err
+	}
+
+	syncState, err := state.Load(syncOutputDir)
+	if err != nil {
+		return err
+	}
+	if syncState != nil && syncState.Mailbox != syncMailbox {
+		log.Warn(fmt.Sprintf("Sync state belongs to mailbox %s, starting a full sync of %s", syncState.Mailbox, syncMailbox))
+		syncState = nil
+	}
+
+	ctx, cancel := runContext()
+	defer cancel()
+
+	gmailClient, err := connectGmail(ctx, log)
+	if err != nil {
+		return err
+	}
+
+	var ids, relabeled, deleted []string
+	var historyID uint64
+	truncated := false
+
+	if syncState != nil {
+		log.Info(fmt.Sprintf("Fetching changes to %s since history ID %d...", syncMailbox, syncState.HistoryID))
+		changes, err := gmailClient.ListHistory(ctx, syncMailbox, syncState.HistoryID)
+		switch {
+		case errors.Is(err, interfaces.ErrHistoryExpired):
+			log.Warn(fmt.Sprintf("History ID %d has expired, falling back to a full listing", syncState.HistoryID))
+		case err != nil:
+			log.Error(fmt.Sprintf("Failed to list history: %v", err))
+			return err
+		default:
+			historyID = changes.HistoryID
+			ids = historyDownloadIDs(changes)
+			// Taken before downloading, so only emails saved by earlier runs
+			relabeled = savedIDs(writer, historyRelabeledIDs(changes))
+			deleted = savedIDs(writer, changes.Deleted)
+			log.Info(fmt.Sprintf("History: %d added, %d deleted, %d labeled, %d unlabeled",
+				len(changes.Added), len(changes.Deleted), len(changes.LabelsAdded), len(changes.LabelsRemoved)))
+		}
+	}
+
+	if historyID == 0 {
+		// Record the history ID before listing so nothing that changes during
+		// the listing is missed by the next sync
+		historyID, err = gmailClient.GetHistoryID(ctx)
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to get history ID: %v", err))
+			return err
+		}
+
+		if syncCount > 0 {
+			log.Info(fmt.Sprintf("Fetching message list (max %d messages)...", syncCount))
+		} else {
+			log.Info(fmt.Sprintf("Fetching the message list of %s...", syncMailbox))
+		}
+		messages, err := gmailClient.ListMessages(ctx, syncMailbox, int64(syncCount))
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to list messages: %v", err))
+			return err
+		}
+		// Older messages past the cap would never be fetched once the history
+		// ID is saved, so a capped listing leaves the next run a full sync
+		truncated = syncCount > 0 && len(messages) >= syncCount
+		for _, msg := range messages {
+			ids = append(ids, msg.Id)
+		}
+	}
+
+	log.Info(fmt.Sprintf("Found %d messages to process", len(ids)))
+
+	stats, err := downloadMessages(ctx, log, gmailClient, writer, ids, downloadOptions{
+		outputDir:   syncOutputDir,
+		concurrency: syncConcurrency,
+		format:      fetchFormat,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(relabeled) > 0 || len(deleted) > 0 {
+		failed, err := applyHistory(ctx, log, gmailClient, writer, relabeled, deleted, syncOutputDir)
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to update saved emails: %v", err))
+			return err
+		}
+		stats.failed += failed
+	}
+
+	log.Info(fmt.Sprintf("Sync completed. Processed: %d, Skipped: %d, Failed: %d. Emails saved to: %s",
+		stats.processed, stats.skipped, stats.failed, syncOutputDir))
+
+	// Keep the old history ID when messages failed so they are retried next run
+	if stats.failed > 0 {
+		log.Warn("Some messages failed, sync state not advanced")
+		if stats.allFailed() {
+			return fmt.Errorf("all email downloads failed")
+		}
+		return nil
+	}
+	if truncated {
+		log.Warn(fmt.Sprintf("The listing was capped at --count %d emails, sync state not saved. Run without --count to sync the whole mailbox", syncCount))
+		return nil
+	}
+
+	if err := state.Save(syncOutputDir, &state.SyncState{
+		Mailbox:   syncMailbox,
+		HistoryID: historyID,
+		LastSync:  time.Now(),
+	}); err != nil {
+		log.Error(fmt.Sprintf("Failed to save sync state: %v", err))
+		return err
+	}
+	log.Info(fmt.Sprintf("Saved sync state at history ID %d", historyID))
+
+	return nil
+}
+
+// historyDownloadIDs returns the messages that entered the mailbox, either by
+// arriving or by being labeled, without duplicates
+func historyDownloadIDs(changes *interfaces.HistoryChanges) []string {
+	deleted := make(map[string]bool)
+	for _, id := range changes.Deleted {
+		deleted[id] = true
+	}
+
+	seen := make(map[string]bool)
+	var ids []string
+	for _, list := range [][]string{changes.Added, changes.LabelsAdded} {
+		for _, id := range list {
+			if deleted[id] || seen[id] {
+				continue
+			}
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// historyRelabeledIDs returns the messages whose labels changed, without
+// duplicates and without deleted messages
+func historyRelabeledIDs(changes *interfaces.HistoryChanges) []string {
+	deleted := make(map[string]bool)
+	for _, id := range changes.Deleted {
+		deleted[id] = true
+	}
+
+	seen := make(map[string]bool)
+	var ids []string
+	for _, list := range [][]string{changes.LabelsAdded, changes.LabelsRemoved} {
+		for _, id := range list {
+			if deleted[id] || seen[id] {
+				continue
+			}
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// savedIDs returns the messages the writer has saved already
+func savedIDs(writer interfaces.OutputWriter, ids []string) []string {
+	var saved []string
+	for _, id := range ids {
+		if writer.IsDownloaded(id) {
+			saved = append(saved, id)
+		}
+	}
+	return saved
+}
+
+// applyHistory brings saved emails up to date with the label changes and
+// deletions found in the history, when the writer supports it. It returns
+// the number of emails whose labels could not be fetched.
+func applyHistory(ctx context.Context, log interfaces.Logger, gmailClient interfaces.GmailClient, writer interfaces.OutputWriter, relabeled, deleted []string, outputDir string) (int, error) {
+	updater, ok := writer.(interfaces.MailboxUpdater)
+	if !ok {
+		log.Info(fmt.Sprintf("Keeping %d relabeled and %d deleted emails as saved", len(relabeled), len(deleted)))
+		return 0, nil
+	}
+
+	failed := 0
+	var emails []*interfaces.EmailMessage
+	for _, id := range relabeled {
+		email, err := gmailClient.GetMessageLabels(ctx, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return failed, ctx.Err()
+			}
+			log.Error(fmt.Sprintf("Failed to get the labels of email %s: %v", id, err))
+			failed++
+			continue
+		}
+		emails = append(emails, email)
+	}
+
+	if len(emails) > 0 {
+		if err := updater.UpdateLabels(ctx, emails, outputDir); err != nil {
+			return failed, err
+		}
+		log.Info(fmt.Sprintf("Updated the labels of %d relabeled emails", len(emails)))
+	}
+	if len(deleted) > 0 {
+		if err := updater.MarkDeleted(ctx, deleted, outputDir); err != nil {
+			return failed, err
+		}
+		log.Info(fmt.Sprintf("Marked %d emails deleted in Gmail", len(deleted)))
+	}
+	return failed, nil
+}
@@ -0,0 +1,148 @@
+package gmail
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/perarneng/getgmail/pkg/ratelimit"
+)
+
+// downloadAttachment streams an attachment to w. Users.Messages.Attachments.Get
+// returns the content base64 encoded inside a JSON document, so the response
+// is read directly instead of through the generated client, which would hold
+// the whole document in memory. Failed requests are retried once as long as
+// nothing has been written yet.
+func (c *Client) downloadAttachment(ctx context.Context, messageID, attachmentID string, size int64, w io.Writer) (int64, error) {
+	if c.service == nil || c.attachmentClient == nil {
+		return 0, fmt.Errorf("gmail service not connected")
+	}
+
+	n, err := c.streamAttachment(ctx, messageID, attachmentID, size, w)
+	if err != nil && n == 0 && c.isRetryableError(err) {
+		time.Sleep(2 * time.Second)
+		n, err = c.streamAttachment(ctx, messageID, attachmentID, size, w)
+	}
+	if err != nil {
+		return n, fmt.Errorf("unable to download attachment: %v", err)
+	}
+	return n, nil
+}
+
+func (c *Client) streamAttachment(ctx context.Context, messageID, attachmentID string, size int64, w io.Writer) (int64, error) {
+	// Allow 45 seconds plus one second per 100KB so large files can finish
+	attachCtx, cancel := context.WithTimeout(ctx, 45*time.Second+time.Duration(size/(100*1024))*time.Second)
+	defer cancel()
+
+	if err := c.limiter.Wait(ctx, ratelimit.CostAttachmentsGet); err != nil {
+		return 0, err
+	}
+
+	endpoint := fmt.Sprintf("%sgmail/v1/users/%s/messages/%s/attachments/%s?alt=json",
+		c.service.BasePath, url.PathEscape(c.userID), url.PathEscape(messageID), url.PathEscape(attachmentID))
+	req, err := http.NewRequestWithContext(attachCtx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.attachmentClient.Do(req)
+	if err == nil {
+		// CheckResponse turns error statuses into *googleapi.Error, which the
+		// rate limit and retry checks understand
+		err = googleapi.CheckResponse(resp)
+		if err != nil {
+			resp.Body.Close()
+		}
+	}
+	c.observe(err)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := jsonStringReader(resp.Body, "data")
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(w, base64.NewDecoder(base64.RawURLEncoding, data))
+}
+
+// jsonStringReader returns a reader over the raw characters of the string
+// value of field in a JSON document, without decoding the document. It is
+// only meant for values that need no unescaping, like base64 data; base64
+// padding is dropped so the value decodes with a Raw encoding.
+func jsonStringReader(r io.Reader, field string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	key := `"` + field + `"`
+
+	matched := 0
+	for matched < len(key) {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("no %q field in response", field)
+		}
+		switch {
+		case b == key[matched]:
+			matched++
+		case b == key[0]:
+			matched = 1
+		default:
+			matched = 0
+		}
+	}
+
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("no %q value in response", field)
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n', ':':
+			continue
+		case '"':
+			return &jsonStringValue{r: br}, nil
+		}
+		return nil, fmt.Errorf("%q field in response is not a string", field)
+	}
+}
+
+// jsonStringValue reads a JSON string value up to its closing quote
+type jsonStringValue struct {
+	r    *bufio.Reader
+	done bool
+}
+
+func (v *jsonStringValue) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && !v.done {
+		b, err := v.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, io.ErrUnexpectedEOF
+		}
+		switch b {
+		case '"':
+			v.done = true
+		case '=':
+			// base64 padding
+		case '\\':
+			return n, fmt.Errorf("unexpected escape sequence in string value")
+		default:
+			p[n] = b
+			n++
+		}
+	}
+	if n == 0 && v.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
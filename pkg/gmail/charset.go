@@ -0,0 +1,77 @@
+package gmail
+
+import (
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"google.golang.org/api/gmail/v1"
+)
+
+// metaCharsetRe matches charset declarations in HTML meta tags, both
+// <meta charset="x"> and <meta http-equiv="Content-Type" content="text/html; charset=x">
+var metaCharsetRe = regexp.MustCompile(`(?i)(<meta[^>]*charset\s*=\s*["']?)([\w.:-]+)`)
+
+// partCharset returns the charset parameter of a part's Content-Type header,
+// lower-cased, or "" if none is declared
+func partCharset(part *gmail.MessagePart) string {
+	for _, header := range part.Headers {
+		if !strings.EqualFold(header.Name, "Content-Type") {
+			continue
+		}
+		_, params, err := mime.ParseMediaType(header.Value)
+		if err != nil {
+			// Fall back to a plain search for broken headers
+			lower := strings.ToLower(header.Value)
+			if idx := strings.Index(lower, "charset="); idx != -1 {
+				value := strings.Trim(lower[idx+8:], `"' `)
+				if end := strings.IndexAny(value, `"'; `); end != -1 {
+					value = value[:end]
+				}
+				return value
+			}
+			return ""
+		}
+		return strings.ToLower(params["charset"])
+	}
+	return ""
+}
+
+// decodeCharset transcodes text in the given charset to UTF-8. Text without a
+// declared charset is assumed to be UTF-8 already.
+func decodeCharset(data []byte, charset string) (string, error) {
+	switch charset {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return string(data), nil
+	}
+
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return string(data), fmt.Errorf("unsupported charset %q", charset)
+	}
+
+	decoded, err := encoding.NewDecoder().Bytes(data)
+	if err != nil {
+		return string(data), fmt.Errorf("unable to decode %s text: %v", charset, err)
+	}
+	return string(decoded), nil
+}
+
+// decodeTextPart decodes a text part to UTF-8. HTML parts get their meta
+// charset declaration rewritten so browsers do not decode them a second time.
+func (c *Client) decodeTextPart(data []byte, charset, mimeType string) string {
+	content, err := decodeCharset(data, charset)
+	if err != nil {
+		c.logger.Warn(fmt.Sprintf("%v, keeping text as is", err))
+		// Replace invalid bytes so the saved files are valid UTF-8
+		return strings.ToValidUTF8(content, string(utf8.RuneError))
+	}
+
+	if mimeType == "text/html" && charset != "" {
+		content = metaCharsetRe.ReplaceAllString(content, "${1}utf-8")
+	}
+	return content
+}
@@ -5,10 +5,12 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -18,16 +20,26 @@ import (
 	"google.golang.org/api/option"
 
 	"github.com/perarneng/getgmail/pkg/interfaces"
+	"github.com/perarneng/getgmail/pkg/ratelimit"
 )
 
 type Client struct {
-	service *gmail.Service
-	userID  string
+	service          *gmail.Service
+	attachmentClient *http.Client
+	userID           string
+	limiter          *ratelimit.Limiter
+	logger           interfaces.Logger
+
+	labelsMu   sync.Mutex
+	labelIDs   map[string]string
+	labelNames map[string]string
 }
 
-func NewClient() interfaces.GmailClient {
+func NewClient(logger interfaces.Logger) interfaces.GmailClient {
 	return &Client{
-		userID: "me",
+		userID:  "me",
+		limiter: ratelimit.NewLimiter(ratelimit.DefaultUnitsPerSecond),
+		logger:  logger,
 	}
 }
 
@@ -63,26 +75,33 @@ func (c *Client) Connect(ctx context.Context) error {
 	}
 
 	// Create HTTP client with timeouts
+	transport := &http.Transport{
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	}
 	httpClient := &http.Client{
-		Timeout: 60 * time.Second, // Overall request timeout
-		Transport: &http.Transport{
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 10,
-			IdleConnTimeout:     90 * time.Second,
-			TLSHandshakeTimeout: 10 * time.Second,
-			ResponseHeaderTimeout: 30 * time.Second,
-		},
-	}
-	
-	// Wrap the HTTP client with OAuth2
+		Timeout:   60 * time.Second, // Overall request timeout
+		Transport: transport,
+	}
+
+	// Wrap the HTTP client with OAuth2. Both clients share one token source
+	// so a refreshed token is used by both.
 	ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
-	client := config.Client(ctx, tok)
+	authTransport := &oauth2.Transport{Source: config.TokenSource(ctx, tok), Base: transport}
+	client := &http.Client{Timeout: httpClient.Timeout, Transport: authTransport}
 	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
 		return fmt.Errorf("unable to retrieve Gmail client: %v", err)
 	}
 
 	c.service = srv
+	// Attachment downloads run as long as their size needs, bounded by the
+	// context deadline in streamAttachment instead of an overall timeout.
+	// ResponseHeaderTimeout still catches a server that never answers.
+	c.attachmentClient = &http.Client{Transport: authTransport}
 	return nil
 }
 
@@ -92,7 +111,7 @@ func (c *Client) tokenFromFile(file string) (*oauth2.Token, error) {
 		return nil, err
 	}
 	defer f.Close()
-	
+
 	tok := &oauth2.Token{}
 	err = json.NewDecoder(f).Decode(tok)
 	return tok, err
@@ -125,28 +144,64 @@ func (c *Client) saveToken(path string, token *oauth2.Token) {
 }
 
 func (c *Client) ListMessages(ctx context.Context, mailbox string, maxResults int64) ([]*gmail.Message, error) {
+	return c.SearchMessages(ctx, interfaces.MessageFilter{
+		LabelIDs:   []string{mailbox},
+		MaxResults: maxResults,
+	})
+}
+
+// SearchMessages lists up to filter.MaxResults messages matching the filter,
+// newest first. A zero MaxResults lists every matching message.
+func (c *Client) SearchMessages(ctx context.Context, filter interfaces.MessageFilter) ([]*gmail.Message, error) {
 	if c.service == nil {
 		return nil, fmt.Errorf("gmail service not connected")
 	}
 
+	labelIDs, err := c.resolveLabelIDs(ctx, filter.LabelIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Gmail only intersects label IDs, so a union is searched for with one
+	// query that ORs the labels, keeping Gmail's newest first order
+	if filter.AnyLabel && len(labelIDs) > 1 {
+		return c.listMessages(ctx, nil, c.anyLabelQuery(buildQuery(filter), labelIDs), filter.MaxResults)
+	}
+
+	return c.listMessages(ctx, labelIDs, buildQuery(filter), filter.MaxResults)
+}
+
+// listMessages pages through Users.Messages.List until maxResults messages
+// have been collected, or through the whole listing when maxResults is zero
+func (c *Client) listMessages(ctx context.Context, labelIDs []string, query string, maxResults int64) ([]*gmail.Message, error) {
 	var messages []*gmail.Message
 	pageToken := ""
 	remaining := maxResults
 
-	for remaining > 0 {
-		call := c.service.Users.Messages.List(c.userID).LabelIds(mailbox)
+	for {
+		call := c.service.Users.Messages.List(c.userID)
+		if len(labelIDs) > 0 {
+			call = call.LabelIds(labelIDs...)
+		}
+		if query != "" {
+			call = call.Q(query)
+		}
 		if pageToken != "" {
 			call = call.PageToken(pageToken)
 		}
-		
+
 		// Set page size to remaining count or max page size (500)
-		pageSize := remaining
-		if pageSize > 500 {
-			pageSize = 500
+		pageSize := int64(500)
+		if maxResults > 0 && remaining < pageSize {
+			pageSize = remaining
 		}
 		call = call.MaxResults(pageSize)
 
+		if err := c.limiter.Wait(ctx, ratelimit.CostMessagesList); err != nil {
+			return nil, err
+		}
 		resp, err := call.Context(ctx).Do()
+		c.observe(err)
 		if err != nil {
 			return nil, fmt.Errorf("unable to retrieve messages: %v", err)
 		}
@@ -154,7 +209,7 @@ func (c *Client) ListMessages(ctx context.Context, mailbox string, maxResults in
 		messages = append(messages, resp.Messages...)
 		remaining -= int64(len(resp.Messages))
 
-		if resp.NextPageToken == "" || remaining <= 0 {
+		if resp.NextPageToken == "" || (maxResults > 0 && remaining <= 0) {
 			break
 		}
 		pageToken = resp.NextPageToken
@@ -163,40 +218,236 @@ func (c *Client) ListMessages(ctx context.Context, mailbox string, maxResults in
 	return messages, nil
 }
 
-func (c *Client) GetMessage(ctx context.Context, messageID string) (*interfaces.EmailMessage, error) {
+// buildQuery turns the structured parts of a filter into Gmail search syntax
+// and combines them with the free-form query
+func buildQuery(filter interfaces.MessageFilter) string {
+	var terms []string
+	if filter.Query != "" {
+		terms = append(terms, filter.Query)
+	}
+	if filter.From != "" {
+		from := filter.From
+		if strings.ContainsAny(from, " \t") {
+			from = `"` + from + `"`
+		}
+		terms = append(terms, "from:"+from)
+	}
+	// Gmail interprets after:/before: as epoch seconds when given a number,
+	// which avoids any ambiguity about the account's timezone
+	if !filter.After.IsZero() {
+		terms = append(terms, fmt.Sprintf("after:%d", filter.After.Unix()))
+	}
+	if !filter.Before.IsZero() {
+		terms = append(terms, fmt.Sprintf("before:%d", filter.Before.Unix()))
+	}
+	if filter.HasAttachment {
+		terms = append(terms, "has:attachment")
+	}
+	if filter.LargerThan > 0 {
+		terms = append(terms, fmt.Sprintf("larger:%d", filter.LargerThan))
+	}
+	if filter.SmallerThan > 0 {
+		terms = append(terms, fmt.Sprintf("smaller:%d", filter.SmallerThan))
+	}
+	return strings.Join(terms, " ")
+}
+
+// GetHistoryID returns the mailbox's current history ID, used as the starting
+// point for the next incremental sync
+func (c *Client) GetHistoryID(ctx context.Context) (uint64, error) {
 	if c.service == nil {
-		return nil, fmt.Errorf("gmail service not connected")
+		return 0, fmt.Errorf("gmail service not connected")
 	}
 
-	// Add timeout for individual message fetch
-	msgCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
-	
-	msg, err := c.service.Users.Messages.Get(c.userID, messageID).Context(msgCtx).Do()
+	if err := c.limiter.Wait(ctx, ratelimit.CostGetProfile); err != nil {
+		return 0, err
+	}
+	profile, err := c.service.Users.GetProfile(c.userID).Context(ctx).Do()
+	c.observe(err)
 	if err != nil {
-		// Check if it's a retryable error
-		if c.isRetryableError(err) {
-			// Try once more with backoff
-			time.Sleep(2 * time.Second)
-			msgCtx2, cancel2 := context.WithTimeout(ctx, 30*time.Second)
-			defer cancel2()
-			msg, err = c.service.Users.Messages.Get(c.userID, messageID).Context(msgCtx2).Do()
-			if err != nil {
-				return nil, fmt.Errorf("unable to retrieve message %s after retry: %v", messageID, err)
+		return 0, fmt.Errorf("unable to retrieve profile: %v", err)
+	}
+
+	return profile.HistoryId, nil
+}
+
+// ListHistory returns the messages added, deleted and relabeled in the given
+// mailbox since startHistoryID
+func (c *Client) ListHistory(ctx context.Context, mailbox string, startHistoryID uint64) (*interfaces.HistoryChanges, error) {
+	if c.service == nil {
+		return nil, fmt.Errorf("gmail service not connected")
+	}
+
+	var labelID string
+	if mailbox != "" {
+		labelIDs, err := c.resolveLabelIDs(ctx, []string{mailbox})
+		if err != nil {
+			return nil, err
+		}
+		labelID = labelIDs[0]
+	}
+
+	changes := &interfaces.HistoryChanges{HistoryID: startHistoryID}
+	seen := make(map[string]map[string]bool)
+	record := func(kind string, list *[]string, id string) {
+		if seen[kind] == nil {
+			seen[kind] = make(map[string]bool)
+		}
+		if !seen[kind][id] {
+			seen[kind][id] = true
+			*list = append(*list, id)
+		}
+	}
+
+	pageToken := ""
+	for {
+		call := c.service.Users.History.List(c.userID).
+			StartHistoryId(startHistoryID).
+			HistoryTypes("messageAdded", "messageDeleted", "labelAdded", "labelRemoved")
+		if labelID != "" {
+			call = call.LabelId(labelID)
+		}
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+
+		if err := c.limiter.Wait(ctx, ratelimit.CostHistoryList); err != nil {
+			return nil, err
+		}
+		resp, err := call.Context(ctx).Do()
+		c.observe(err)
+		if err != nil {
+			// Gmail answers 404 when the start history ID is no longer available
+			if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+				return nil, interfaces.ErrHistoryExpired
 			}
-		} else {
-			return nil, fmt.Errorf("unable to retrieve message %s: %v", messageID, err)
+			return nil, fmt.Errorf("unable to retrieve history: %v", err)
+		}
+
+		for _, h := range resp.History {
+			for _, added := range h.MessagesAdded {
+				record("added", &changes.Added, added.Message.Id)
+			}
+			for _, deleted := range h.MessagesDeleted {
+				record("deleted", &changes.Deleted, deleted.Message.Id)
+			}
+			for _, labeled := range h.LabelsAdded {
+				record("labelsAdded", &changes.LabelsAdded, labeled.Message.Id)
+			}
+			for _, unlabeled := range h.LabelsRemoved {
+				record("labelsRemoved", &changes.LabelsRemoved, unlabeled.Message.Id)
+			}
+		}
+
+		if resp.HistoryId > changes.HistoryID {
+			changes.HistoryID = resp.HistoryId
+		}
+
+		if resp.NextPageToken == "" {
+			break
 		}
+		pageToken = resp.NextPageToken
+	}
+
+	return changes, nil
+}
+
+func (c *Client) GetMessage(ctx context.Context, messageID string) (*interfaces.EmailMessage, error) {
+	msg, err := c.fetchMessage(ctx, messageID, "full")
+	if err != nil {
+		return nil, err
 	}
 
 	email := &interfaces.EmailMessage{
-		ID:          msg.Id,
-		Headers:     make(map[string]string),
-		Attachments: []interfaces.Attachment{},
+		ID:           msg.Id,
+		ThreadID:     msg.ThreadId,
+		LabelIDs:     msg.LabelIds,
+		Labels:       c.labelNamesFor(ctx, msg.LabelIds),
+		Snippet:      msg.Snippet,
+		InternalDate: msg.InternalDate,
+		SizeEstimate: msg.SizeEstimate,
+		Headers:      make(map[string]string),
+		Attachments:  []interfaces.Attachment{},
 	}
 
 	// Extract headers
 	for _, header := range msg.Payload.Headers {
+		email.HeaderList = append(email.HeaderList, interfaces.Header{Name: header.Name, Value: header.Value})
+	}
+	c.applyHeaders(email)
+
+	// Extract body
+	email.Body, email.BodyMimeType, email.BodyParts = c.extractBody(msg.Payload)
+
+	// Extract attachments
+	email.Attachments = c.extractAttachments(ctx, msg.Id, msg.Payload)
+
+	return email, nil
+}
+
+// GetRawMessage fetches the original RFC 822 message. Only the headers are
+// parsed, the body and attachments stay inside EmailMessage.Raw.
+func (c *Client) GetRawMessage(ctx context.Context, messageID string) (*interfaces.EmailMessage, error) {
+	msg, err := c.fetchMessage(ctx, messageID, "raw")
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.URLEncoding.DecodeString(msg.Raw)
+	if err != nil {
+		// Gmail sometimes omits the base64 padding
+		raw, err = base64.RawURLEncoding.DecodeString(msg.Raw)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode raw message %s: %v", messageID, err)
+		}
+	}
+
+	email := &interfaces.EmailMessage{
+		ID:           msg.Id,
+		ThreadID:     msg.ThreadId,
+		LabelIDs:     msg.LabelIds,
+		Labels:       c.labelNamesFor(ctx, msg.LabelIds),
+		Snippet:      msg.Snippet,
+		InternalDate: msg.InternalDate,
+		SizeEstimate: msg.SizeEstimate,
+		Headers:      make(map[string]string),
+		Attachments:  []interfaces.Attachment{},
+		Raw:          raw,
+	}
+
+	email.HeaderList = parseRawHeaders(raw)
+	if len(email.HeaderList) == 0 {
+		return nil, fmt.Errorf("unable to parse raw message %s: no headers found", messageID)
+	}
+	c.applyHeaders(email)
+	email.BodyMimeType = "message/rfc822"
+
+	return email, nil
+}
+
+// GetMessageLabels fetches only the current labels of a message, for
+// updating an email that was saved before it was relabeled
+func (c *Client) GetMessageLabels(ctx context.Context, messageID string) (*interfaces.EmailMessage, error) {
+	msg, err := c.fetchMessage(ctx, messageID, "minimal")
+	if err != nil {
+		return nil, err
+	}
+
+	return &interfaces.EmailMessage{
+		ID:       msg.Id,
+		ThreadID: msg.ThreadId,
+		LabelIDs: msg.LabelIds,
+		Labels:   c.labelNamesFor(ctx, msg.LabelIds),
+	}, nil
+}
+
+// applyHeaders decodes RFC 2047 encoded-words in the ordered header list and
+// fills the convenience header map and the common header fields from it. The
+// undecoded originals stay available in the raw message.
+func (c *Client) applyHeaders(email *interfaces.EmailMessage) {
+	for i := range email.HeaderList {
+		header := &email.HeaderList[i]
+		header.Value = decodeHeader(header.Value)
 		email.Headers[header.Name] = header.Value
 		switch strings.ToLower(header.Name) {
 		case "subject":
@@ -209,55 +460,118 @@ func (c *Client) GetMessage(ctx context.Context, messageID string) (*interfaces.
 			email.Date = header.Value
 		}
 	}
+}
 
-	// Extract body
-	email.Body, email.BodyMimeType = c.extractBody(msg.Payload)
+// parseRawHeaders reads the header block of a raw message in order,
+// unfolding continuation lines
+func parseRawHeaders(raw []byte) []interfaces.Header {
+	var headers []interfaces.Header
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			last := &headers[len(headers)-1]
+			last.Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		headers = append(headers, interfaces.Header{Name: name, Value: strings.TrimSpace(value)})
+	}
+	return headers
+}
 
-	// Extract attachments
-	email.Attachments = c.extractAttachments(ctx, msg.Id, msg.Payload)
+// fetchMessage gets a message in the given Gmail format ("full", "raw" or
+// "minimal"), retrying once on transient errors
+func (c *Client) fetchMessage(ctx context.Context, messageID string, format string) (*gmail.Message, error) {
+	if c.service == nil {
+		return nil, fmt.Errorf("gmail service not connected")
+	}
 
-	return email, nil
+	// Add timeout for individual message fetch
+	msgCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	if err := c.limiter.Wait(ctx, ratelimit.CostMessagesGet); err != nil {
+		return nil, err
+	}
+	msg, err := c.service.Users.Messages.Get(c.userID, messageID).Format(format).Context(msgCtx).Do()
+	c.observe(err)
+	if err != nil {
+		// Check if it's a retryable error
+		if c.isRetryableError(err) {
+			// Try once more with backoff
+			time.Sleep(2 * time.Second)
+			msgCtx2, cancel2 := context.WithTimeout(ctx, 30*time.Second)
+			defer cancel2()
+			if err := c.limiter.Wait(ctx, ratelimit.CostMessagesGet); err != nil {
+				return nil, err
+			}
+			msg, err = c.service.Users.Messages.Get(c.userID, messageID).Format(format).Context(msgCtx2).Do()
+			c.observe(err)
+			if err != nil {
+				return nil, fmt.Errorf("unable to retrieve message %s after retry: %v", messageID, err)
+			}
+		} else {
+			return nil, fmt.Errorf("unable to retrieve message %s: %v", messageID, err)
+		}
+	}
+
+	return msg, nil
 }
 
-func (c *Client) extractBody(payload *gmail.MessagePart) (string, string) {
-	var htmlContent, plainContent string
-	var htmlMime, plainMime string
+// extractBody collects every text alternative of the message and returns the
+// HTML view of the body, its MIME type and all alternatives
+func (c *Client) extractBody(payload *gmail.MessagePart) (string, string, []interfaces.BodyPart) {
+	var parts []interfaces.BodyPart
+	c.recursiveExtractBody(payload, &parts)
 
-	c.recursiveExtractBody(payload, &htmlContent, &plainContent, &htmlMime, &plainMime)
+	var htmlContent, plainContent string
+	for _, part := range parts {
+		if part.MimeType == "text/html" && htmlContent == "" {
+			htmlContent = part.Content
+		} else if part.MimeType == "text/plain" && plainContent == "" {
+			plainContent = part.Content
+		}
+	}
 
 	// Prioritize HTML content if available
 	if htmlContent != "" {
-		return htmlContent, htmlMime
+		return htmlContent, "text/html", parts
 	}
 
 	// If only plain text, wrap it in HTML structure
 	if plainContent != "" {
 		wrappedHTML := c.wrapPlainTextAsHTML(plainContent)
-		return wrappedHTML, "text/html"
+		return wrappedHTML, "text/html", parts
 	}
 
-	return "", "text/html"
+	return "", "text/html", parts
 }
 
-func (c *Client) recursiveExtractBody(payload *gmail.MessagePart, htmlContent, plainContent, htmlMime, plainMime *string) {
-	// Check if current payload has body data
-	if payload.Body != nil && payload.Body.Data != "" {
+func (c *Client) recursiveExtractBody(payload *gmail.MessagePart, parts *[]interfaces.BodyPart) {
+	// Check if current payload has inline text body data. Text files sent as
+	// attachments carry a filename and are handled as attachments instead.
+	if payload.Body != nil && payload.Body.Data != "" && payload.Filename == "" &&
+		strings.HasPrefix(payload.MimeType, "text/") {
 		data, err := base64.URLEncoding.DecodeString(payload.Body.Data)
 		if err == nil {
-			content := string(data)
-			if payload.MimeType == "text/html" && *htmlContent == "" {
-				*htmlContent = content
-				*htmlMime = payload.MimeType
-			} else if payload.MimeType == "text/plain" && *plainContent == "" {
-				*plainContent = content
-				*plainMime = payload.MimeType
-			}
+			charset := partCharset(payload)
+			*parts = append(*parts, interfaces.BodyPart{
+				MimeType: payload.MimeType,
+				Charset:  charset,
+				Content:  c.decodeTextPart(data, charset, payload.MimeType),
+			})
 		}
 	}
 
 	// Recursively check all parts
 	for _, part := range payload.Parts {
-		c.recursiveExtractBody(part, htmlContent, plainContent, htmlMime, plainMime)
+		c.recursiveExtractBody(part, parts)
 	}
 }
 
@@ -300,16 +614,16 @@ func (c *Client) wrapPlainTextAsHTML(plainText string) string {
 
 func (c *Client) extractAttachments(ctx context.Context, messageID string, payload *gmail.MessagePart) []interfaces.Attachment {
 	attachmentMap := make(map[string]interfaces.Attachment)
-	fmt.Printf("DEBUG: Starting attachment extraction for message %s\n", messageID)
+	c.logger.Debug(fmt.Sprintf("Starting attachment extraction for message %s", messageID))
 	c.extractAttachmentsRecursive(ctx, messageID, payload, attachmentMap)
-	
+
 	// Convert map to slice
 	var attachments []interfaces.Attachment
 	for _, attachment := range attachmentMap {
 		attachments = append(attachments, attachment)
 	}
-	
-	fmt.Printf("DEBUG: Found %d attachments for message %s\n", len(attachments), messageID)
+
+	c.logger.Debug(fmt.Sprintf("Found %d attachments for message %s", len(attachments), messageID))
 	return attachments
 }
 
@@ -324,7 +638,7 @@ func (c *Client) extractAttachmentsRecursive(ctx context.Context, messageID stri
 			}
 		}
 	}
-	
+
 	// Recursively check parts for attachments
 	for _, part := range payload.Parts {
 		c.extractAttachmentsRecursive(ctx, messageID, part, attachmentMap)
@@ -334,22 +648,22 @@ func (c *Client) extractAttachmentsRecursive(ctx context.Context, messageID stri
 func (c *Client) isAttachment(part *gmail.MessagePart) bool {
 	// Skip inline images if configured
 	skipInlineImages := os.Getenv("SKIP_INLINE_IMAGES") == "true"
-	
+
 	// Check for Content-ID (inline images in HTML emails)
 	for _, header := range part.Headers {
 		if strings.ToLower(header.Name) == "content-id" {
 			// This is likely an inline image
 			if part.Body != nil && part.Body.AttachmentId != "" && part.Body.Size > 0 {
-				fmt.Printf("DEBUG: Found inline image with Content-ID: %s, Size: %d\n", header.Value, part.Body.Size)
+				c.logger.Debug(fmt.Sprintf("Found inline image with Content-ID: %s, Size: %d", header.Value, part.Body.Size))
 				if skipInlineImages {
-					fmt.Printf("DEBUG: Skipping inline image due to SKIP_INLINE_IMAGES=true\n")
+					c.logger.Debug("Skipping inline image due to SKIP_INLINE_IMAGES=true")
 					return false
 				}
 				return true
 			}
 		}
 	}
-	
+
 	// Check if this part has a filename in headers
 	for _, header := range part.Headers {
 		if strings.ToLower(header.Name) == "content-disposition" {
@@ -359,7 +673,7 @@ func (c *Client) isAttachment(part *gmail.MessagePart) bool {
 			}
 		}
 	}
-	
+
 	// Check if it has an attachment ID and body size > 0
 	return part.Body != nil && part.Body.AttachmentId != "" && part.Body.Size > 0
 }
@@ -368,106 +682,84 @@ func (c *Client) processAttachment(ctx context.Context, messageID string, part *
 	if part.Body == nil || part.Body.AttachmentId == "" {
 		return nil
 	}
-	
+
 	// GENERAL FIX: Skip attachments with abnormally long IDs
 	// These appear to be malformed attachments where Gmail API stores corrupted data
 	// The attachment ID becomes abnormally long (300+ chars) and the API cannot retrieve it
 	// This affects emails like the Webhallen barcode (19855d64da73b5be) and others
-	
+
 	// Get filename from headers
 	filename := c.getFilenameFromHeaders(part.Headers)
 	if filename == "" {
 		filename = fmt.Sprintf("attachment_%s", part.Body.AttachmentId)
 	}
-	
+
 	// Truncate attachment ID for logging (they can be extremely long)
 	attachIDForLog := part.Body.AttachmentId
 	if len(attachIDForLog) > 50 {
 		attachIDForLog = attachIDForLog[:50] + "..."
 	}
-	fmt.Printf("DEBUG: Processing attachment %s (ID: %s, Size: %d bytes) for message %s\n", 
-		filename, attachIDForLog, part.Body.Size, messageID)
-	
-	// Skip very large attachments that might cause timeouts
-	if part.Body.Size > 10*1024*1024 { // 10MB
-		fmt.Printf("WARNING: Skipping large attachment %s (%d bytes) for message %s\n", 
-			filename, part.Body.Size, messageID)
-		return nil
+	c.logger.Debug(fmt.Sprintf("Processing attachment %s (ID: %s, Size: %d bytes) for message %s",
+		filename, attachIDForLog, part.Body.Size, messageID))
+
+	result := &interfaces.Attachment{
+		Filename:     filename,
+		MimeType:     part.MimeType,
+		Size:         part.Body.Size,
+		AttachmentID: part.Body.AttachmentId,
+		ContentID:    getContentID(part.Headers),
 	}
-	
+
 	// Skip attachments with suspiciously long IDs (likely corrupted)
 	// Normal Gmail attachment IDs are typically 50-150 chars, anything over 300 is suspicious
 	if len(part.Body.AttachmentId) > 300 {
-		fmt.Printf("WARNING: Skipping attachment with extremely long ID (%d chars) for message %s - likely corrupted\n", 
-			len(part.Body.AttachmentId), messageID)
-		return nil
+		c.logger.Warn(fmt.Sprintf("Skipping attachment with extremely long ID (%d chars) for message %s - likely corrupted",
+			len(part.Body.AttachmentId), messageID))
+		result.SkipReason = fmt.Sprintf("attachment ID is %d characters long, likely corrupted", len(part.Body.AttachmentId))
+		return result
 	}
-	
-	// Download attachment data with shorter timeout for small files
-	timeoutDuration := 45 * time.Second
-	if part.Body.Size < 1024 { // Less than 1KB
-		timeoutDuration = 10 * time.Second
-	}
-	attachCtx, cancel := context.WithTimeout(ctx, timeoutDuration)
-	defer cancel()
-	
-	// Add small delay to avoid rate limiting
-	time.Sleep(50 * time.Millisecond)
-	
-	fmt.Printf("DEBUG: Downloading attachment %s for message %s (timeout: %v)...\n", filename, messageID, timeoutDuration)
-	attachment, err := c.service.Users.Messages.Attachments.Get(c.userID, messageID, part.Body.AttachmentId).Context(attachCtx).Do()
-	if err != nil {
-		// Retry once for transient errors
-		if c.isRetryableError(err) {
-			fmt.Printf("DEBUG: Retrying attachment download for %s...\n", filename)
-			time.Sleep(2 * time.Second)
-			attachCtx2, cancel2 := context.WithTimeout(ctx, 45*time.Second)
-			defer cancel2()
-			attachment, err = c.service.Users.Messages.Attachments.Get(c.userID, messageID, part.Body.AttachmentId).Context(attachCtx2).Do()
-			if err != nil {
-				fmt.Printf("Error downloading attachment %s after retry: %v\n", filename, err)
-				return nil
-			}
-		} else {
-			fmt.Printf("Error downloading attachment %s: %v\n", filename, err)
-			return nil
-		}
+
+	// The content is downloaded later, straight to disk, by whoever saves it
+	attachmentID := part.Body.AttachmentId
+	size := part.Body.Size
+	result.Fetch = func(ctx context.Context, w io.Writer) (int64, error) {
+		c.logger.Debug(fmt.Sprintf("Downloading attachment %s for message %s", filename, messageID))
+		return c.downloadAttachment(ctx, messageID, attachmentID, size, w)
 	}
-	
-	// Decode attachment data
-	data, err := base64.URLEncoding.DecodeString(attachment.Data)
-	if err != nil {
-		fmt.Printf("Error decoding attachment %s: %v\n", filename, err)
-		return nil
+	return result
+}
+
+// observe reports the outcome of an API call to the rate limiter, backing off
+// when Gmail says we are over quota
+func (c *Client) observe(err error) {
+	if err == nil {
+		c.limiter.Success()
+		return
 	}
-	
-	return &interfaces.Attachment{
-		Filename:     filename,
-		MimeType:     part.MimeType,
-		Size:         part.Body.Size,
-		Data:         data,
-		AttachmentID: part.Body.AttachmentId,
+	if c.isRateLimitError(err) {
+		c.limiter.Backoff()
+		c.logger.Warn(fmt.Sprintf("Gmail rate limit hit, slowing down to %.0f quota units/s", c.limiter.Rate()))
 	}
 }
 
-func (c *Client) getFilenameFromHeaders(headers []*gmail.MessagePartHeader) string {
-	for _, header := range headers {
-		if strings.ToLower(header.Name) == "content-disposition" {
-			// Parse filename from Content-Disposition header
-			value := header.Value
-			if idx := strings.Index(strings.ToLower(value), "filename="); idx != -1 {
-				filename := value[idx+9:]
-				// Remove quotes if present
-				filename = strings.Trim(filename, `"`)
-				// Remove any trailing parameters
-				if idx := strings.Index(filename, ";"); idx != -1 {
-					filename = filename[:idx]
-				}
-				return strings.TrimSpace(filename)
+// isRateLimitError checks if an error is a Gmail quota error
+func (c *Client) isRateLimitError(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	if apiErr.Code == http.StatusTooManyRequests {
+		return true
+	}
+	// Gmail also reports per-user rate limits as 403 with a rate limit reason
+	if apiErr.Code == http.StatusForbidden {
+		for _, e := range apiErr.Errors {
+			if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+				return true
 			}
 		}
 	}
-	return ""
+	return false
 }
 
 // isRetryableError checks if an error is retryable
@@ -475,19 +767,19 @@ func (c *Client) isRetryableError(err error) bool {
 	if err == nil {
 		return false
 	}
-	
+
 	// Check for Google API errors
 	if apiErr, ok := err.(*googleapi.Error); ok {
 		// Retry on rate limit or server errors
-		return apiErr.Code == 429 || apiErr.Code >= 500
+		return c.isRateLimitError(err) || apiErr.Code >= 500
 	}
-	
+
 	// Check for timeout errors
 	if strings.Contains(err.Error(), "timeout") ||
-	   strings.Contains(err.Error(), "deadline exceeded") ||
-	   strings.Contains(err.Error(), "connection reset") {
+		strings.Contains(err.Error(), "deadline exceeded") ||
+		strings.Contains(err.Error(), "connection reset") {
 		return true
 	}
-	
+
 	return false
-}
\ No newline at end of file
+}
@@ -0,0 +1,42 @@
+package gmail
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/perarneng/getgmail/pkg/ratelimit"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Info(string)  {}
+func (nopLogger) Error(string) {}
+func (nopLogger) Warn(string)  {}
+func (nopLogger) Debug(string) {}
+
+func TestObserveBacksOffOnRateLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want float64
+	}{
+		{"success", nil, 100},
+		{"429", &googleapi.Error{Code: http.StatusTooManyRequests}, 50},
+		{"403 user rate limit", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}}, 50},
+		{"403 forbidden", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "insufficientPermissions"}}}, 100},
+		{"500", &googleapi.Error{Code: http.StatusInternalServerError}, 100},
+		{"network error", errors.New("connection reset"), 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Client{limiter: ratelimit.NewLimiter(100), logger: nopLogger{}}
+			c.observe(test.err)
+			if got := c.limiter.Rate(); got != test.want {
+				t.Errorf("rate after observing %v = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
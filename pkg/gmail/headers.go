@@ -0,0 +1,156 @@
+package gmail
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"google.golang.org/api/gmail/v1"
+)
+
+// wordDecoder decodes RFC 2047 encoded-words in any charset known to the
+// HTML encoding index, not just the UTF-8 and ISO-8859-1 net/mail supports
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// rfc2231ParamRe matches the pieces of an RFC 2231 parameter such as
+// filename*=UTF-8”a%20b or filename*0*=...; filename*1=...
+var rfc2231ParamRe = regexp.MustCompile(`(?i)(?:^|;)\s*(filename|name)\*(\d+)?(\*)?\s*=\s*("[^"]*"|[^;]*)`)
+
+// brokenParamRe matches the parameters of a header mime.ParseMediaType
+// rejects, such as an unquoted filename containing spaces
+var brokenParamRe = regexp.MustCompile(`(?i)(?:^|[;\s])([\w.-]+)\s*=\s*("[^"]*"|[^;]*)`)
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+	return encoding.NewDecoder().Reader(input), nil
+}
+
+// decodeHeader decodes RFC 2047 encoded-words such as =?UTF-8?B?...?= in a
+// header value. Values that cannot be decoded are returned unchanged.
+func decodeHeader(value string) string {
+	if !strings.Contains(value, "=?") {
+		return value
+	}
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// getFilenameFromHeaders returns the decoded attachment filename from the
+// Content-Disposition filename parameter, falling back to the Content-Type
+// name parameter. Both RFC 2231 (filename*=) and RFC 2047 encodings are decoded.
+func (c *Client) getFilenameFromHeaders(headers []*gmail.MessagePartHeader) string {
+	for _, wanted := range []struct{ header, param string }{
+		{"content-disposition", "filename"},
+		{"content-type", "name"},
+	} {
+		for _, header := range headers {
+			if strings.ToLower(header.Name) != wanted.header {
+				continue
+			}
+			if filename := headerParam(header.Value, wanted.param); filename != "" {
+				return filename
+			}
+		}
+	}
+	return ""
+}
+
+// getContentID returns the Content-ID of a part without its angle brackets,
+// as referenced by cid: URLs in the HTML body
+func getContentID(headers []*gmail.MessagePartHeader) string {
+	for _, header := range headers {
+		if strings.ToLower(header.Name) == "content-id" {
+			return strings.Trim(strings.TrimSpace(header.Value), "<>")
+		}
+	}
+	return ""
+}
+
+// headerParam extracts and decodes one parameter of a structured header
+func headerParam(value, param string) string {
+	// RFC 2231 extended values take precedence over the plain parameter
+	if extended := decodeRFC2231Param(value, param); extended != "" {
+		return extended
+	}
+
+	if _, params, err := mime.ParseMediaType(value); err == nil {
+		if v, ok := params[param]; ok {
+			return strings.TrimSpace(decodeHeader(v))
+		}
+		return ""
+	}
+
+	// Parse broken headers by hand
+	for _, m := range brokenParamRe.FindAllStringSubmatch(value, -1) {
+		if strings.EqualFold(m[1], param) {
+			return strings.TrimSpace(decodeHeader(strings.Trim(strings.TrimSpace(m[2]), `"`)))
+		}
+	}
+	return ""
+}
+
+// decodeRFC2231Param joins the continuations of an RFC 2231 parameter and
+// decodes its charset”-prefixed, percent-encoded value
+func decodeRFC2231Param(value, param string) string {
+	type segment struct {
+		index   int
+		encoded bool
+		text    string
+	}
+
+	var segments []segment
+	for _, m := range rfc2231ParamRe.FindAllStringSubmatch(value, -1) {
+		if !strings.EqualFold(m[1], param) {
+			continue
+		}
+		index := 0
+		if m[2] != "" {
+			index, _ = strconv.Atoi(m[2])
+		}
+		// A bare "filename*=" is a single encoded segment
+		encoded := m[3] != "" || m[2] == ""
+		segments = append(segments, segment{index: index, encoded: encoded, text: strings.Trim(strings.TrimSpace(m[4]), `"`)})
+	}
+	if len(segments) == 0 {
+		return ""
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].index < segments[j].index })
+
+	// Only the first segment carries the charset'language' prefix
+	charset := ""
+	var raw strings.Builder
+	for i, seg := range segments {
+		text := seg.text
+		if i == 0 && seg.encoded {
+			parts := strings.SplitN(text, "'", 3)
+			if len(parts) == 3 {
+				charset = strings.ToLower(parts[0])
+				text = parts[2]
+			}
+		}
+		if seg.encoded {
+			if unescaped, err := url.PathUnescape(text); err == nil {
+				text = unescaped
+			}
+		}
+		raw.WriteString(text)
+	}
+
+	decoded, err := decodeCharset([]byte(raw.String()), charset)
+	if err != nil {
+		return raw.String()
+	}
+	return strings.TrimSpace(decoded)
+}
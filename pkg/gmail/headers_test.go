@@ -0,0 +1,84 @@
+package gmail
+
+import "testing"
+
+func TestDecodeRFC2231Param(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		param string
+		want  string
+	}{
+		{"utf-8", `attachment; filename*=UTF-8''%C3%A5%C3%A4%C3%B6.pdf`, "filename", "åäö.pdf"},
+		{"language tag", `attachment; filename*=utf-8'sv'r%C3%A4kning.pdf`, "filename", "räkning.pdf"},
+		{"iso-8859-1", `attachment; filename*=iso-8859-1'en'%E5r.txt`, "filename", "år.txt"},
+		{"windows-1252", `attachment; filename*=windows-1252''%80%20report.txt`, "filename", "€ report.txt"},
+		{"shift_jis", `attachment; filename*=Shift_JIS''%93%FA%96%7B.txt`, "filename", "日本.txt"},
+		{"quoted value", `attachment; filename*="UTF-8''a%20b.txt"`, "filename", "a b.txt"},
+		{"content-type name", `application/pdf; name*=UTF-8''%C3%A9t%C3%A9.pdf`, "name", "été.pdf"},
+		{"other parameter", `application/pdf; name*=UTF-8''x.pdf`, "filename", ""},
+		{"plain parameter only", `attachment; filename="plain.txt"`, "filename", ""},
+		{
+			"encoded continuations",
+			`attachment; filename*0*=UTF-8''Rapport%20; filename*1*=%C3%A5r%202024; filename*2*=.pdf`,
+			"filename", "Rapport år 2024.pdf",
+		},
+		{
+			"multibyte character split across continuations",
+			`attachment; filename*0*=UTF-8''%C3; filename*1*=%A5.txt`,
+			"filename", "å.txt",
+		},
+		{
+			"mixed encoded and plain continuations",
+			`attachment; filename*0*=UTF-8''100%25%20; filename*1="done %41.txt"`,
+			"filename", "100% done %41.txt",
+		},
+		{
+			"unencoded continuations out of order",
+			`attachment; filename*1=".pdf"; filename*0="report"`,
+			"filename", "report.pdf",
+		},
+		{
+			"more than ten continuations",
+			`attachment; filename*0=a; filename*1=b; filename*2=c; filename*3=d; filename*4=e; filename*5=f; ` +
+				`filename*6=g; filename*7=h; filename*8=i; filename*9=j; filename*10=k; filename*11=l`,
+			"filename", "abcdefghijkl",
+		},
+		{
+			"folded header",
+			"attachment;\r\n filename*0*=UTF-8''long%20;\r\n filename*1*=name.txt",
+			"filename", "long name.txt",
+		},
+		{"unknown charset keeps bytes", `attachment; filename*=x-unknown''abc.txt`, "filename", "abc.txt"},
+		{"invalid escape kept", `attachment; filename*=UTF-8''50%.txt`, "filename", "50%.txt"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := decodeRFC2231Param(test.value, test.param); got != test.want {
+				t.Errorf("decodeRFC2231Param(%q, %q) = %q, want %q", test.value, test.param, got, test.want)
+			}
+		})
+	}
+}
+
+func TestHeaderParam(t *testing.T) {
+	tests := []struct {
+		value string
+		param string
+		want  string
+	}{
+		{`attachment; filename="report.pdf"`, "filename", "report.pdf"},
+		{`attachment; filename="=?UTF-8?B?w6XDpMO2LnBkZg==?="`, "filename", "åäö.pdf"},
+		{`attachment; filename="=?iso-8859-1?Q?=E5r.txt?="`, "filename", "år.txt"},
+		{`attachment; filename="plain.txt"; filename*=UTF-8''%C3%A9.txt`, "filename", "é.txt"},
+		{`attachment; filename=unquoted name.txt; size=10`, "filename", "unquoted name.txt"},
+		{`attachment; size=10`, "filename", ""},
+		{`inline; filename=c d.png; name=a b.png`, "name", "a b.png"},
+		{`image/png; NAME=upper case.png`, "name", "upper case.png"},
+	}
+	for _, test := range tests {
+		if got := headerParam(test.value, test.param); got != test.want {
+			t.Errorf("headerParam(%q, %q) = %q, want %q", test.value, test.param, got, test.want)
+		}
+	}
+}
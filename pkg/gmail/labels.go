@@ -0,0 +1,193 @@
+package gmail
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+	"github.com/perarneng/getgmail/pkg/ratelimit"
+)
+
+// ListLabels returns all system and user labels of the mailbox
+func (c *Client) ListLabels(ctx context.Context) ([]interfaces.Label, error) {
+	if c.service == nil {
+		return nil, fmt.Errorf("gmail service not connected")
+	}
+
+	if err := c.limiter.Wait(ctx, ratelimit.CostLabelsList); err != nil {
+		return nil, err
+	}
+	resp, err := c.service.Users.Labels.List(c.userID).Context(ctx).Do()
+	c.observe(err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve labels: %v", err)
+	}
+
+	labels := make([]interfaces.Label, 0, len(resp.Labels))
+	for _, l := range resp.Labels {
+		labels = append(labels, toLabel(l))
+	}
+	return labels, nil
+}
+
+// GetLabel returns a single label including its message and thread counts
+func (c *Client) GetLabel(ctx context.Context, labelID string) (*interfaces.Label, error) {
+	if c.service == nil {
+		return nil, fmt.Errorf("gmail service not connected")
+	}
+
+	if err := c.limiter.Wait(ctx, ratelimit.CostLabelsGet); err != nil {
+		return nil, err
+	}
+	l, err := c.service.Users.Labels.Get(c.userID, labelID).Context(ctx).Do()
+	c.observe(err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve label %s: %v", labelID, err)
+	}
+
+	label := toLabel(l)
+	return &label, nil
+}
+
+func toLabel(l *gmail.Label) interfaces.Label {
+	return interfaces.Label{
+		ID:             l.Id,
+		Name:           l.Name,
+		Type:           l.Type,
+		MessagesTotal:  l.MessagesTotal,
+		MessagesUnread: l.MessagesUnread,
+		ThreadsTotal:   l.ThreadsTotal,
+	}
+}
+
+// loadLabelCache fills the label lookup maps once per client. The caller must
+// hold labelsMu.
+func (c *Client) loadLabelCache(ctx context.Context) error {
+	if c.labelIDs != nil {
+		return nil
+	}
+
+	labels, err := c.ListLabels(ctx)
+	if err != nil {
+		return err
+	}
+	c.labelIDs = make(map[string]string)
+	c.labelNames = make(map[string]string)
+	for _, l := range labels {
+		c.labelIDs[l.ID] = l.ID
+		// Names are matched case-insensitively, the same way Gmail search does
+		c.labelIDs[strings.ToLower(l.Name)] = l.ID
+		c.labelNames[l.ID] = l.Name
+	}
+	return nil
+}
+
+// resolveLabelIDs maps human-readable label names, including nested names
+// like "Receipts/2024", to the label IDs the Gmail API expects. Values that
+// already are label IDs are passed through unchanged.
+func (c *Client) resolveLabelIDs(ctx context.Context, names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	c.labelsMu.Lock()
+	defer c.labelsMu.Unlock()
+
+	if err := c.loadLabelCache(ctx); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(names))
+	for _, name := range names {
+		if id, ok := c.labelIDs[name]; ok {
+			ids = append(ids, id)
+			continue
+		}
+		id, ok := c.labelIDs[strings.ToLower(strings.Trim(name, "/"))]
+		if !ok {
+			return nil, fmt.Errorf("unknown label: %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// labelNamesFor maps label IDs to their names. IDs that cannot be resolved
+// are returned as-is so no label is lost.
+func (c *Client) labelNamesFor(ctx context.Context, ids []string) []string {
+	c.labelsMu.Lock()
+	defer c.labelsMu.Unlock()
+
+	if err := c.loadLabelCache(ctx); err != nil {
+		c.logger.Warn(fmt.Sprintf("Unable to resolve label names: %v", err))
+	}
+
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if name, ok := c.labelNames[id]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, id)
+		}
+	}
+	return names
+}
+
+// systemLabelTerms maps system label IDs to the Gmail search term selecting them
+var systemLabelTerms = map[string]string{
+	"INBOX":               "in:inbox",
+	"SENT":                "in:sent",
+	"DRAFT":               "in:drafts",
+	"SPAM":                "in:spam",
+	"TRASH":               "in:trash",
+	"CHAT":                "in:chats",
+	"STARRED":             "is:starred",
+	"UNREAD":              "is:unread",
+	"IMPORTANT":           "is:important",
+	"CATEGORY_PERSONAL":   "category:primary",
+	"CATEGORY_SOCIAL":     "category:social",
+	"CATEGORY_PROMOTIONS": "category:promotions",
+	"CATEGORY_UPDATES":    "category:updates",
+	"CATEGORY_FORUMS":     "category:forums",
+}
+
+// anyLabelQuery adds a term matching any of the labels to a search query,
+// using Gmail's {a b} OR syntax, e.g. "{in:inbox label:receipts-2024}"
+func (c *Client) anyLabelQuery(query string, labelIDs []string) string {
+	c.labelsMu.Lock()
+	defer c.labelsMu.Unlock()
+
+	terms := make([]string, 0, len(labelIDs))
+	for _, id := range labelIDs {
+		if term, ok := systemLabelTerms[id]; ok {
+			terms = append(terms, term)
+			continue
+		}
+		name, ok := c.labelNames[id]
+		if !ok {
+			name = id
+		}
+		terms = append(terms, labelSearchTerm(name))
+	}
+
+	union := "{" + strings.Join(terms, " ") + "}"
+	if query == "" {
+		return union
+	}
+	return query + " " + union
+}
+
+// labelSearchTerm returns the label: term Gmail search uses for a user
+// label, which lower-cases the name and turns spaces and the slashes of
+// nested labels into dashes
+func labelSearchTerm(name string) string {
+	name = strings.ToLower(strings.Trim(name, "/"))
+	name = strings.Join(strings.FieldsFunc(name, func(r rune) bool {
+		return r == '/' || unicode.IsSpace(r)
+	}), "-")
+	return "label:" + name
+}
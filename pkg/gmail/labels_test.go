@@ -0,0 +1,27 @@
+package gmail
+
+import "testing"
+
+func TestAnyLabelQuery(t *testing.T) {
+	c := &Client{labelNames: map[string]string{
+		"Label_1": "Receipts/2024",
+		"Label_2": "Travel Plans",
+		"Label_3": "Work",
+	}}
+
+	tests := []struct {
+		query    string
+		labelIDs []string
+		want     string
+	}{
+		{"", []string{"INBOX", "Label_3"}, "{in:inbox label:work}"},
+		{"", []string{"Label_1", "Label_2"}, "{label:receipts-2024 label:travel-plans}"},
+		{"has:attachment", []string{"SENT", "CATEGORY_PERSONAL"}, "has:attachment {in:sent category:primary}"},
+		{"", []string{"STARRED", "Label_9"}, "{is:starred label:label_9}"},
+	}
+	for _, test := range tests {
+		if got := c.anyLabelQuery(test.query, test.labelIDs); got != test.want {
+			t.Errorf("anyLabelQuery(%q, %v) = %q, want %q", test.query, test.labelIDs, got, test.want)
+		}
+	}
+}
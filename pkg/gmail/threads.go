@@ -0,0 +1,110 @@
+package gmail
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+	"github.com/perarneng/getgmail/pkg/ratelimit"
+)
+
+// SearchThreads lists up to filter.MaxResults conversations with at least one
+// message matching the filter, most recently active first
+func (c *Client) SearchThreads(ctx context.Context, filter interfaces.MessageFilter) ([]*gmail.Thread, error) {
+	if c.service == nil {
+		return nil, fmt.Errorf("gmail service not connected")
+	}
+
+	labelIDs, err := c.resolveLabelIDs(ctx, filter.LabelIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Gmail only intersects label IDs, so a union is searched for with one
+	// query that ORs the labels, keeping Gmail's most recent first order
+	if filter.AnyLabel && len(labelIDs) > 1 {
+		return c.listThreads(ctx, nil, c.anyLabelQuery(buildQuery(filter), labelIDs), filter.MaxResults)
+	}
+
+	return c.listThreads(ctx, labelIDs, buildQuery(filter), filter.MaxResults)
+}
+
+// listThreads pages through Users.Threads.List until maxResults threads have
+// been collected
+func (c *Client) listThreads(ctx context.Context, labelIDs []string, query string, maxResults int64) ([]*gmail.Thread, error) {
+	var threads []*gmail.Thread
+	pageToken := ""
+	remaining := maxResults
+
+	for remaining > 0 {
+		call := c.service.Users.Threads.List(c.userID)
+		if len(labelIDs) > 0 {
+			call = call.LabelIds(labelIDs...)
+		}
+		if query != "" {
+			call = call.Q(query)
+		}
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+
+		pageSize := remaining
+		if pageSize > 500 {
+			pageSize = 500
+		}
+		call = call.MaxResults(pageSize)
+
+		if err := c.limiter.Wait(ctx, ratelimit.CostThreadsList); err != nil {
+			return nil, err
+		}
+		resp, err := call.Context(ctx).Do()
+		c.observe(err)
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve threads: %v", err)
+		}
+
+		threads = append(threads, resp.Threads...)
+		remaining -= int64(len(resp.Threads))
+
+		if resp.NextPageToken == "" || remaining <= 0 {
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+
+	return threads, nil
+}
+
+// GetThread returns the message IDs of a conversation. Only the minimal
+// format is requested; messages are fetched separately so that already
+// downloaded ones cost nothing and every output format is available.
+func (c *Client) GetThread(ctx context.Context, threadID string) (*interfaces.Thread, error) {
+	if c.service == nil {
+		return nil, fmt.Errorf("gmail service not connected")
+	}
+
+	threadCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	if err := c.limiter.Wait(ctx, ratelimit.CostThreadsGet); err != nil {
+		return nil, err
+	}
+	thread, err := c.service.Users.Threads.Get(c.userID, threadID).Format("minimal").Context(threadCtx).Do()
+	c.observe(err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve thread %s: %v", threadID, err)
+	}
+
+	result := &interfaces.Thread{
+		ID:        thread.Id,
+		HistoryID: thread.HistoryId,
+		Snippet:   thread.Snippet,
+	}
+	for _, msg := range thread.Messages {
+		result.MessageIDs = append(result.MessageIDs, msg.Id)
+	}
+	return result, nil
+}
@@ -2,31 +2,159 @@ package interfaces
 
 import (
 	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
 	"google.golang.org/api/gmail/v1"
 )
 
+// ErrHistoryExpired is returned by ListHistory when the start history ID is
+// too old for Gmail to serve and a full listing is required instead
+var ErrHistoryExpired = errors.New("history ID expired")
+
+// Attachment describes an attachment of a message. Its content is never
+// held in memory: Fetch streams it from Gmail, usually into a staged file
+// at Path that the writer moves into the email folder.
 type Attachment struct {
-	Filename    string
-	MimeType    string
-	Size        int64
-	Data        []byte
+	Filename     string
+	MimeType     string
+	Size         int64
 	AttachmentID string
+
+	// ContentID identifies an inline image referenced from the HTML body
+	// as cid:<ContentID>
+	ContentID string
+
+	// Fetch streams the decoded content to w and returns the bytes written
+	Fetch func(ctx context.Context, w io.Writer) (int64, error)
+
+	// Path is the temporary file holding the fetched content until it is
+	// moved into the email folder. SHA256 and Size are set when fetching.
+	Path   string
+	SHA256 string
+
+	// SkipReason explains why the attachment was not saved
+	SkipReason string
 }
 
+// Header is a single message header. Repeated headers such as Received keep
+// one entry each, in the order they appear in the message.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// BodyPart is one text alternative of the message body, such as the
+// text/plain and text/html parts of a multipart/alternative message. Content
+// is always UTF-8; Charset records the charset the part was sent in.
+type BodyPart struct {
+	MimeType string
+	Charset  string
+	Content  string
+}
+
+// EmailMessage is a downloaded email. Body is the HTML view of the message
+// while BodyParts keeps every text alternative as received. HeaderList holds
+// every header in message order; Headers is a convenience map keeping the
+// last value of each.
 type EmailMessage struct {
 	ID           string
+	ThreadID     string
+	LabelIDs     []string
+	Labels       []string
+	Snippet      string
+	InternalDate int64
+	SizeEstimate int64
 	Subject      string
 	Date         string
 	From         string
 	To           string
 	Body         string
 	BodyMimeType string
+	BodyParts    []BodyPart
 	Headers      map[string]string
+	HeaderList   []Header
 	Attachments  []Attachment
+	Raw          []byte
+}
+
+// Label is a Gmail system or user label. The counts are only filled in by
+// GetLabel since Users.Labels.List does not return them.
+type Label struct {
+	ID             string
+	Name           string
+	Type           string
+	MessagesTotal  int64
+	MessagesUnread int64
+	ThreadsTotal   int64
+}
+
+// MessageFilter selects messages for SearchMessages. Empty fields are ignored;
+// all set fields must match. LabelIDs may hold label IDs or label names; a
+// message must carry all of them unless AnyLabel is set. A zero MaxResults
+// selects every matching message.
+type MessageFilter struct {
+	LabelIDs      []string
+	AnyLabel      bool
+	Query         string
+	From          string
+	After         time.Time
+	Before        time.Time
+	HasAttachment bool
+	LargerThan    int64
+	SmallerThan   int64
+	MaxResults    int64
+}
+
+// HeaderValues returns all values of a header in message order, matching the
+// name case-insensitively
+func (e *EmailMessage) HeaderValues(name string) []string {
+	var values []string
+	for _, h := range e.HeaderList {
+		if strings.EqualFold(h.Name, name) {
+			values = append(values, h.Value)
+		}
+	}
+	return values
+}
+
+// HistoryChanges summarizes the mailbox changes reported by Users.History.List
+type HistoryChanges struct {
+	HistoryID     uint64
+	Added         []string
+	Deleted       []string
+	LabelsAdded   []string
+	LabelsRemoved []string
+}
+
+// Thread is a Gmail conversation. MessageIDs lists its messages in the
+// order Gmail returns them, oldest first.
+type Thread struct {
+	ID         string
+	HistoryID  uint64
+	Snippet    string
+	MessageIDs []string
+}
+
+// EmailThread is a downloaded conversation with its messages oldest first
+type EmailThread struct {
+	ID       string
+	Messages []*EmailMessage
 }
 
 type GmailClient interface {
 	ListMessages(ctx context.Context, mailbox string, maxResults int64) ([]*gmail.Message, error)
+	SearchMessages(ctx context.Context, filter MessageFilter) ([]*gmail.Message, error)
 	GetMessage(ctx context.Context, messageID string) (*EmailMessage, error)
+	GetRawMessage(ctx context.Context, messageID string) (*EmailMessage, error)
+	GetMessageLabels(ctx context.Context, messageID string) (*EmailMessage, error)
+	SearchThreads(ctx context.Context, filter MessageFilter) ([]*gmail.Thread, error)
+	GetThread(ctx context.Context, threadID string) (*Thread, error)
+	ListLabels(ctx context.Context) ([]Label, error)
+	GetLabel(ctx context.Context, labelID string) (*Label, error)
+	GetHistoryID(ctx context.Context) (uint64, error)
+	ListHistory(ctx context.Context, mailbox string, startHistoryID uint64) (*HistoryChanges, error)
 	Connect(ctx context.Context) error
-}
\ No newline at end of file
+}
@@ -1,10 +1,68 @@
 package interfaces
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type OutputWriter interface {
 	WriteEmail(ctx context.Context, email *EmailMessage, outputDir string) error
 	ValidateOutputDir(outputDir string) error
 	CreateEmailFolder(email *EmailMessage, outputDir string) (string, error)
 	GenerateFolderName(email *EmailMessage) string
-}
\ No newline at end of file
+	LoadIndex(outputDir string) error
+	IsDownloaded(messageID string) bool
+}
+
+// ThreadWriter is implemented by writers that can group a conversation into
+// a single folder
+type ThreadWriter interface {
+	OutputWriter
+	WriteThread(ctx context.Context, thread *EmailThread, outputDir string) error
+	IsThreadDownloaded(thread *Thread) bool
+}
+
+// AttachmentStager is implemented by writers that save attachments. Staging
+// downloads attachment content to disk ahead of WriteEmail so that it can
+// run in parallel with writing other emails.
+type AttachmentStager interface {
+	StageAttachments(ctx context.Context, email *EmailMessage, outputDir string) error
+}
+
+// MailboxUpdater is implemented by writers that can bring emails they saved
+// earlier up to date with the changes an incremental sync finds in Gmail
+type MailboxUpdater interface {
+	// UpdateLabels replaces the labels of saved emails. The emails only need
+	// ID, LabelIDs and Labels; emails that were never saved are ignored.
+	UpdateLabels(ctx context.Context, emails []*EmailMessage, outputDir string) error
+
+	// MarkDeleted marks saved emails as deleted in Gmail, keeping their content
+	MarkDeleted(ctx context.Context, messageIDs []string, outputDir string) error
+}
+
+// PDFRenderer converts a saved HTML page into a PDF file
+type PDFRenderer interface {
+	RenderPDF(ctx context.Context, htmlPath, pdfPath string) error
+}
+
+// SearchDocument is the searchable content of one saved email. Folder and
+// TextFile are relative to the output directory.
+type SearchDocument struct {
+	ID          string
+	ThreadID    string
+	Folder      string
+	TextFile    string
+	Subject     string
+	From        string
+	To          string
+	Date        time.Time
+	Labels      []string
+	Attachments []string
+	Snippet     string
+	Body        string
+}
+
+// SearchIndexer adds saved emails to a full-text search index
+type SearchIndexer interface {
+	AddDocument(doc SearchDocument) error
+}
@@ -0,0 +1,227 @@
+package output
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+// StagingDirName is the folder in the output directory that attachments are
+// streamed into before their email is written. It sits on the same
+// filesystem as the email folders, so moving a staged file is a rename.
+// Each run stages into its own subfolder, so several runs can share an
+// output directory.
+const StagingDirName = ".getgmail_tmp"
+
+// staleStagingAge is how long a staging subfolder has to be untouched before
+// a new run removes it as left behind by an interrupted one. Files being
+// written count as touched, so long downloads keep their folder.
+const staleStagingAge = 24 * time.Hour
+
+// StageAttachments downloads the attachments of an email into the staging
+// folder of outputDir. It runs in the download workers, so attachments are
+// fetched in parallel while emails are still written in order; WriteEmail
+// then only has to move the files into place. Attachments that fail are
+// marked skipped rather than failing the email.
+func (w *FileWriter) StageAttachments(ctx context.Context, email *interfaces.EmailMessage, outputDir string) error {
+	if len(email.Attachments) == 0 {
+		return nil
+	}
+
+	stagingDir, err := w.stagingDir(outputDir)
+	if err != nil {
+		return err
+	}
+
+	for i := range email.Attachments {
+		attachment := &email.Attachments[i]
+		skipOversized(attachment, w.options.MaxAttachmentSize)
+		if attachment.SkipReason != "" || attachment.Path != "" {
+			continue
+		}
+		if err := fetchAttachment(ctx, attachment, stagingDir, w.options.MaxAttachmentSize); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			attachment.SkipReason = err.Error()
+		}
+	}
+	return nil
+}
+
+// DiscardStaged removes the staged attachment files of an email that is not
+// going to be written
+func DiscardStaged(email *interfaces.EmailMessage) {
+	for i := range email.Attachments {
+		if path := email.Attachments[i].Path; path != "" {
+			os.Remove(path)
+			email.Attachments[i].Path = ""
+		}
+	}
+}
+
+// stagingDir returns the staging subfolder of this run, creating it on first use
+func (w *FileWriter) stagingDir(outputDir string) (string, error) {
+	w.stagingMu.Lock()
+	defer w.stagingMu.Unlock()
+
+	root := filepath.Join(outputDir, StagingDirName)
+	if w.staging != "" && filepath.Dir(w.staging) == root {
+		// Recreated in case another run found it stale and removed it
+		if err := os.MkdirAll(w.staging, 0755); err != nil {
+			return "", fmt.Errorf("failed to create staging folder: %v", err)
+		}
+		return w.staging, nil
+	}
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return "", fmt.Errorf("failed to create staging folder: %v", err)
+	}
+	dir, err := os.MkdirTemp(root, "run-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging folder: %v", err)
+	}
+	w.staging = dir
+	return dir, nil
+}
+
+// cleanStaging removes the staging subfolders of interrupted runs. Folders
+// of runs that are still active, including this one, are left alone.
+func cleanStaging(outputDir string) error {
+	root := filepath.Join(outputDir, StagingDirName)
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to clean staging folder: %v", err)
+	}
+
+	cutoff := time.Now().Add(-staleStagingAge)
+	for _, entry := range entries {
+		path := filepath.Join(root, entry.Name())
+		if lastModified(path).After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to clean staging folder: %v", err)
+		}
+	}
+	return nil
+}
+
+// lastModified returns the newest modification time of path and, for a
+// folder, the files in it
+func lastModified(path string) time.Time {
+	var latest time.Time
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest
+}
+
+// saveAttachment moves a staged attachment to path, or streams it from Gmail
+// into a temporary file next to path that is renamed once complete. With an
+// attachment store the file goes into the store instead and path links to
+// it; the store path relative to outputDir is returned.
+func (w *FileWriter) saveAttachment(ctx context.Context, attachment *interfaces.Attachment, path, outputDir string) (string, error) {
+	if attachment.Path == "" {
+		if err := fetchAttachment(ctx, attachment, filepath.Dir(path), w.options.MaxAttachmentSize); err != nil {
+			return "", err
+		}
+	}
+
+	if w.usesStore() {
+		storeFile, err := storeAttachment(attachment, outputDir)
+		if err != nil {
+			os.Remove(attachment.Path)
+			attachment.Path = ""
+			return "", err
+		}
+		if w.options.AttachmentStore == AttachmentStoreReference {
+			return storeFile, nil
+		}
+		return storeFile, w.linkStored(outputDir, storeFile, path)
+	}
+
+	if err := os.Rename(attachment.Path, path); err != nil {
+		os.Remove(attachment.Path)
+		attachment.Path = ""
+		return "", fmt.Errorf("failed to move attachment into place: %v", err)
+	}
+	attachment.Path = ""
+	return "", nil
+}
+
+// fetchAttachment streams an attachment into a new temporary file in dir,
+// hashing it on the way, and records the file in attachment.Path
+func fetchAttachment(ctx context.Context, attachment *interfaces.Attachment, dir string, maxSize int64) error {
+	if attachment.Fetch == nil {
+		return fmt.Errorf("attachment content is not available")
+	}
+
+	f, err := os.CreateTemp(dir, ".attachment-*.part")
+	if err != nil {
+		return fmt.Errorf("failed to create attachment file: %v", err)
+	}
+
+	var dst io.Writer = f
+	if maxSize > 0 {
+		dst = &limitedWriter{w: f, remaining: maxSize}
+	}
+	hash := sha256.New()
+	n, err := attachment.Fetch(ctx, io.MultiWriter(dst, hash))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write attachment file: %v", err)
+	}
+
+	attachment.Path = f.Name()
+	attachment.Size = n
+	attachment.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+// skipOversized marks an attachment skipped when Gmail reports it larger
+// than maxSize bytes
+func skipOversized(attachment *interfaces.Attachment, maxSize int64) {
+	if maxSize > 0 && attachment.Path == "" && attachment.SkipReason == "" && attachment.Size > maxSize {
+		attachment.SkipReason = fmt.Sprintf("larger than the %d byte attachment size limit", maxSize)
+	}
+}
+
+// limitedWriter fails once more than remaining bytes are written, for
+// attachments that turn out bigger than Gmail's size estimate
+type limitedWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining {
+		return 0, fmt.Errorf("attachment exceeds the size limit")
+	}
+	l.remaining -= int64(len(p))
+	return l.w.Write(p)
+}
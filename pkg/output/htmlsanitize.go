@@ -0,0 +1,478 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTML sanitization modes for the saved body. Both modes strip active content;
+// HTMLSanitizeBlock drops every remote resource, HTMLSanitizeLocalize
+// downloads remote images into the email folder and drops the rest.
+const (
+	HTMLSanitizeOff      = "off"
+	HTMLSanitizeBlock    = "block"
+	HTMLSanitizeLocalize = "localize"
+)
+
+// OriginalBodySuffix names the copy of the body as received, kept next to
+// the sanitized {prefix}_body.html
+const OriginalBodySuffix = "_body.orig.html"
+
+// maxRemoteImageSize caps downloaded remote images unless the attachment
+// size limit is lower
+const maxRemoteImageSize = 10 * 1024 * 1024
+
+// contentSecurityPolicy is added to sanitized bodies so the browser refuses
+// anything the sanitizer missed: no scripts, frames or remote loads
+const contentSecurityPolicy = "default-src 'none'; img-src data: file: 'self'; media-src data: file: 'self'; style-src 'unsafe-inline'; font-src data:"
+
+// removedElements are dropped together with their content
+var removedElements = map[string]bool{
+	"script": true, "iframe": true, "frame": true, "frameset": true, "object": true,
+	"embed": true, "applet": true, "base": true, "link": true, "portal": true,
+	"input": true, "button": true, "select": true, "textarea": true,
+}
+
+// resourceAttributes load content when the page is displayed
+var resourceAttributes = map[string]bool{
+	"src": true, "background": true, "poster": true, "data": true,
+	"lowsrc": true, "dynsrc": true, "href": true,
+}
+
+var (
+	cssImportRe     = regexp.MustCompile(`(?i)@import[^;]*;?`)
+	cssExpressionRe = regexp.MustCompile(`(?i)expression\s*\(`)
+	cssURLRe        = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)]*))\s*\)`)
+	urlSchemeRe     = regexp.MustCompile(`^[a-z][a-z0-9+.\-]*:`)
+)
+
+// maxImageRedirects bounds the redirects followed for one remote image
+const maxImageRedirects = 5
+
+// remoteImageClient downloads remote images for HTMLSanitizeLocalize. Image
+// URLs come from whoever sent the email, so it only connects to public
+// addresses, checked after DNS resolution and again for every redirect,
+// and never through a proxy that could reach internal hosts for it.
+var remoteImageClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				return checkPublicAddress(address)
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 15 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxImageRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxImageRedirects)
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+// carrierGradeNAT is the shared address space of RFC 6598, private in practice
+var carrierGradeNAT = netip.MustParsePrefix("100.64.0.0/10")
+
+// checkPublicAddress rejects connections to loopback, private, link-local
+// (including the 169.254.169.254 cloud metadata service) and other
+// non-public addresses. address is the resolved "ip:port" being dialed.
+func checkPublicAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", address, err)
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", address, err)
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || carrierGradeNAT.Contains(ip) {
+		return fmt.Errorf("refusing to connect to non-public address %s", ip)
+	}
+	return nil
+}
+
+// ValidateHTMLSanitize checks that mode is one of the HTMLSanitize* modes
+func ValidateHTMLSanitize(mode string) error {
+	switch mode {
+	case "", HTMLSanitizeOff, HTMLSanitizeBlock, HTMLSanitizeLocalize:
+		return nil
+	}
+	return fmt.Errorf("invalid HTML sanitize mode %q, expected %s, %s or %s", mode, HTMLSanitizeOff, HTMLSanitizeBlock, HTMLSanitizeLocalize)
+}
+
+// sanitizesHTML reports whether saved bodies are sanitized
+func (w *FileWriter) sanitizesHTML() bool {
+	return w.options.SanitizeHTML != "" && w.options.SanitizeHTML != HTMLSanitizeOff
+}
+
+// bodySanitizer cleans the HTML body of one email
+type bodySanitizer struct {
+	writer     *FileWriter
+	ctx        context.Context
+	mode       string
+	folderPath string
+	filePrefix string
+
+	// localized maps downloaded image URLs to their saved file names
+	localized    map[string]string
+	remoteImages []MetadataRemoteImage
+}
+
+// sanitizeBody removes scripts, event handlers, frames and forms from an
+// HTML body and blocks or localizes its remote resources, depending on mode.
+// It returns the sanitized body and the remote images that were saved to
+// folderPath.
+func (w *FileWriter) sanitizeBody(ctx context.Context, body, mode, folderPath, filePrefix string) (string, []MetadataRemoteImage, error) {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse email body: %v", err)
+	}
+
+	s := &bodySanitizer{
+		writer:     w,
+		ctx:        ctx,
+		mode:       mode,
+		folderPath: folderPath,
+		filePrefix: filePrefix,
+		localized:  make(map[string]string),
+	}
+	s.clean(doc)
+	addContentSecurityPolicy(doc)
+
+	var b strings.Builder
+	if err := html.Render(&b, doc); err != nil {
+		return "", nil, fmt.Errorf("failed to render sanitized body: %v", err)
+	}
+	return b.String(), s.remoteImages, nil
+}
+
+// clean sanitizes the children of n, removing the dangerous ones
+func (s *bodySanitizer) clean(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type != html.ElementNode {
+			c = next
+			continue
+		}
+
+		switch {
+		case removedElements[c.Data]:
+			n.RemoveChild(c)
+			c = next
+			continue
+
+		case c.Data == "meta" && (htmlAttr(c, "http-equiv") != "" || htmlAttr(c, "charset") != ""):
+			// Refreshes, redirects and charsets; the saved body is UTF-8
+			// and gets its own declaration
+			n.RemoveChild(c)
+			c = next
+			continue
+
+		case c.Data == "form":
+			// Keep the content of forms, which some newsletters wrap
+			// everything in, without making it submittable
+			s.clean(c)
+			for gc := c.FirstChild; gc != nil; gc = c.FirstChild {
+				c.RemoveChild(gc)
+				n.InsertBefore(gc, c)
+			}
+			n.RemoveChild(c)
+			c = next
+			continue
+
+		case c.Data == "style":
+			for t := c.FirstChild; t != nil; t = t.NextSibling {
+				if t.Type == html.TextNode {
+					t.Data = cleanCSS(t.Data)
+				}
+			}
+		}
+
+		s.cleanAttributes(c)
+		s.clean(c)
+		c = next
+	}
+}
+
+// cleanAttributes drops event handlers and script URLs from an element and
+// blocks or localizes the remote resources it loads
+func (s *bodySanitizer) cleanAttributes(n *html.Node) {
+	isLink := n.Data == "a" || n.Data == "area"
+	isPixel := isTrackingPixel(n)
+
+	attrs := n.Attr[:0]
+	for _, a := range n.Attr {
+		key := strings.ToLower(a.Key)
+		switch {
+		case strings.HasPrefix(key, "on"), key == "action", key == "formaction", key == "ping":
+			continue
+
+		case key == "style":
+			a.Val = cleanCSS(a.Val)
+
+		case key == "href" && isLink:
+			if !safeLinkURL(a.Val) {
+				continue
+			}
+
+		case key == "srcset":
+			// Candidate lists are not localized, the src fallback is
+			continue
+
+		case resourceAttributes[key]:
+			if !isRemoteURL(a.Val) {
+				if !safeResourceURL(a.Val) {
+					continue
+				}
+				break
+			}
+			if key != "src" || n.DataAtom != atom.Img || isPixel {
+				continue
+			}
+			local, ok := s.localizeImage(a.Val)
+			if !ok {
+				continue
+			}
+			a.Val = local
+		}
+		attrs = append(attrs, a)
+	}
+	n.Attr = attrs
+}
+
+// localizeImage downloads a remote image into the email folder when
+// localizing, returning the relative URL to use instead
+func (s *bodySanitizer) localizeImage(rawURL string) (string, bool) {
+	if s.mode != HTMLSanitizeLocalize {
+		return "", false
+	}
+	if name, ok := s.localized[rawURL]; ok {
+		if name == "" {
+			return "", false
+		}
+		return relativeURL(name), true
+	}
+
+	name, size, err := s.downloadImage(rawURL)
+	s.localized[rawURL] = name
+	if err != nil {
+		s.writer.logger.Warn(fmt.Sprintf("Blocked remote image %s: %v", rawURL, err))
+		return "", false
+	}
+
+	s.remoteImages = append(s.remoteImages, MetadataRemoteImage{URL: rawURL, Filename: name, Size: size})
+	s.writer.logger.Info(fmt.Sprintf("Saved remote image: %s (%d bytes)", name, size))
+	return relativeURL(name), true
+}
+
+// downloadImage saves a remote image as {prefix}_remote_{n}{ext}
+func (s *bodySanitizer) downloadImage(rawURL string) (string, int64, error) {
+	u := strings.TrimSpace(rawURL)
+	if strings.HasPrefix(u, "//") {
+		u = "https:" + u
+	}
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err := remoteImageClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("server returned %s", resp.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "image/") {
+		return "", 0, fmt.Errorf("not an image: %q", mediaType)
+	}
+
+	limit := int64(maxRemoteImageSize)
+	if max := s.writer.options.MaxAttachmentSize; max > 0 && max < limit {
+		limit = max
+	}
+
+	f, err := os.CreateTemp(s.folderPath, ".remote-*.part")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create image file: %v", err)
+	}
+	n, err := io.Copy(&limitedWriter{w: f, remaining: limit}, resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+
+	ext := imageExtension(mediaType, req.URL.Path)
+	for i := len(s.remoteImages) + 1; ; i++ {
+		name := fmt.Sprintf("%s_remote_%d%s", s.filePrefix, i, ext)
+		target := filepath.Join(s.folderPath, name)
+		if _, err := os.Lstat(target); err == nil {
+			continue
+		}
+		if err := os.Rename(f.Name(), target); err != nil {
+			os.Remove(f.Name())
+			return "", 0, fmt.Errorf("failed to move image into place: %v", err)
+		}
+		return name, n, nil
+	}
+}
+
+// imageExtension picks a file extension for a downloaded image
+func imageExtension(mediaType, urlPath string) string {
+	switch mediaType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/svg+xml":
+		return ".svg"
+	}
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	if ext := strings.ToLower(path.Ext(urlPath)); len(ext) > 1 && len(ext) <= 5 && !strings.ContainsAny(ext, `/\:`) {
+		return ext
+	}
+	return ".img"
+}
+
+// isTrackingPixel reports whether an element is declared as a 1x1 or
+// invisible image, which is never worth downloading
+func isTrackingPixel(n *html.Node) bool {
+	small := func(v string) bool {
+		v = strings.TrimSuffix(strings.TrimSpace(v), "px")
+		return v == "0" || v == "1"
+	}
+	return n.DataAtom == atom.Img && small(htmlAttr(n, "width")) && small(htmlAttr(n, "height"))
+}
+
+// cleanCSS removes imports, expressions and url() references that would be
+// loaded from the network
+func cleanCSS(css string) string {
+	css = cssImportRe.ReplaceAllString(css, "")
+	css = cssExpressionRe.ReplaceAllString(css, "invalid(")
+	return cssURLRe.ReplaceAllStringFunc(css, func(match string) string {
+		m := cssURLRe.FindStringSubmatch(match)
+		if safeResourceURL(strings.TrimSpace(m[1] + m[2] + m[3])) {
+			return match
+		}
+		return "none"
+	})
+}
+
+// normalizeURL drops the whitespace and control characters browsers ignore
+// in URLs, so "java\tscript:" is recognized
+func normalizeURL(raw string) string {
+	return strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, raw))
+}
+
+// isRemoteURL reports whether a resource URL points at the network
+func isRemoteURL(raw string) bool {
+	u := normalizeURL(raw)
+	return strings.HasPrefix(u, "http:") || strings.HasPrefix(u, "https:") || strings.HasPrefix(u, "//")
+}
+
+// safeResourceURL allows embedded data images, cid: references and paths
+// relative to the email folder
+func safeResourceURL(raw string) bool {
+	u := normalizeURL(raw)
+	if u == "" {
+		return true
+	}
+	if urlSchemeRe.MatchString(u) {
+		return strings.HasPrefix(u, "data:image/") || strings.HasPrefix(u, "cid:")
+	}
+	// Absolute paths would point into the local filesystem, and "//host"
+	// or "\\host" at the network
+	return !strings.HasPrefix(u, "/") && !strings.HasPrefix(u, `\`)
+}
+
+// safeLinkURL allows ordinary link targets but no script URLs
+func safeLinkURL(raw string) bool {
+	u := normalizeURL(raw)
+	if !urlSchemeRe.MatchString(u) {
+		return true
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	switch parsed.Scheme {
+	case "http", "https", "mailto", "tel":
+		return true
+	}
+	return false
+}
+
+// addContentSecurityPolicy declares the charset and the CSP at the top of
+// the head of a document
+func addContentSecurityPolicy(doc *html.Node) {
+	head := findElement(doc, atom.Head)
+	if head == nil {
+		return
+	}
+	for _, attrs := range [][]html.Attribute{
+		{{Key: "http-equiv", Val: "Content-Security-Policy"}, {Key: "content", Val: contentSecurityPolicy}},
+		{{Key: "charset", Val: "utf-8"}},
+	} {
+		meta := &html.Node{Type: html.ElementNode, Data: "meta", DataAtom: atom.Meta, Attr: attrs}
+		head.InsertBefore(meta, head.FirstChild)
+	}
+}
+
+func findElement(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func htmlAttr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if strings.EqualFold(a.Key, name) {
+			return a.Val
+		}
+	}
+	return ""
+}
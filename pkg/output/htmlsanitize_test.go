@@ -0,0 +1,269 @@
+package output
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+func sanitizeTestBody(t *testing.T, body string) string {
+	t.Helper()
+	w := NewFileWriter(&testLogger{}, Options{SanitizeHTML: HTMLSanitizeBlock}).(*FileWriter)
+	out, images, err := w.sanitizeBody(context.Background(), body, HTMLSanitizeBlock, t.TempDir(), "prefix")
+	if err != nil {
+		t.Fatalf("sanitizeBody(%q): %v", body, err)
+	}
+	if len(images) != 0 {
+		t.Fatalf("block mode saved remote images: %v", images)
+	}
+	return out
+}
+
+// metaContent returns the content of the <meta> in the head whose attribute
+// key has value, parsing the document like a browser would
+func metaContent(t *testing.T, doc, key, value string) string {
+	t.Helper()
+	root, err := html.Parse(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := findElement(root, atom.Head)
+	if head == nil {
+		return ""
+	}
+	for c := head.FirstChild; c != nil; c = c.NextSibling {
+		if c.DataAtom == atom.Meta && strings.EqualFold(htmlAttr(c, key), value) {
+			return htmlAttr(c, "content")
+		}
+	}
+	return ""
+}
+
+func TestSanitizeBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "script element",
+			body:    `<p>Hi</p><script>alert(1)</script>`,
+			want:    []string{"<p>Hi</p>"},
+			notWant: []string{"<script", "alert"},
+		},
+		{
+			name:    "script inside svg",
+			body:    `<svg><script>alert(1)</script><circle r="1"></circle></svg>`,
+			want:    []string{"<circle"},
+			notWant: []string{"<script", "alert"},
+		},
+		{
+			name:    "event handlers",
+			body:    `<img src="logo.png" onerror="alert(1)"><body onload="x()"><a href="https://example.com" OnMouseOver="y()">link</a>`,
+			want:    []string{`src="logo.png"`, `href="https://example.com"`},
+			notWant: []string{"onerror", "onload", "onmouseover", "OnMouseOver", "alert"},
+		},
+		{
+			name:    "javascript link",
+			body:    `<a href="javascript:alert(1)">a</a>`,
+			notWant: []string{"javascript"},
+		},
+		{
+			name:    "javascript link with tab",
+			body:    "<a href=\"java\tscript:alert(1)\">a</a>",
+			notWant: []string{"script:", "alert"},
+		},
+		{
+			name:    "javascript link with entity and case",
+			body:    `<a href="JaVa&#x09;ScRiPt:alert(1)">a</a>`,
+			notWant: []string{"alert"},
+		},
+		{
+			name: "safe links",
+			body: `<a href="mailto:me@example.com">m</a><a href="tel:+4612345">t</a><a href="#top">f</a>`,
+			want: []string{`href="mailto:me@example.com"`, `href="tel:+4612345"`, `href="#top"`},
+		},
+		{
+			name:    "remote css url",
+			body:    `<div style="background: url('https://tracker.example/p.gif')">x</div>`,
+			want:    []string{"background: none"},
+			notWant: []string{"tracker.example"},
+		},
+		{
+			name:    "protocol relative css url in style element",
+			body:    `<style>body { background: url(//tracker.example/p.gif) } @import url("https://evil.example/x.css");</style>`,
+			notWant: []string{"tracker.example", "evil.example", "@import"},
+		},
+		{
+			name:    "css expression",
+			body:    `<div style="width: expression(alert(1))">x</div>`,
+			notWant: []string{"expression("},
+		},
+		{
+			name: "local css url",
+			body: `<div style="background: url(cid:logo@example)">x</div>`,
+			want: []string{"url(cid:logo@example)"},
+		},
+		{
+			name:    "remote image blocked",
+			body:    `<img src="https://tracker.example/open.gif" width="1" height="1"><img src="http://cdn.example/hero.jpg">`,
+			notWant: []string{"tracker.example", "cdn.example"},
+		},
+		{
+			name:    "local file and data images",
+			body:    `<img src="/etc/passwd"><img src="\\host\share\x.png"><img src="data:image/png;base64,AAAA">`,
+			want:    []string{`src="data:image/png;base64,AAAA"`},
+			notWant: []string{"/etc/passwd", "share"},
+		},
+		{
+			name:    "frames, objects and forms",
+			body:    `<iframe src="https://evil.example"></iframe><object data="x.swf"></object><form action="https://evil.example/post"><p>Kept</p><input name="pw"></form>`,
+			want:    []string{"<p>Kept</p>"},
+			notWant: []string{"<iframe", "<object", "<form", "<input", "evil.example"},
+		},
+		{
+			name:    "meta refresh and base",
+			body:    `<html><head><meta http-equiv="refresh" content="0;url=https://evil.example"><base href="https://evil.example/"></head><body>x</body></html>`,
+			notWant: []string{"refresh", "<base", "evil.example"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := sanitizeTestBody(t, test.body)
+			for _, want := range test.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("sanitized body lacks %q:\n%s", want, out)
+				}
+			}
+			for _, unwanted := range test.notWant {
+				if strings.Contains(out, unwanted) {
+					t.Errorf("sanitized body contains %q:\n%s", unwanted, out)
+				}
+			}
+			if got := metaContent(t, out, "http-equiv", "Content-Security-Policy"); got != contentSecurityPolicy {
+				t.Errorf("Content-Security-Policy meta = %q, want %q", got, contentSecurityPolicy)
+			}
+			if !strings.Contains(out, `<meta charset="utf-8"/>`) {
+				t.Errorf("sanitized body lacks the charset meta:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestSafeResourceURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"", true},
+		{"logo.png", true},
+		{"images/logo.png", true},
+		{"../attachments/sha256/ab/cd/abcd", true},
+		{"cid:logo@example", true},
+		{"data:image/png;base64,AAAA", true},
+		{"DATA:IMAGE/gif;base64,AAAA", true},
+		{"data:text/html,<script>alert(1)</script>", false},
+		{"javascript:alert(1)", false},
+		{"java\tscript:alert(1)", false},
+		{" javascript:alert(1)", false},
+		{"vbscript:x", false},
+		{"file:///etc/passwd", false},
+		{"/etc/passwd", false},
+		{"//evil.example/x.png", false},
+		{`\\host\share`, false},
+	}
+	for _, test := range tests {
+		if got := safeResourceURL(test.url); got != test.want {
+			t.Errorf("safeResourceURL(%q) = %v, want %v", test.url, got, test.want)
+		}
+	}
+}
+
+func TestSafeLinkURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://example.com/a?b=c", true},
+		{"HTTP://example.com", true},
+		{"mailto:me@example.com", true},
+		{"tel:+4612345", true},
+		{"#section", true},
+		{"page.html", true},
+		{"javascript:alert(1)", false},
+		{"java\tscript:alert(1)", false},
+		{"java\nscript:alert(1)", false},
+		{"\x00javascript:alert(1)", false},
+		{"data:text/html,<script>alert(1)</script>", false},
+		{"vbscript:msgbox", false},
+		{"file:///etc/passwd", false},
+	}
+	for _, test := range tests {
+		if got := safeLinkURL(test.url); got != test.want {
+			t.Errorf("safeLinkURL(%q) = %v, want %v", test.url, got, test.want)
+		}
+	}
+}
+
+func TestCheckPublicAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		public  bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"127.0.0.1:80", false},
+		{"127.1.2.3:8080", false},
+		{"[::1]:80", false},
+		{"10.0.0.5:80", false},
+		{"172.16.3.4:80", false},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"[fc00::1]:80", false},
+		{"100.64.0.1:80", false},
+		{"0.0.0.0:80", false},
+		{"[::]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"[::ffff:169.254.169.254]:80", false},
+		{"224.0.0.1:80", false},
+		{"not-an-address", false},
+	}
+	for _, test := range tests {
+		err := checkPublicAddress(test.address)
+		if (err == nil) != test.public {
+			t.Errorf("checkPublicAddress(%q) = %v, want public %v", test.address, err, test.public)
+		}
+	}
+}
+
+func TestLocalizeRefusesLoopback(t *testing.T) {
+	requested := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG"))
+	}))
+	defer server.Close()
+
+	log := &testLogger{}
+	w := NewFileWriter(log, Options{SanitizeHTML: HTMLSanitizeLocalize}).(*FileWriter)
+	body := `<img src="` + server.URL + `/logo.png" width="200">`
+	out, images, err := w.sanitizeBody(context.Background(), body, HTMLSanitizeLocalize, t.TempDir(), "prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requested || len(images) != 0 || strings.Contains(out, server.URL) {
+		t.Errorf("loopback image was fetched: requested %v, images %v, body %s", requested, images, out)
+	}
+	if len(log.warnings) != 1 || !strings.Contains(log.warnings[0], "non-public address") {
+		t.Errorf("expected a blocked image warning, got %v", log.warnings)
+	}
+}
@@ -0,0 +1,183 @@
+package output
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// IndexFileName is the name of the message index kept in the output directory
+const IndexFileName = ".getgmail_index"
+
+// messageIndex maps Gmail message IDs to the folder (or file) they were written to.
+// It is stored as an append-only file of "id<TAB>folder" lines so that each
+// written email costs a single small append.
+type messageIndex struct {
+	mu      sync.Mutex
+	dir     string
+	folders map[string]string
+}
+
+// indexScanner rebuilds an index by scanning the output a writer produced
+type indexScanner func(outputDir string) (map[string]string, error)
+
+// loadMessageIndex reads the index from outputDir, rebuilding it with scan
+// when no index file is present
+func loadMessageIndex(outputDir string, scan indexScanner) (*messageIndex, bool, error) {
+	idx := &messageIndex{
+		dir:     outputDir,
+		folders: make(map[string]string),
+	}
+
+	f, err := os.Open(filepath.Join(outputDir, IndexFileName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, false, fmt.Errorf("failed to open message index: %v", err)
+		}
+		if err := idx.rebuild(scan); err != nil {
+			return nil, false, err
+		}
+		return idx, true, nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		id, folder, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok || id == "" {
+			continue
+		}
+		// Later entries win, so a re-written email points at its newest folder
+		idx.folders[id] = folder
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, fmt.Errorf("failed to read message index: %v", err)
+	}
+	return idx, false, nil
+}
+
+// rebuild recreates the index from the writer's output and rewrites the
+// index file from the result
+func (idx *messageIndex) rebuild(scan indexScanner) error {
+	folders, err := scan(idx.dir)
+	if err != nil {
+		return err
+	}
+	idx.folders = folders
+
+	var b strings.Builder
+	for id, folder := range idx.folders {
+		fmt.Fprintf(&b, "%s\t%s\n", id, folder)
+	}
+	if err := os.WriteFile(filepath.Join(idx.dir, IndexFileName), []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write message index: %v", err)
+	}
+	return nil
+}
+
+// scanMetadataFiles finds every *_metadata.txt file below the output
+// directory, at any depth a folder layout may nest them, and maps its
+// "Email ID:" line to the email folder
+func scanMetadataFiles(outputDir string) (map[string]string, error) {
+	folders := make(map[string]string)
+	err := filepath.WalkDir(outputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == filepath.Join(outputDir, AttachmentStoreDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(d.Name(), "_metadata.txt") {
+			return nil
+		}
+
+		id := readMetadataEmailID(path)
+		if id == "" {
+			return nil
+		}
+		folder, err := filepath.Rel(outputDir, filepath.Dir(path))
+		if err != nil {
+			return nil
+		}
+		folders[id] = folder
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan metadata files: %v", err)
+	}
+	return folders, nil
+}
+
+// readMetadataEmailID returns the value of the "Email ID:" line of a metadata file
+func readMetadataEmailID(metadataPath string) string {
+	f, err := os.Open(metadataPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if id, ok := strings.CutPrefix(scanner.Text(), "Email ID: "); ok {
+			return strings.TrimSpace(id)
+		}
+	}
+	return ""
+}
+
+// folderEmailID returns the message ID recorded in the metadata file of an
+// email folder, or "" when the folder holds no email
+func folderEmailID(folderPath string) string {
+	matches, err := filepath.Glob(filepath.Join(folderPath, "*_metadata.txt"))
+	if err != nil {
+		return ""
+	}
+	for _, metadataPath := range matches {
+		if id := readMetadataEmailID(metadataPath); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// Lookup returns the folder of a downloaded message, relative to the output
+// directory. Entries whose folder has since been removed are ignored.
+func (idx *messageIndex) Lookup(messageID string) (string, bool) {
+	idx.mu.Lock()
+	folder, ok := idx.folders[messageID]
+	idx.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+
+	if _, err := os.Stat(filepath.Join(idx.dir, folder)); err != nil {
+		return "", false
+	}
+	return folder, true
+}
+
+// Add records a downloaded message and appends it to the index file
+func (idx *messageIndex) Add(messageID, folder string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.folders[messageID] = folder
+
+	f, err := os.OpenFile(filepath.Join(idx.dir, IndexFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open message index: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(f, "%s\t%s\n", messageID, folder); err != nil {
+		return fmt.Errorf("failed to update message index: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package output
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMessageIndexLookup(t *testing.T) {
+	outputDir := t.TempDir()
+	for _, folder := range []string{"2024-01-01_a", "2024-02-02_b", filepath.Join("2024", "03", "c")} {
+		if err := os.MkdirAll(filepath.Join(outputDir, folder), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, filepath.Join(outputDir, IndexFileName), "aaa\t2024-01-01_a\n"+
+		"bbb\t2024-01-01_old\n"+
+		"bbb\t2024-02-02_b\n"+
+		"gone\t2024-05-05_deleted\n"+
+		"ccc\t"+filepath.Join("2024", "03", "c")+"\n"+
+		"no tab on this line\n"+
+		"\t2024-01-01_a\n")
+
+	idx, rebuilt, err := loadMessageIndex(outputDir, func(string) (map[string]string, error) {
+		t.Fatal("the index was rebuilt although its file exists")
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt {
+		t.Error("loadMessageIndex reported a rebuild")
+	}
+
+	tests := []struct {
+		name   string
+		id     string
+		folder string
+		found  bool
+	}{
+		{"hit", "aaa", "2024-01-01_a", true},
+		{"later entry wins", "bbb", "2024-02-02_b", true},
+		{"nested folder", "ccc", filepath.Join("2024", "03", "c"), true},
+		{"miss", "zzz", "", false},
+		{"folder removed", "gone", "", false},
+		{"malformed line", "no tab on this line", "", false},
+		{"empty id", "", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			folder, found := idx.Lookup(test.id)
+			if folder != test.folder || found != test.found {
+				t.Errorf("Lookup(%q) = %q, %v, want %q, %v", test.id, folder, found, test.folder, test.found)
+			}
+		})
+	}
+}
+
+func TestMessageIndexRebuild(t *testing.T) {
+	outputDir := t.TempDir()
+	writeTestFile(t, filepath.Join(outputDir, "2024-01-01_a", "2024-01-01_a_metadata.txt"), "Subject: A\nEmail ID: aaa\n")
+	writeTestFile(t, filepath.Join(outputDir, "2024", "02", "b", "b_metadata.txt"), "Subject: B\nEmail ID: bbb \n")
+	writeTestFile(t, filepath.Join(outputDir, "2024-03-03_c", "c_metadata.txt"), "Subject: no ID\n")
+	writeTestFile(t, filepath.Join(outputDir, AttachmentStoreDir, "sha256", "x_metadata.txt"), "Email ID: stored\n")
+
+	idx, rebuilt, err := loadMessageIndex(outputDir, scanMetadataFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rebuilt {
+		t.Error("loadMessageIndex did not report a rebuild")
+	}
+	want := map[string]string{
+		"aaa": "2024-01-01_a",
+		"bbb": filepath.Join("2024", "02", "b"),
+	}
+	if !reflect.DeepEqual(idx.folders, want) {
+		t.Errorf("rebuilt index = %v, want %v", idx.folders, want)
+	}
+
+	// The rebuilt file and later additions are read back without a rescan
+	if err := os.MkdirAll(filepath.Join(outputDir, "2024-04-04_d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Add("ddd", "2024-04-04_d"); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, rebuilt, err := loadMessageIndex(outputDir, func(string) (map[string]string, error) {
+		t.Fatal("the index was rebuilt again")
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt {
+		t.Error("loadMessageIndex reported a rebuild of an existing index")
+	}
+	want["ddd"] = "2024-04-04_d"
+	if !reflect.DeepEqual(reloaded.folders, want) {
+		t.Errorf("reloaded index = %v, want %v", reloaded.folders, want)
+	}
+}
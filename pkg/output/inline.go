@@ -0,0 +1,102 @@
+package output
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Inline image modes, selecting what cid: references to inline images in the
+// saved HTML body are rewritten to
+const (
+	InlineImagesLink  = "link"
+	InlineImagesEmbed = "embed"
+)
+
+// cidRefRe matches cid: URLs in attribute values and CSS url(), capturing
+// what precedes the URL and the Content-ID
+var cidRefRe = regexp.MustCompile(`(?i)(["'(=]\s*)cid:([^"'\s>)]+)`)
+
+// ValidateInlineImages checks that mode is one of the InlineImages* modes
+func ValidateInlineImages(mode string) error {
+	switch mode {
+	case "", InlineImagesLink, InlineImagesEmbed:
+		return nil
+	}
+	return fmt.Errorf("invalid inline images mode %q, expected %s or %s", mode, InlineImagesLink, InlineImagesEmbed)
+}
+
+// inlineImage is a saved attachment the HTML body can refer to by Content-ID
+type inlineImage struct {
+	file     string // file holding the content
+	link     string // URL of the file relative to the email folder
+	mimeType string
+}
+
+// newInlineImage describes a saved attachment for rewriting the body of the
+// email in folderPath. Attachments that are only referenced from the
+// metadata link to the attachment store.
+func newInlineImage(folderPath, attachmentPath, storeFile, outputDir, mimeType string) inlineImage {
+	image := inlineImage{file: attachmentPath, link: filepath.Base(attachmentPath), mimeType: mimeType}
+	if _, err := os.Lstat(attachmentPath); err != nil && storeFile != "" {
+		image.file = filepath.Join(outputDir, storeFile)
+		if rel, err := filepath.Rel(folderPath, image.file); err == nil {
+			image.link = rel
+		}
+	}
+	image.link = relativeURL(image.link)
+	return image
+}
+
+// relativeURL escapes a relative file path for use in an HTML attribute
+func relativeURL(path string) string {
+	// url.URL prefixes "./" when the first segment looks like a scheme
+	u := (&url.URL{Path: filepath.ToSlash(path)}).String()
+	return strings.NewReplacer("'", "%27", "&", "%26").Replace(u)
+}
+
+// rewriteCIDs replaces cid: references in an HTML body with links to the
+// saved inline images, or with data: URIs when images are embedded.
+// References to images that were not saved are left alone.
+func (w *FileWriter) rewriteCIDs(body string, images map[string]inlineImage) string {
+	if len(images) == 0 || !strings.Contains(strings.ToLower(body), "cid:") {
+		return body
+	}
+
+	embedded := make(map[string]string)
+	return cidRefRe.ReplaceAllStringFunc(body, func(match string) string {
+		m := cidRefRe.FindStringSubmatch(match)
+		// cid: URLs are percent-encoded Content-IDs (RFC 2392)
+		id := m[2]
+		if unescaped, err := url.PathUnescape(id); err == nil {
+			id = unescaped
+		}
+		image, ok := images[strings.ToLower(id)]
+		if !ok {
+			return match
+		}
+		if w.options.InlineImages != InlineImagesEmbed {
+			return m[1] + image.link
+		}
+
+		uri, ok := embedded[image.file]
+		if !ok {
+			data, err := os.ReadFile(image.file)
+			if err != nil {
+				w.logger.Warn(fmt.Sprintf("Failed to embed inline image %s, linking it instead: %v", id, err))
+				return m[1] + image.link
+			}
+			mimeType := image.mimeType
+			if mimeType == "" {
+				mimeType = "application/octet-stream"
+			}
+			uri = "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data)
+			embedded[image.file] = uri
+		}
+		return m[1] + uri
+	})
+}
@@ -0,0 +1,75 @@
+package output
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRewriteCIDs(t *testing.T) {
+	dir := t.TempDir()
+	logo := filepath.Join(dir, "logo.png")
+	if err := os.WriteFile(logo, []byte("PNG"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	raw := filepath.Join(dir, "chart")
+	if err := os.WriteFile(raw, []byte("raw"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	images := map[string]inlineImage{
+		"logo@example.com": {file: logo, link: "logo.png", mimeType: "image/png"},
+		"chart":            {file: raw, link: "my%20chart"},
+		"gone":             {file: filepath.Join(dir, "missing.gif"), link: "missing.gif", mimeType: "image/gif"},
+	}
+
+	tests := []struct {
+		name     string
+		mode     string
+		body     string
+		want     string
+		warnings int
+	}{
+		{"link", InlineImagesLink, `<img src="cid:logo@example.com">`, `<img src="logo.png">`, 0},
+		{"default mode links", "", `<img src='cid:logo@example.com'>`, `<img src='logo.png'>`, 0},
+		{"case-insensitive", InlineImagesLink, `<img src="CID:Logo@Example.com">`, `<img src="logo.png">`, 0},
+		{"percent-encoded", InlineImagesLink, `<img src="cid:logo%40example.com">`, `<img src="logo.png">`, 0},
+		{"css url", InlineImagesLink, `<td style="background: url(cid:chart)">`, `<td style="background: url(my%20chart)">`, 0},
+		{"unquoted attribute", InlineImagesLink, `<img src=cid:chart alt=x>`, `<img src=my%20chart alt=x>`, 0},
+		{"unknown image", InlineImagesLink, `<img src="cid:other@example.com">`, `<img src="cid:other@example.com">`, 0},
+		{"not a reference", InlineImagesLink, `<p>see cid:logo@example.com</p>`, `<p>see cid:logo@example.com</p>`, 0},
+		{"embed", InlineImagesEmbed, `<img src="cid:logo@example.com"><img src="cid:logo@example.com">`,
+			`<img src="data:image/png;base64,UE5H"><img src="data:image/png;base64,UE5H">`, 0},
+		{"embed without type", InlineImagesEmbed, `<img src="cid:chart">`, `<img src="data:application/octet-stream;base64,cmF3">`, 0},
+		{"embed missing file links", InlineImagesEmbed, `<img src="cid:gone">`, `<img src="missing.gif">`, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			log := &testLogger{}
+			writer, err := NewWriter(log, OutputFiles, Options{InlineImages: test.mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := writer.(*FileWriter).rewriteCIDs(test.body, images); got != test.want {
+				t.Errorf("rewriteCIDs(%q) = %q, want %q", test.body, got, test.want)
+			}
+			if len(log.warnings) != test.warnings {
+				t.Errorf("got warnings %v, want %d", log.warnings, test.warnings)
+			}
+		})
+	}
+}
+
+func TestRelativeURL(t *testing.T) {
+	tests := map[string]string{
+		"logo.png":                 "logo.png",
+		"my chart.png":             "my%20chart.png",
+		"a:b.png":                  "./a:b.png",
+		"it's & more.png":          "it%27s%20%26%20more.png",
+		"../attachments/sha256/ab": "../attachments/sha256/ab",
+	}
+	for path, want := range tests {
+		if got := relativeURL(path); got != want {
+			t.Errorf("relativeURL(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
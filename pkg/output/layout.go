@@ -0,0 +1,196 @@
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+// DefaultLayout is the folder layout of FileWriter: one flat folder per email
+// named YYYY-MM-DD_HH-MM-SS_subject
+const DefaultLayout = "{{.Date}}_{{.Time}}_{{.Subject}}"
+
+// layoutFolderLabels are the system labels the Label field falls back to
+// when an email has no user label, in order of preference
+var layoutFolderLabels = []string{"INBOX", "SENT", "DRAFT", "SPAM", "TRASH"}
+
+// LayoutData is the value a layout template is rendered against. All string
+// fields except the IDs are sanitized with the writer's filename policy.
+type LayoutData struct {
+	Year     string // 2006
+	Month    string // 01
+	Day      string // 02
+	Date     string // 2006-01-02
+	Time     string // 15-04-05
+	From     string // sender name, or the address when there is no name
+	Subject  string
+	Label    string // first user label with nested labels as subfolders, else INBOX, SENT, ...
+	ThreadID string
+	ID       string
+
+	// Email gives access to the unsanitized message. Its values go into the
+	// path as they are: a "/" in them starts a subfolder, characters no
+	// filesystem accepts are removed and "." and ".." segments are dropped.
+	Email *interfaces.EmailMessage
+}
+
+// Layout renders the folder path of an email, relative to the output
+// directory, from a text/template
+type Layout struct {
+	tmpl      *template.Template
+	sanitizer *Sanitizer
+}
+
+// NewLayout parses a layout template and checks that it renders a usable path
+func NewLayout(text string, sanitizer *Sanitizer) (*Layout, error) {
+	if strings.TrimSpace(text) == "" {
+		text = DefaultLayout
+	}
+
+	tmpl, err := template.New("layout").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid layout template: %v", err)
+	}
+	l := &Layout{tmpl: tmpl, sanitizer: sanitizer}
+
+	sample := &interfaces.EmailMessage{
+		ID:       "18c2f0a1b2c3d4e5",
+		ThreadID: "18c2f0a1b2c3d4e5",
+		LabelIDs: []string{"INBOX"},
+		Labels:   []string{"INBOX"},
+		Subject:  "Layout check",
+		From:     "Sender <sender@example.com>",
+	}
+	path, err := l.render(sample, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("invalid layout template: %v", err)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("invalid layout template: %q renders an empty folder name", text)
+	}
+	return l, nil
+}
+
+// mustLayout returns the layout for a template, falling back to
+// DefaultLayout for invalid ones. Layouts are validated by NewWriter.
+func mustLayout(text string, sanitizer *Sanitizer) *Layout {
+	l, err := NewLayout(text, sanitizer)
+	if err != nil {
+		l, _ = NewLayout(DefaultLayout, sanitizer)
+	}
+	return l
+}
+
+// FolderPath renders the email's folder path relative to the output directory
+func (l *Layout) FolderPath(email *interfaces.EmailMessage, date time.Time) (string, error) {
+	path, err := l.render(email, date)
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		return "", fmt.Errorf("layout renders an empty folder name for email %s", email.ID)
+	}
+	return path, nil
+}
+
+// render executes the template and turns the result into a clean relative
+// path. "/" in the template separates folders; empty, "." and ".." segments
+// are dropped so a layout can never point outside the output directory.
+func (l *Layout) render(email *interfaces.EmailMessage, date time.Time) (string, error) {
+	var buf bytes.Buffer
+	if err := l.tmpl.Execute(&buf, l.data(email, date)); err != nil {
+		return "", err
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(filepath.ToSlash(buf.String()), "/") {
+		segment = cleanPathSegment(segment)
+		if segment == "" || segment == "." || segment == ".." {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	return filepath.Join(segments...), nil
+}
+
+func (l *Layout) data(email *interfaces.EmailMessage, date time.Time) LayoutData {
+	// Keep the subject short enough that the folder name and the files
+	// prefixed with it stay below the filesystem limit
+	subject := l.sanitizer.Clean(email.Subject)
+	if subject == "" {
+		subject = "no-subject"
+	}
+	subject = strings.TrimRight(truncateBytes(subject, 200-len("2006-01-02_15-04-05")-1), "-")
+
+	from := email.From
+	if addr, err := mail.ParseAddress(email.From); err == nil {
+		from = addr.Name
+		if from == "" {
+			from = addr.Address
+		}
+	}
+	from = truncateBytes(l.sanitizer.Clean(from), 64)
+	if from == "" {
+		from = "unknown-sender"
+	}
+
+	return LayoutData{
+		Year:     date.Format("2006"),
+		Month:    date.Format("01"),
+		Day:      date.Format("02"),
+		Date:     date.Format("2006-01-02"),
+		Time:     date.Format("15-04-05"),
+		From:     from,
+		Subject:  subject,
+		Label:    l.label(email),
+		ThreadID: email.ThreadID,
+		ID:       email.ID,
+		Email:    email,
+	}
+}
+
+// label picks the folder an email is filed under: its first user label, with
+// nested labels kept as subfolders, or its first system folder label
+func (l *Layout) label(email *interfaces.EmailMessage) string {
+	for i, labelID := range email.LabelIDs {
+		if !strings.HasPrefix(labelID, "Label_") || i >= len(email.Labels) {
+			continue
+		}
+		var parts []string
+		for _, part := range strings.Split(email.Labels[i], "/") {
+			if part = l.sanitizer.Clean(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+		if len(parts) > 0 {
+			return strings.Join(parts, "/")
+		}
+	}
+
+	for _, folder := range layoutFolderLabels {
+		for _, labelID := range email.LabelIDs {
+			if labelID == folder {
+				return folder
+			}
+		}
+	}
+	return "Archive"
+}
+
+// cleanPathSegment strips characters no filesystem accepts in a folder name
+// from one rendered path segment and shortens it to the name length limit
+func cleanPathSegment(segment string) string {
+	segment = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f || strings.ContainsRune(`<>:"\|?*`, r) {
+			return -1
+		}
+		return r
+	}, segment)
+	return strings.TrimSpace(truncateBytes(strings.TrimSpace(segment), maxFilenameBytes))
+}
@@ -0,0 +1,77 @@
+package output
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+func TestLayoutFolderPath(t *testing.T) {
+	sanitizer, err := NewSanitizer(FilenamesUnicode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2024, time.August, 1, 4, 39, 3, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		layout   string
+		subject  string
+		labelIDs []string
+		labels   []string
+		want     string // slash-separated, "" for an error
+	}{
+		{name: "default", layout: DefaultLayout, subject: "Invoice 42", want: "2024-08-01_04-39-03_Invoice-42"},
+		{name: "nested", layout: "{{.Year}}/{{.Month}}/{{.Day}}", want: "2024/08/01"},
+		{name: "nested label", layout: "{{.Label}}/{{.Date}}", labelIDs: []string{"INBOX", "Label_1"}, labels: []string{"INBOX", "Receipts/2024"}, want: "Receipts/2024/2024-08-01"},
+		{name: "system label", layout: "{{.Label}}", labelIDs: []string{"UNREAD", "SENT"}, labels: []string{"UNREAD", "SENT"}, want: "SENT"},
+		{name: "no folder label", layout: "{{.Label}}", labelIDs: []string{"CATEGORY_UPDATES"}, labels: []string{"CATEGORY_UPDATES"}, want: "Archive"},
+		{name: "dot segments dropped", layout: "../{{.Email.Subject}}", subject: "../../etc/./passwd", want: "etc/passwd"},
+		{name: "empty segments dropped", layout: "{{.Year}}//{{.Email.Subject}}/", subject: "a", want: "2024/a"},
+		{name: "invalid characters stripped", layout: "{{.Email.Subject}}", subject: `a<b>:c"d|e?f*g`, want: "abcdefg"},
+		{name: "only whitespace", layout: "{{.Year}}/{{.Email.Subject}}", subject: "  \t ", want: "2024"},
+		{name: "nothing left", layout: "{{.Email.Subject}}", subject: "../..", want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layout, err := NewLayout(test.layout, sanitizer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			email := &interfaces.EmailMessage{
+				ID:       "18c2f0a1",
+				Subject:  test.subject,
+				From:     "Billing <billing@example.com>",
+				LabelIDs: test.labelIDs,
+				Labels:   test.labels,
+			}
+			got, err := layout.FolderPath(email, date)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("FolderPath = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != filepath.FromSlash(test.want) {
+				t.Errorf("FolderPath = %q, want %q", got, filepath.FromSlash(test.want))
+			}
+		})
+	}
+}
+
+func TestNewLayoutRejectsEmptyPaths(t *testing.T) {
+	sanitizer, err := NewSanitizer(FilenamesUnicode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"..", "./..", "{{.Year", "{{.Missing}}"} {
+		if _, err := NewLayout(text, sanitizer); err == nil {
+			t.Errorf("NewLayout(%q) succeeded, want an error", text)
+		}
+	}
+}
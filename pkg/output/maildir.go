@@ -0,0 +1,507 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+// maildirSystemFolders maps Gmail system labels to Maildir++ folders. INBOX
+// is the Maildir root, labels missing here (UNREAD, STARRED, CATEGORY_*...)
+// become flags or are ignored.
+var maildirSystemFolders = map[string]string{
+	"INBOX": ".",
+	"SENT":  ".Sent",
+	"DRAFT": ".Drafts",
+	"SPAM":  ".Spam",
+	"TRASH": ".Trash",
+}
+
+// isFolderLabel reports whether a label gets a Maildir folder or mbox file of
+// its own: the system labels of maildirSystemFolders and all user labels.
+// Labels that are flags or views, such as UNREAD, IMPORTANT and the
+// CATEGORY_* tabs, do not.
+func isFolderLabel(labelID string) bool {
+	_, system := maildirSystemFolders[labelID]
+	return system || strings.HasPrefix(labelID, "Label_")
+}
+
+// maildirArchiveFolder holds messages without any folder label, which Gmail
+// shows only under "All Mail"
+const maildirArchiveFolder = ".Archive"
+
+// maildirIDRe extracts the Gmail message ID from a file name written by MaildirWriter
+var maildirIDRe = regexp.MustCompile(`\.G([0-9a-fA-F]+)\.`)
+
+// maildirCounter keeps file names unique within one process and second
+var maildirCounter atomic.Uint64
+
+// MaildirWriter delivers each email into a Maildir++ tree: INBOX is the root
+// maildir, every other Gmail label a ".Label.Sub" subfolder, and UNREAD and
+// STARRED become the absence of the S flag and the F flag
+type MaildirWriter struct {
+	logger    interfaces.Logger
+	options   Options
+	sanitizer *Sanitizer
+	index     *messageIndex
+	hostname  string
+}
+
+func NewMaildirWriter(logger interfaces.Logger, options Options) interfaces.OutputWriter {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+	// "/" and ":" are not allowed in Maildir file names
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+
+	return &MaildirWriter{
+		logger:    logger,
+		options:   options,
+		sanitizer: mustSanitizer(options.FilenamePolicy),
+		hostname:  hostname,
+	}
+}
+
+func (w *MaildirWriter) ValidateOutputDir(outputDir string) error {
+	return validateOutputDir(w.logger, outputDir)
+}
+
+// LoadIndex loads the message ID index of the output directory, rebuilding it
+// from the file names in the Maildir tree if needed
+func (w *MaildirWriter) LoadIndex(outputDir string) error {
+	idx, rebuilt, err := loadMessageIndex(outputDir, scanMaildirs)
+	if err != nil {
+		return err
+	}
+	if rebuilt {
+		w.logger.Info(fmt.Sprintf("Rebuilt message index with %d emails", len(idx.folders)))
+	}
+	w.index = idx
+	return nil
+}
+
+func (w *MaildirWriter) IsDownloaded(messageID string) bool {
+	if w.index == nil {
+		return false
+	}
+	_, ok := w.index.Lookup(messageID)
+	return ok
+}
+
+// GenerateFolderName returns the first Maildir++ folder the email is delivered to
+func (w *MaildirWriter) GenerateFolderName(email *interfaces.EmailMessage) string {
+	return w.maildirFolders(email)[0]
+}
+
+// CreateEmailFolder makes sure the email's first Maildir++ folder exists
+func (w *MaildirWriter) CreateEmailFolder(email *interfaces.EmailMessage, outputDir string) (string, error) {
+	folder := w.GenerateFolderName(email)
+	if err := w.createMaildir(outputDir, folder); err != nil {
+		return "", err
+	}
+	return filepath.Join(outputDir, folder), nil
+}
+
+// maildirFolders maps the email's labels to Maildir++ folder names
+func (w *MaildirWriter) maildirFolders(email *interfaces.EmailMessage) []string {
+	var folders []string
+	seen := make(map[string]bool)
+	add := func(folder string) {
+		if !seen[folder] {
+			seen[folder] = true
+			folders = append(folders, folder)
+		}
+	}
+
+	for i, labelID := range email.LabelIDs {
+		if !isFolderLabel(labelID) {
+			continue
+		}
+		if folder, ok := maildirSystemFolders[labelID]; ok {
+			add(folder)
+			continue
+		}
+
+		name := labelID
+		if i < len(email.Labels) {
+			name = email.Labels[i]
+		}
+		// Dots separate Maildir++ levels, so they are replaced inside each
+		// label component before the "/" of nested labels become levels
+		var parts []string
+		for _, part := range strings.Split(name, "/") {
+			part = w.sanitizer.Clean(strings.ReplaceAll(part, ".", "_"))
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+		if len(parts) > 0 {
+			add("." + strings.Join(parts, "."))
+		}
+	}
+
+	if len(folders) == 0 {
+		add(maildirArchiveFolder)
+	}
+	return folders
+}
+
+// maildirFlags returns the sorted Maildir info flags for the email's labels
+func maildirFlags(email *interfaces.EmailMessage) string {
+	unread := false
+	var flags []string
+	for _, labelID := range email.LabelIDs {
+		switch labelID {
+		case "UNREAD":
+			unread = true
+		case "STARRED":
+			flags = append(flags, "F")
+		case "DRAFT":
+			flags = append(flags, "D")
+		}
+	}
+	if !unread {
+		flags = append(flags, "S")
+	}
+	sort.Strings(flags)
+	return strings.Join(flags, "")
+}
+
+// createMaildir creates the tmp/new/cur directories of a Maildir++ folder
+func (w *MaildirWriter) createMaildir(outputDir, folder string) error {
+	folderPath := filepath.Join(outputDir, folder)
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(folderPath, sub), 0755); err != nil {
+			return fmt.Errorf("failed to create maildir: %v", err)
+		}
+	}
+	// Maildir++ marks subfolders with an empty maildirfolder file
+	if folder != "." {
+		marker := filepath.Join(folderPath, "maildirfolder")
+		if _, err := os.Stat(marker); os.IsNotExist(err) {
+			if err := os.WriteFile(marker, nil, 0644); err != nil {
+				return fmt.Errorf("failed to create maildir: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (w *MaildirWriter) WriteEmail(ctx context.Context, email *interfaces.EmailMessage, outputDir string) error {
+	if len(email.Raw) == 0 {
+		return fmt.Errorf("email %s has no raw message to write to maildir", email.ID)
+	}
+
+	date := parseEmailDate(w.logger, email.Date)
+	uniqueName := fmt.Sprintf("%d.G%s.M%dP%d.%s", time.Now().Unix(), email.ID, maildirCounter.Add(1), os.Getpid(), w.hostname)
+
+	// Unread messages without flags are new mail, the rest is filed in cur/
+	// with its info suffix
+	sub, fileName := "new", uniqueName
+	if flags := maildirFlags(email); flags != "" {
+		sub, fileName = "cur", uniqueName+":2,"+flags
+	}
+
+	folders := w.maildirFolders(email)
+	var delivered string
+	for _, folder := range folders {
+		if err := w.createMaildir(outputDir, folder); err != nil {
+			return err
+		}
+
+		targetPath := filepath.Join(outputDir, folder, sub, fileName)
+
+		// Further folders share the message through a hard link where possible
+		if delivered != "" {
+			if err := os.Link(delivered, targetPath); err == nil {
+				continue
+			}
+		}
+
+		// Deliver through tmp so readers never see a partially written message
+		tmpPath := filepath.Join(outputDir, folder, "tmp", uniqueName)
+		if err := os.WriteFile(tmpPath, email.Raw, 0644); err != nil {
+			return fmt.Errorf("failed to write maildir message: %v", err)
+		}
+		if err := os.Chtimes(tmpPath, date, date); err != nil {
+			w.logger.Warn(fmt.Sprintf("Failed to set message timestamp: %v", err))
+		}
+		if err := os.Rename(tmpPath, targetPath); err != nil {
+			os.Remove(tmpPath)
+			return fmt.Errorf("failed to deliver maildir message: %v", err)
+		}
+		delivered = targetPath
+	}
+
+	if w.index != nil && w.index.dir == outputDir {
+		if err := w.index.Add(email.ID, folders[0]); err != nil {
+			w.logger.Warn(fmt.Sprintf("Failed to index email %s: %v", email.ID, err))
+		}
+	}
+
+	w.logger.Info(fmt.Sprintf("Delivered email %s to %s", email.ID, strings.Join(folders, ", ")))
+	return nil
+}
+
+// maildirFolderNames returns the root maildir and all Maildir++ subfolders
+func maildirFolderNames(outputDir string) ([]string, error) {
+	folders := []string{"."}
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan maildir: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), ".") {
+			folders = append(folders, entry.Name())
+		}
+	}
+	return folders, nil
+}
+
+// walkMaildirs calls fn with the folder, subdirectory and Gmail message ID of
+// every message file in the root maildir and all Maildir++ subfolders
+func walkMaildirs(outputDir string, fn func(folder, sub, name, id string)) error {
+	folders, err := maildirFolderNames(outputDir)
+	if err != nil {
+		return err
+	}
+	for _, folder := range folders {
+		for _, sub := range []string{"new", "cur"} {
+			files, err := os.ReadDir(filepath.Join(outputDir, folder, sub))
+			if err != nil {
+				continue
+			}
+			for _, f := range files {
+				if m := maildirIDRe.FindStringSubmatch(f.Name()); m != nil {
+					fn(folder, sub, f.Name(), m[1])
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// scanMaildirs maps the Gmail message IDs in the file names of the root
+// maildir and all Maildir++ subfolders to their folder
+func scanMaildirs(outputDir string) (map[string]string, error) {
+	ids := make(map[string]string)
+	err := walkMaildirs(outputDir, func(folder, sub, name, id string) {
+		if _, seen := ids[id]; !seen {
+			ids[id] = folder
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// maildirFile is one copy of a saved message in a Maildir++ folder
+type maildirFile struct {
+	folder string
+	sub    string
+	name   string
+}
+
+func (f maildirFile) path(outputDir string) string {
+	return filepath.Join(outputDir, f.folder, f.sub, f.name)
+}
+
+// uniqueName returns the file name without the info suffix
+func (f maildirFile) uniqueName() string {
+	name, _, _ := strings.Cut(f.name, ":")
+	return name
+}
+
+// flags returns the info flags of the file name
+func (f maildirFile) flags() string {
+	_, flags, _ := strings.Cut(f.name, ":2,")
+	return flags
+}
+
+// findMaildirFiles returns every copy of the given messages in the Maildir tree
+func findMaildirFiles(outputDir string, ids map[string]bool) (map[string][]maildirFile, error) {
+	files := make(map[string][]maildirFile)
+	err := walkMaildirs(outputDir, func(folder, sub, name, id string) {
+		if ids[id] {
+			files[id] = append(files[id], maildirFile{folder: folder, sub: sub, name: name})
+		}
+	})
+	return files, err
+}
+
+// maildirGmailFlags are the flags that follow Gmail labels; the others, such
+// as R (replied) and T (trashed), belong to the mail client or to sync
+const maildirGmailFlags = "DFS"
+
+// mergeMaildirFlags replaces the Gmail flags in flags with gmailFlags
+func mergeMaildirFlags(flags, gmailFlags string) string {
+	kept := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(maildirGmailFlags, r) {
+			return -1
+		}
+		return r
+	}, flags)
+	return sortMaildirFlags(kept + gmailFlags)
+}
+
+// sortMaildirFlags sorts flags and drops duplicates, as Maildir expects
+func sortMaildirFlags(flags string) string {
+	runes := []rune(flags)
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+	var b strings.Builder
+	for i, r := range runes {
+		if i == 0 || r != runes[i-1] {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// UpdateLabels moves saved emails into the Maildir++ folders of their new
+// labels and updates their flags. Flags a mail client set that Gmail does not
+// track, such as R (replied), are kept.
+func (w *MaildirWriter) UpdateLabels(ctx context.Context, emails []*interfaces.EmailMessage, outputDir string) error {
+	ids := make(map[string]bool)
+	for _, email := range emails {
+		ids[email.ID] = true
+	}
+	found, err := findMaildirFiles(outputDir, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, email := range emails {
+		files := found[email.ID]
+		if len(files) == 0 {
+			continue
+		}
+		folders := w.maildirFolders(email)
+		flags := mergeMaildirFlags(files[0].flags(), maildirFlags(email))
+		if err := w.redeliver(outputDir, files, folders, flags); err != nil {
+			return err
+		}
+		if w.index != nil && w.index.dir == outputDir {
+			if err := w.index.Add(email.ID, folders[0]); err != nil {
+				w.logger.Warn(fmt.Sprintf("Failed to index email %s: %v", email.ID, err))
+			}
+		}
+		w.logger.Info(fmt.Sprintf("Moved email %s to %s", email.ID, strings.Join(folders, ", ")))
+	}
+	return nil
+}
+
+// MarkDeleted adds the T (trashed) flag to every copy of saved emails that
+// were deleted in Gmail
+func (w *MaildirWriter) MarkDeleted(ctx context.Context, messageIDs []string, outputDir string) error {
+	ids := make(map[string]bool)
+	for _, id := range messageIDs {
+		ids[id] = true
+	}
+	found, err := findMaildirFiles(outputDir, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, files := range found {
+		for _, f := range files {
+			if strings.ContainsRune(f.flags(), 'T') {
+				continue
+			}
+			target := maildirFile{folder: f.folder, sub: "cur", name: f.uniqueName() + ":2," + sortMaildirFlags(f.flags()+"T")}
+			if err := os.Rename(f.path(outputDir), target.path(outputDir)); err != nil {
+				return fmt.Errorf("failed to flag maildir message: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// redeliver makes the copies of a message match the given folders and flags:
+// copies are renamed in folders that stay, added to new folders and removed
+// from folders the message left
+func (w *MaildirWriter) redeliver(outputDir string, files []maildirFile, folders []string, flags string) error {
+	uniqueName := files[0].uniqueName()
+	source := files[0].path(outputDir)
+
+	// Messages still unseen by any mail client stay in new/ while they have
+	// no flags to record
+	unseen := flags == ""
+	present := make(map[string]maildirFile)
+	for _, f := range files {
+		present[f.folder] = f
+		if f.sub != "new" {
+			unseen = false
+		}
+	}
+	wanted := make(map[string]bool)
+
+	for _, folder := range folders {
+		wanted[folder] = true
+		target := maildirFile{folder: folder, sub: "cur", name: uniqueName + ":2," + flags}
+		if unseen {
+			target = maildirFile{folder: folder, sub: "new", name: uniqueName}
+		}
+		targetPath := target.path(outputDir)
+
+		if f, ok := present[folder]; ok {
+			if f.path(outputDir) == targetPath {
+				continue
+			}
+			if err := os.Rename(f.path(outputDir), targetPath); err != nil {
+				return fmt.Errorf("failed to update maildir message: %v", err)
+			}
+			if f.path(outputDir) == source {
+				source = targetPath
+			}
+			continue
+		}
+
+		if err := w.createMaildir(outputDir, folder); err != nil {
+			return err
+		}
+		if err := os.Link(source, targetPath); err == nil {
+			continue
+		}
+		if err := copyMaildirMessage(source, filepath.Join(outputDir, folder, "tmp", uniqueName), targetPath); err != nil {
+			return err
+		}
+	}
+
+	for folder, f := range present {
+		if !wanted[folder] {
+			if err := os.Remove(f.path(outputDir)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove maildir message: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// copyMaildirMessage delivers a copy of a message through tmpPath
+func copyMaildirMessage(source, tmpPath, targetPath string) error {
+	data, err := os.ReadFile(source)
+	if err != nil {
+		return fmt.Errorf("failed to read maildir message: %v", err)
+	}
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write maildir message: %v", err)
+	}
+	if info, err := os.Stat(source); err == nil {
+		os.Chtimes(tmpPath, info.ModTime(), info.ModTime())
+	}
+	if err := os.Rename(tmpPath, targetPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to deliver maildir message: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package output
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+func TestMaildirDelivery(t *testing.T) {
+	tests := []struct {
+		name     string
+		labelIDs []string
+		labels   []string
+		want     []string // delivered files, relative to the output directory
+	}{
+		{
+			name:     "unread",
+			labelIDs: []string{"INBOX", "UNREAD"},
+			labels:   []string{"INBOX", "UNREAD"},
+			want:     []string{"new/<name>"},
+		},
+		{
+			name:     "read",
+			labelIDs: []string{"INBOX"},
+			labels:   []string{"INBOX"},
+			want:     []string{"cur/<name>:2,S"},
+		},
+		{
+			name:     "unread and starred",
+			labelIDs: []string{"INBOX", "UNREAD", "STARRED"},
+			labels:   []string{"INBOX", "UNREAD", "STARRED"},
+			want:     []string{"cur/<name>:2,F"},
+		},
+		{
+			name:     "several labels",
+			labelIDs: []string{"INBOX", "UNREAD", "Label_1"},
+			labels:   []string{"INBOX", "UNREAD", "Receipts/2024"},
+			want:     []string{"new/<name>", ".Receipts.2024/new/<name>"},
+		},
+		{
+			name:     "no folder label",
+			labelIDs: []string{"CATEGORY_UPDATES"},
+			labels:   []string{"CATEGORY_UPDATES"},
+			want:     []string{".Archive/cur/<name>:2,S"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writer, outputDir := newTestWriter(t, OutputMaildir, Options{})
+			email := rawTestEmail("18c2f0a1", test.labelIDs, test.labels)
+			if err := writer.WriteEmail(context.Background(), email, outputDir); err != nil {
+				t.Fatal(err)
+			}
+
+			var delivered []string
+			err := walkMaildirs(outputDir, func(folder, sub, name, id string) {
+				delivered = append(delivered, filepath.ToSlash(filepath.Join(folder, sub, name)))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(delivered) != len(test.want) {
+				t.Fatalf("delivered %v, want %v", delivered, test.want)
+			}
+			for i, path := range delivered {
+				name, _, _ := strings.Cut(filepath.Base(path), ":")
+				if want := strings.ReplaceAll(test.want[i], "<name>", name); path != want {
+					t.Errorf("delivered %s, want %s", path, want)
+				}
+				if data := readFile(t, filepath.Join(outputDir, path)); data != string(email.Raw) {
+					t.Errorf("%s holds %q, want the raw message", path, data)
+				}
+			}
+
+			// Nothing is left behind in tmp/
+			for _, folder := range []string{".", ".Receipts.2024", ".Archive"} {
+				if left, _ := os.ReadDir(filepath.Join(outputDir, folder, "tmp")); len(left) != 0 {
+					t.Errorf("%s/tmp still holds %d files", folder, len(left))
+				}
+			}
+		})
+	}
+}
+
+func TestMaildirRelabelKeepsNewMail(t *testing.T) {
+	writer, outputDir := newTestWriter(t, OutputMaildir, Options{})
+	ctx := context.Background()
+	email := rawTestEmail("18c2f0a1", []string{"INBOX", "UNREAD"}, []string{"INBOX", "UNREAD"})
+	if err := writer.WriteEmail(ctx, email, outputDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Still unread, filed under a label as well
+	relabeled := rawTestEmail("18c2f0a1", []string{"INBOX", "UNREAD", "Label_1"}, []string{"INBOX", "UNREAD", "Work"})
+	if err := writer.(interfaces.MailboxUpdater).UpdateLabels(ctx, []*interfaces.EmailMessage{relabeled}, outputDir); err != nil {
+		t.Fatal(err)
+	}
+	for _, folder := range []string{".", ".Work"} {
+		if files, _ := filepath.Glob(filepath.Join(outputDir, folder, "new", "*G18c2f0a1*")); len(files) != 1 {
+			t.Errorf("expected the message in %s/new, got %v", folder, files)
+		}
+		if files, _ := filepath.Glob(filepath.Join(outputDir, folder, "cur", "*")); len(files) != 0 {
+			t.Errorf("unseen message was moved to %s/cur: %v", folder, files)
+		}
+	}
+}
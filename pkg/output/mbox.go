@@ -0,0 +1,441 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+// mboxFileName is the archive file used when messages are not split by label
+const mboxFileName = "mailbox.mbox"
+
+// mboxArchiveFileName holds the emails without any folder label when
+// messages are split by label, like the Maildir .Archive folder
+const mboxArchiveFileName = "Archive.mbox"
+
+// mboxFromLineRe matches lines that would be read as a message separator and
+// therefore need one more ">" (mboxrd escaping)
+var mboxFromLineRe = regexp.MustCompile(`^>*From `)
+
+// MboxWriter appends each email to a single mbox file, or to one mbox file per
+// Gmail label, using the mboxrd format understood by Thunderbird, mutt and
+// most e-discovery tools
+type MboxWriter struct {
+	logger    interfaces.Logger
+	options   Options
+	sanitizer *Sanitizer
+	index     *messageIndex
+}
+
+func NewMboxWriter(logger interfaces.Logger, options Options) interfaces.OutputWriter {
+	return &MboxWriter{
+		logger:    logger,
+		options:   options,
+		sanitizer: mustSanitizer(options.FilenamePolicy),
+	}
+}
+
+func (w *MboxWriter) ValidateOutputDir(outputDir string) error {
+	return validateOutputDir(w.logger, outputDir)
+}
+
+// LoadIndex loads the message ID index of the output directory, rebuilding it
+// from the separator lines of existing mbox files if needed
+func (w *MboxWriter) LoadIndex(outputDir string) error {
+	idx, rebuilt, err := loadMessageIndex(outputDir, scanMboxFiles)
+	if err != nil {
+		return err
+	}
+	if rebuilt {
+		w.logger.Info(fmt.Sprintf("Rebuilt message index with %d emails", len(idx.folders)))
+	}
+	w.index = idx
+	return nil
+}
+
+func (w *MboxWriter) IsDownloaded(messageID string) bool {
+	if w.index == nil {
+		return false
+	}
+	_, ok := w.index.Lookup(messageID)
+	return ok
+}
+
+// GenerateFolderName returns the mbox file the email is appended to first
+func (w *MboxWriter) GenerateFolderName(email *interfaces.EmailMessage) string {
+	return w.mboxFiles(email)[0]
+}
+
+// CreateEmailFolder has nothing to create for mbox output, all emails share
+// the output directory
+func (w *MboxWriter) CreateEmailFolder(email *interfaces.EmailMessage, outputDir string) (string, error) {
+	return outputDir, nil
+}
+
+// mboxFiles returns the mbox files an email belongs in. Only folder labels
+// get a file of their own, see isFolderLabel; emails without one go to
+// mboxArchiveFileName.
+func (w *MboxWriter) mboxFiles(email *interfaces.EmailMessage) []string {
+	if !w.options.MboxPerLabel {
+		return []string{mboxFileName}
+	}
+
+	var files []string
+	seen := make(map[string]bool)
+	for i, labelID := range email.LabelIDs {
+		if !isFolderLabel(labelID) {
+			continue
+		}
+		name := labelID
+		if i < len(email.Labels) {
+			name = email.Labels[i]
+		}
+		// Nested labels become dotted names, e.g. Receipts/2024 -> Receipts.2024.mbox
+		name = w.sanitizer.Clean(strings.ReplaceAll(name, "/", "."))
+		if name == "" {
+			name = "label"
+		}
+		if !seen[name] {
+			seen[name] = true
+			files = append(files, name+".mbox")
+		}
+	}
+
+	if len(files) == 0 {
+		files = append(files, mboxArchiveFileName)
+	}
+	return files
+}
+
+func (w *MboxWriter) WriteEmail(ctx context.Context, email *interfaces.EmailMessage, outputDir string) error {
+	if len(email.Raw) == 0 {
+		return fmt.Errorf("email %s has no raw message to write to mbox", email.ID)
+	}
+
+	entry := formatMboxEntry(w.logger, email)
+
+	files := w.mboxFiles(email)
+	for _, name := range files {
+		if err := appendMbox(filepath.Join(outputDir, name), entry); err != nil {
+			return err
+		}
+	}
+
+	if w.index != nil && w.index.dir == outputDir {
+		if err := w.index.Add(email.ID, files[0]); err != nil {
+			w.logger.Warn(fmt.Sprintf("Failed to index email %s: %v", email.ID, err))
+		}
+	}
+
+	w.logger.Info(fmt.Sprintf("Appended email %s to %s", email.ID, strings.Join(files, ", ")))
+	return nil
+}
+
+// appendMbox appends an entry to an mbox file, creating the file if needed
+func appendMbox(mboxPath string, entry []byte) error {
+	f, err := os.OpenFile(mboxPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open mbox file: %v", err)
+	}
+	_, err = f.Write(entry)
+	closeErr := f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to append to mbox file: %v", err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to close mbox file: %v", closeErr)
+	}
+	return nil
+}
+
+// formatMboxEntry renders one mboxrd entry: the separator line carrying the
+// Gmail message ID, an X-Gmail-Labels header like Google Takeout writes, and
+// the escaped message with LF line endings
+func formatMboxEntry(logger interfaces.Logger, email *interfaces.EmailMessage) []byte {
+	var b bytes.Buffer
+
+	date := parseEmailDate(logger, email.Date).UTC()
+	fmt.Fprintf(&b, "From %s@getgmail %s\n", email.ID, date.Format("Mon Jan _2 15:04:05 2006"))
+
+	if len(email.Labels) > 0 {
+		fmt.Fprintf(&b, "X-Gmail-Labels: %s\n", strings.Join(email.Labels, ","))
+	}
+
+	raw := bytes.ReplaceAll(email.Raw, []byte("\r\n"), []byte("\n"))
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 64*1024), len(raw)+1)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if mboxFromLineRe.Match(line) {
+			b.WriteByte('>')
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+
+	// Messages are separated by an empty line
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// mboxSeparatorID returns the Gmail message ID of an mbox separator line
+// written by MboxWriter, or "" for any other line
+func mboxSeparatorID(line string) string {
+	sender, ok := strings.CutPrefix(line, "From ")
+	fields := strings.Fields(sender)
+	if !ok || len(fields) == 0 {
+		return ""
+	}
+	id, ok := strings.CutSuffix(fields[0], "@getgmail")
+	if !ok {
+		return ""
+	}
+	return id
+}
+
+// mboxFileIDs returns the message IDs in the separator lines of an mbox file
+// in file order
+func mboxFileIDs(mboxPath string) ([]string, error) {
+	f, err := os.Open(mboxPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ids []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if id := mboxSeparatorID(scanner.Text()); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids, scanner.Err()
+}
+
+// scanMboxFiles maps the message IDs in the separator lines of every mbox
+// file in the output directory to that file
+func scanMboxFiles(outputDir string) (map[string]string, error) {
+	matches, err := filepath.Glob(filepath.Join(outputDir, "*.mbox"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan mbox files: %v", err)
+	}
+
+	files := make(map[string]string)
+	for _, mboxPath := range matches {
+		ids, _ := mboxFileIDs(mboxPath)
+		for _, id := range ids {
+			if _, seen := files[id]; !seen {
+				files[id] = filepath.Base(mboxPath)
+			}
+		}
+	}
+	return files, nil
+}
+
+// mboxEntry is one message of an mbox file with the headers MboxWriter adds
+// in front of the message split off
+type mboxEntry struct {
+	separator string // the From line
+	labels    string // X-Gmail-Labels value, "" for none
+	deleted   bool   // X-Status: D, the mutt and c-client deleted flag
+	message   []byte // the escaped message and the empty line ending it
+}
+
+func (e *mboxEntry) bytes() []byte {
+	var b bytes.Buffer
+	b.WriteString(e.separator)
+	if e.deleted {
+		b.WriteString("X-Status: D\n")
+	}
+	if e.labels != "" {
+		fmt.Fprintf(&b, "X-Gmail-Labels: %s\n", e.labels)
+	}
+	b.Write(e.message)
+	return b.Bytes()
+}
+
+// rewriteMboxFile passes the entries of the given messages through update
+// and replaces the file with the result. Entries for which update returns
+// false are dropped; all other content is copied unchanged.
+func rewriteMboxFile(mboxPath string, ids map[string]bool, update func(id string, entry *mboxEntry) bool) error {
+	in, err := os.Open(mboxPath)
+	if err != nil {
+		return fmt.Errorf("failed to open mbox file: %v", err)
+	}
+	defer in.Close()
+
+	tmpPath := mboxPath + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite mbox file: %v", err)
+	}
+	defer os.Remove(tmpPath)
+	writer := bufio.NewWriter(out)
+
+	var entry *mboxEntry
+	var entryID string
+	inHeaders := false
+	flush := func() {
+		if entry != nil && update(entryID, entry) {
+			writer.Write(entry.bytes())
+		}
+		entry = nil
+	}
+
+	reader := bufio.NewReader(in)
+	for {
+		line, readErr := reader.ReadString('\n')
+		if line != "" {
+			// Escaping guarantees that only separators start with "From "
+			if strings.HasPrefix(line, "From ") {
+				flush()
+				if id := mboxSeparatorID(line); ids[id] {
+					entry = &mboxEntry{separator: line}
+					entryID = id
+					inHeaders = true
+					continue
+				}
+			}
+			switch {
+			case entry == nil:
+				writer.WriteString(line)
+			case inHeaders && strings.HasPrefix(line, "X-Gmail-Labels: "):
+				entry.labels = strings.TrimSpace(strings.TrimPrefix(line, "X-Gmail-Labels: "))
+			case inHeaders && strings.TrimSpace(line) == "X-Status: D":
+				entry.deleted = true
+			default:
+				inHeaders = false
+				entry.message = append(entry.message, line...)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			out.Close()
+			return fmt.Errorf("failed to read mbox file: %v", readErr)
+		}
+	}
+	flush()
+
+	if err := writer.Flush(); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to rewrite mbox file: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to rewrite mbox file: %v", err)
+	}
+	if err := os.Rename(tmpPath, mboxPath); err != nil {
+		return fmt.Errorf("failed to rewrite mbox file: %v", err)
+	}
+	return nil
+}
+
+// rewriteMboxFiles runs rewriteMboxFile on every mbox file of the output
+// directory holding any of the given messages
+func rewriteMboxFiles(outputDir string, ids map[string]bool, update func(file, id string, entry *mboxEntry) bool) error {
+	matches, err := filepath.Glob(filepath.Join(outputDir, "*.mbox"))
+	if err != nil {
+		return fmt.Errorf("failed to scan mbox files: %v", err)
+	}
+	for _, mboxPath := range matches {
+		fileIDs, err := mboxFileIDs(mboxPath)
+		if err != nil {
+			return fmt.Errorf("failed to scan mbox file: %v", err)
+		}
+		affected := false
+		for _, id := range fileIDs {
+			affected = affected || ids[id]
+		}
+		if !affected {
+			continue
+		}
+
+		file := filepath.Base(mboxPath)
+		err = rewriteMboxFile(mboxPath, ids, func(id string, entry *mboxEntry) bool {
+			return update(file, id, entry)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateLabels rewrites the X-Gmail-Labels header of saved emails. With
+// MboxPerLabel the emails also move between the label mbox files.
+func (w *MboxWriter) UpdateLabels(ctx context.Context, emails []*interfaces.EmailMessage, outputDir string) error {
+	byID := make(map[string]*interfaces.EmailMessage)
+	ids := make(map[string]bool)
+	for _, email := range emails {
+		byID[email.ID] = email
+		ids[email.ID] = true
+	}
+
+	// The updated entry of each email and the files that still hold it
+	entries := make(map[string]*mboxEntry)
+	kept := make(map[string]map[string]bool)
+	err := rewriteMboxFiles(outputDir, ids, func(file, id string, entry *mboxEntry) bool {
+		email := byID[id]
+		entry.labels = strings.Join(email.Labels, ",")
+		if entries[id] == nil {
+			entries[id] = entry
+			kept[id] = make(map[string]bool)
+		}
+		if w.options.MboxPerLabel && !slices.Contains(w.mboxFiles(email), file) {
+			return false
+		}
+		kept[id][file] = true
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, email := range emails {
+		entry := entries[email.ID]
+		if entry == nil {
+			continue
+		}
+		files := w.mboxFiles(email)
+		if w.options.MboxPerLabel {
+			for _, name := range files {
+				if !kept[email.ID][name] {
+					if err := appendMbox(filepath.Join(outputDir, name), entry.bytes()); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if w.index != nil && w.index.dir == outputDir {
+			if err := w.index.Add(email.ID, files[0]); err != nil {
+				w.logger.Warn(fmt.Sprintf("Failed to index email %s: %v", email.ID, err))
+			}
+		}
+		w.logger.Info(fmt.Sprintf("Updated the labels of email %s", email.ID))
+	}
+	return nil
+}
+
+// MarkDeleted adds an X-Status: D header to saved emails deleted in Gmail,
+// which mutt and c-client based tools read as the deleted flag
+func (w *MboxWriter) MarkDeleted(ctx context.Context, messageIDs []string, outputDir string) error {
+	ids := make(map[string]bool)
+	for _, id := range messageIDs {
+		ids[id] = true
+	}
+	return rewriteMboxFiles(outputDir, ids, func(file, id string, entry *mboxEntry) bool {
+		entry.deleted = true
+		return true
+	})
+}
@@ -0,0 +1,93 @@
+package output
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+func TestMboxFilesPerLabel(t *testing.T) {
+	w := NewMboxWriter(&testLogger{}, Options{MboxPerLabel: true}).(*MboxWriter)
+
+	tests := []struct {
+		name     string
+		labelIDs []string
+		labels   []string
+		want     []string
+	}{
+		{
+			name:     "system and user labels",
+			labelIDs: []string{"INBOX", "UNREAD", "Label_1", "IMPORTANT"},
+			labels:   []string{"INBOX", "UNREAD", "Receipts/2024", "IMPORTANT"},
+			want:     []string{"INBOX.mbox", "Receipts.2024.mbox"},
+		},
+		{
+			name:     "categories and flags only",
+			labelIDs: []string{"CATEGORY_UPDATES", "STARRED", "UNREAD"},
+			labels:   []string{"CATEGORY_UPDATES", "STARRED", "UNREAD"},
+			want:     []string{mboxArchiveFileName},
+		},
+		{
+			name:     "sent and trash",
+			labelIDs: []string{"SENT", "TRASH"},
+			labels:   []string{"SENT", "TRASH"},
+			want:     []string{"SENT.mbox", "TRASH.mbox"},
+		},
+		{name: "no labels", want: []string{mboxArchiveFileName}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			email := &interfaces.EmailMessage{LabelIDs: test.labelIDs, Labels: test.labels}
+			if got := w.mboxFiles(email); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("mboxFiles = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	single := NewMboxWriter(&testLogger{}, Options{}).(*MboxWriter)
+	email := &interfaces.EmailMessage{LabelIDs: []string{"INBOX", "Label_1"}, Labels: []string{"INBOX", "Work"}}
+	if got := single.mboxFiles(email); !reflect.DeepEqual(got, []string{mboxFileName}) {
+		t.Errorf("mboxFiles without --mbox-per-label = %v, want %v", got, []string{mboxFileName})
+	}
+}
+
+func TestFormatMboxEntry(t *testing.T) {
+	const separator = "From 18c2f0a1@getgmail Thu Aug  1 04:39:03 2024\n"
+	tests := []struct {
+		name   string
+		labels []string
+		raw    string
+		want   string
+	}{
+		{
+			name:   "CRLF line endings",
+			labels: []string{"INBOX", "Work"},
+			raw:    "Subject: Hi\r\n\r\nBody\r\n",
+			want:   separator + "X-Gmail-Labels: INBOX,Work\nSubject: Hi\n\nBody\n\n",
+		},
+		{
+			name: "From lines are quoted",
+			raw:  "Subject: Hi\n\nFrom here on\n>From quoted before\n>>From twice\n From indented\nFrom\n",
+			want: separator + "Subject: Hi\n\n>From here on\n>>From quoted before\n>>>From twice\n From indented\nFrom\n\n",
+		},
+		{
+			name: "last line without newline",
+			raw:  "Subject: Hi\n\nFrom the end",
+			want: separator + "Subject: Hi\n\n>From the end\n\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			email := &interfaces.EmailMessage{
+				ID:     "18c2f0a1",
+				Date:   "Thu, 1 Aug 2024 06:39:03 +0200",
+				Labels: test.labels,
+				Raw:    []byte(test.raw),
+			}
+			if got := string(formatMboxEntry(&testLogger{}, email)); got != test.want {
+				t.Errorf("formatMboxEntry = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
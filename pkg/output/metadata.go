@@ -0,0 +1,183 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+// Metadata is the structure of the {prefix}_metadata.json file written next
+// to each email, meant to be consumed by scripts without parsing the text file
+type Metadata struct {
+	ID           string               `json:"id"`
+	ThreadID     string               `json:"threadId"`
+	LabelIDs     []string             `json:"labelIds"`
+	Labels       []string             `json:"labels"`
+	Snippet      string               `json:"snippet"`
+	InternalDate int64                `json:"internalDate"`
+	SizeEstimate int64                `json:"sizeEstimate"`
+	Subject      string               `json:"subject"`
+	From         string               `json:"from"`
+	To           string               `json:"to"`
+	Date         string               `json:"date"`
+	BodyMimeType string               `json:"bodyMimeType"`
+	BodyCharset  string               `json:"bodyCharset"`
+	BodyParts    []MetadataBodyPart   `json:"bodyParts"`
+	Headers      []MetadataHeader     `json:"headers"`
+	Attachments  []MetadataAttachment `json:"attachments"`
+
+	SkippedAttachments []MetadataSkippedAttachment `json:"skippedAttachments"`
+	RemoteImages       []MetadataRemoteImage       `json:"remoteImages,omitempty"`
+
+	// DeletedAt is set by sync when the email was found deleted in Gmail
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+// MetadataHeader is one header in message order
+type MetadataHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// MetadataBodyPart describes one text alternative of the body and the
+// charset it was sent in before being converted to UTF-8
+type MetadataBodyPart struct {
+	MimeType string `json:"mimeType"`
+	Charset  string `json:"charset"`
+	Size     int    `json:"size"`
+}
+
+// MetadataAttachment describes one attachment and the file it was saved to.
+// With an attachment store, Store is the stored file relative to the output
+// directory, and Filename is empty when the email folder only references it.
+type MetadataAttachment struct {
+	Filename         string `json:"filename,omitempty"`
+	OriginalFilename string `json:"originalFilename"`
+	MimeType         string `json:"mimeType"`
+	Size             int64  `json:"size"`
+	SHA256           string `json:"sha256"`
+	Store            string `json:"store,omitempty"`
+}
+
+// MetadataRemoteImage is a remote image of the body that was downloaded into
+// the email folder by the HTML sanitizer
+type MetadataRemoteImage struct {
+	URL      string `json:"url"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+}
+
+// MetadataSkippedAttachment describes an attachment that was not saved
+type MetadataSkippedAttachment struct {
+	OriginalFilename string `json:"originalFilename"`
+	MimeType         string `json:"mimeType"`
+	Size             int64  `json:"size"`
+	Reason           string `json:"reason"`
+}
+
+// newMetadata builds the JSON metadata of an email. Attachments are added by
+// the writer as they are saved.
+func newMetadata(email *interfaces.EmailMessage) *Metadata {
+	m := &Metadata{
+		ID:           email.ID,
+		ThreadID:     email.ThreadID,
+		LabelIDs:     email.LabelIDs,
+		Labels:       email.Labels,
+		Snippet:      email.Snippet,
+		InternalDate: email.InternalDate,
+		SizeEstimate: email.SizeEstimate,
+		Subject:      email.Subject,
+		From:         email.From,
+		To:           email.To,
+		Date:         email.Date,
+		BodyMimeType: email.BodyMimeType,
+		BodyCharset:  bodyCharset(email),
+		BodyParts:    make([]MetadataBodyPart, 0, len(email.BodyParts)),
+		Headers:      make([]MetadataHeader, 0, len(email.HeaderList)),
+		Attachments:  []MetadataAttachment{},
+
+		SkippedAttachments: []MetadataSkippedAttachment{},
+	}
+	for _, part := range email.BodyParts {
+		m.BodyParts = append(m.BodyParts, MetadataBodyPart{
+			MimeType: part.MimeType,
+			Charset:  part.Charset,
+			Size:     len(part.Content),
+		})
+	}
+	for _, h := range email.HeaderList {
+		m.Headers = append(m.Headers, MetadataHeader{Name: h.Name, Value: h.Value})
+	}
+	return m
+}
+
+// bodyCharset returns the original charset of the part the HTML body was
+// built from, preferring the HTML alternative like the body extraction does
+func bodyCharset(email *interfaces.EmailMessage) string {
+	for _, mimeType := range []string{"text/html", "text/plain"} {
+		for _, part := range email.BodyParts {
+			if part.MimeType == mimeType {
+				return part.Charset
+			}
+		}
+	}
+	return ""
+}
+
+// addAttachment records a saved attachment with the SHA-256 of its content
+// and its attachment store file, if any
+func (m *Metadata) addAttachment(attachment interfaces.Attachment, savedName, storeFile string) {
+	m.Attachments = append(m.Attachments, MetadataAttachment{
+		Filename:         savedName,
+		OriginalFilename: attachment.Filename,
+		MimeType:         attachment.MimeType,
+		Size:             attachment.Size,
+		SHA256:           attachment.SHA256,
+		Store:            filepath.ToSlash(storeFile),
+	})
+}
+
+// addSkippedAttachment records an attachment that was not saved and why
+func (m *Metadata) addSkippedAttachment(attachment interfaces.Attachment) {
+	m.SkippedAttachments = append(m.SkippedAttachments, MetadataSkippedAttachment{
+		OriginalFilename: attachment.Filename,
+		MimeType:         attachment.MimeType,
+		Size:             attachment.Size,
+		Reason:           attachment.SkipReason,
+	})
+}
+
+// write saves the metadata, replacing the file atomically so that updating
+// the metadata of a saved email never leaves a truncated file behind
+func (m *Metadata) write(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %v", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write metadata: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write metadata: %v", err)
+	}
+	return nil
+}
+
+// ReadMetadata loads a {prefix}_metadata.json file
+func ReadMetadata(path string) (*Metadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %v", err)
+	}
+	var m Metadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata %s: %v", path, err)
+	}
+	return &m, nil
+}
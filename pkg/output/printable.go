@@ -0,0 +1,248 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+// File name suffixes of the printable page and its PDF, after the file prefix
+const (
+	PrintHTMLSuffix = "_print.html"
+	PrintPDFSuffix  = ".pdf"
+)
+
+// PrintData is the value a print template is rendered against
+type PrintData struct {
+	ID      string
+	Subject string
+	From    string
+	To      string
+	Cc      string
+	Date    string
+	Labels  []string
+
+	Attachments        []PrintAttachment
+	SkippedAttachments []PrintAttachment
+
+	// Styles holds the <style> elements of the email's own HTML head and
+	// Body the content of its <body>, so they can be placed in the page
+	Styles template.HTML
+	Body   template.HTML
+
+	// ContentSecurityPolicy is the policy sanitized bodies get, for a
+	// Content-Security-Policy <meta> element
+	ContentSecurityPolicy string
+}
+
+// PrintAttachment is one attachment listed on the printable page. Link is
+// relative to the email folder and empty for skipped attachments.
+type PrintAttachment struct {
+	Name     string
+	Link     string
+	MimeType string
+	Size     int64
+	Reason   string
+}
+
+// DefaultPrintTemplate renders an A4/Letter friendly page with a header
+// table, the attachment list and the body
+const DefaultPrintTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="Content-Security-Policy" content="{{.ContentSecurityPolicy}}">
+<title>{{.Subject}}</title>
+<style>
+@page { margin: 15mm; }
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; color: #222; margin: 0; }
+.getgmail-header { border-collapse: collapse; width: 100%; margin-bottom: 12px; font-size: 13px; }
+.getgmail-header th { text-align: left; vertical-align: top; width: 90px; padding: 3px 8px 3px 0; color: #555; }
+.getgmail-header td { padding: 3px 0; word-break: break-word; }
+.getgmail-subject { font-size: 18px; font-weight: bold; }
+.getgmail-attachments { font-size: 13px; margin: 0 0 12px 0; padding: 8px 12px; background: #f6f6f6; border: 1px solid #ddd; }
+.getgmail-attachments ul { margin: 4px 0 0 0; padding-left: 20px; }
+.getgmail-body { border-top: 2px solid #222; padding-top: 12px; }
+</style>
+{{.Styles}}
+</head>
+<body>
+<table class="getgmail-header">
+<tr><th>Subject</th><td class="getgmail-subject">{{.Subject}}</td></tr>
+<tr><th>From</th><td>{{.From}}</td></tr>
+<tr><th>To</th><td>{{.To}}</td></tr>
+{{if .Cc}}<tr><th>Cc</th><td>{{.Cc}}</td></tr>
+{{end}}<tr><th>Date</th><td>{{.Date}}</td></tr>
+</table>
+{{if or .Attachments .SkippedAttachments}}<div class="getgmail-attachments">
+<strong>Attachments</strong>
+<ul>
+{{range .Attachments}}<li><a href="{{.Link}}">{{.Name}}</a> ({{.MimeType}}, {{.Size}} bytes)</li>
+{{end}}{{range .SkippedAttachments}}<li>{{.Name}} ({{.MimeType}}, {{.Size}} bytes) - not saved: {{.Reason}}</li>
+{{end}}</ul>
+</div>
+{{end}}<div class="getgmail-body">
+{{.Body}}
+</div>
+</body>
+</html>
+`
+
+// NewPrintTemplate parses a print template and checks that it renders
+// against a sample email. Empty text means DefaultPrintTemplate.
+func NewPrintTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultPrintTemplate
+	}
+	tmpl, err := template.New("print").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid print template: %v", err)
+	}
+
+	sample := PrintData{
+		ID:          "18c2f0a1b2c3d4e5",
+		Subject:     "Print check",
+		From:        "Sender <sender@example.com>",
+		Date:        "Thu, 1 Aug 2024 04:39:03 +0000",
+		Attachments: []PrintAttachment{{Name: "invoice.pdf", Link: "invoice.pdf", MimeType: "application/pdf", Size: 1}},
+
+		ContentSecurityPolicy: contentSecurityPolicy,
+	}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, fmt.Errorf("invalid print template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// mustPrintTemplate returns the print template for text, falling back to
+// DefaultPrintTemplate for invalid ones. Templates are validated by NewWriter.
+func mustPrintTemplate(text string) *template.Template {
+	tmpl, err := NewPrintTemplate(text)
+	if err != nil {
+		tmpl, _ = NewPrintTemplate("")
+	}
+	return tmpl
+}
+
+// printsEmails reports whether printable pages are written
+func (w *FileWriter) printsEmails() bool {
+	return w.options.Print || w.options.PrintTemplate != "" || w.options.PDFRenderer != nil
+}
+
+// writePrintable writes the printable page of an email, and converts it to
+// PDF when a renderer is configured. body is the HTML body as saved.
+// A failed PDF conversion is logged but does not fail the email.
+func (w *FileWriter) writePrintable(ctx context.Context, email *interfaces.EmailMessage, metadata *Metadata, body, outputDir, folderPath, filePrefix string) error {
+	data := PrintData{
+		ID:      email.ID,
+		Subject: email.Subject,
+		From:    email.From,
+		To:      email.To,
+		Cc:      headerValue(email, "Cc"),
+		Date:    email.Date,
+		Labels:  email.Labels,
+
+		ContentSecurityPolicy: contentSecurityPolicy,
+	}
+	if data.Subject == "" {
+		data.Subject = "(no subject)"
+	}
+
+	for _, attachment := range metadata.Attachments {
+		link := attachment.Filename
+		if link == "" {
+			// Only referenced from the attachment store
+			rel, err := filepath.Rel(folderPath, filepath.Join(outputDir, filepath.FromSlash(attachment.Store)))
+			if err == nil {
+				link = rel
+			}
+		}
+		data.Attachments = append(data.Attachments, PrintAttachment{
+			Name:     attachment.OriginalFilename,
+			Link:     relativeURL(link),
+			MimeType: attachment.MimeType,
+			Size:     attachment.Size,
+		})
+	}
+	for _, attachment := range metadata.SkippedAttachments {
+		data.SkippedAttachments = append(data.SkippedAttachments, PrintAttachment{
+			Name:     attachment.OriginalFilename,
+			MimeType: attachment.MimeType,
+			Size:     attachment.Size,
+			Reason:   attachment.Reason,
+		})
+	}
+	// The page may be opened by the PDF renderer, so active content and
+	// remote resources are stripped even when saved bodies are not sanitized
+	body, _, err := w.sanitizeBody(ctx, body, HTMLSanitizeBlock, folderPath, filePrefix)
+	if err != nil {
+		return err
+	}
+	data.Styles, data.Body = splitHTMLBody(body)
+
+	printPath := filepath.Join(folderPath, filePrefix+PrintHTMLSuffix)
+	f, err := os.Create(printPath)
+	if err != nil {
+		return fmt.Errorf("failed to write printable page: %v", err)
+	}
+	if err := w.printTemplate.Execute(f, data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to render printable page: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write printable page: %v", err)
+	}
+
+	if w.options.PDFRenderer != nil {
+		pdfPath := filepath.Join(folderPath, filePrefix+PrintPDFSuffix)
+		if err := w.options.PDFRenderer.RenderPDF(ctx, printPath, pdfPath); err != nil {
+			w.logger.Warn(fmt.Sprintf("Failed to render PDF for email %s: %v", email.ID, err))
+		} else {
+			w.logger.Info(fmt.Sprintf("Wrote PDF: %s", filepath.Base(pdfPath)))
+		}
+	}
+	return nil
+}
+
+// splitHTMLBody returns the <style> elements and the <body> content of an
+// HTML document, for placing an email body inside another page
+func splitHTMLBody(body string) (template.HTML, template.HTML) {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return "", template.HTML(template.HTMLEscapeString(body))
+	}
+
+	var styles, content strings.Builder
+	if head := findElement(doc, atom.Head); head != nil {
+		for c := head.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode && c.DataAtom == atom.Style {
+				html.Render(&styles, c)
+			}
+		}
+	}
+	if bodyNode := findElement(doc, atom.Body); bodyNode != nil {
+		for c := bodyNode.FirstChild; c != nil; c = c.NextSibling {
+			html.Render(&content, c)
+		}
+	}
+	return template.HTML(styles.String()), template.HTML(content.String())
+}
+
+// headerValue returns the first value of a header, matched case-insensitively
+func headerValue(email *interfaces.EmailMessage, name string) string {
+	for _, header := range email.HeaderList {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
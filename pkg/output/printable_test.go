@@ -0,0 +1,161 @@
+package output
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+// testLogger records warnings and errors
+type testLogger struct {
+	mu       sync.Mutex
+	warnings []string
+}
+
+func (l *testLogger) Info(message string)  {}
+func (l *testLogger) Debug(message string) {}
+func (l *testLogger) Error(message string) { l.Warn(message) }
+func (l *testLogger) Warn(message string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warnings = append(l.warnings, message)
+}
+
+// fakeRenderer writes a stand-in PDF, or fails with err
+type fakeRenderer struct {
+	err   error
+	pages []string
+}
+
+func (r *fakeRenderer) RenderPDF(ctx context.Context, htmlPath, pdfPath string) error {
+	r.pages = append(r.pages, htmlPath)
+	if r.err != nil {
+		return r.err
+	}
+	return os.WriteFile(pdfPath, []byte("%PDF-1.4"), 0644)
+}
+
+func printTestEmail() *interfaces.EmailMessage {
+	return &interfaces.EmailMessage{
+		ID:           "18c2f0a1b2c3d4e5",
+		Subject:      "Invoice 42",
+		From:         "Billing <billing@example.com>",
+		To:           "me@example.com",
+		Date:         "Thu, 1 Aug 2024 04:39:03 +0000",
+		Body:         `<html><head><style>p { color: red; }</style></head><body><p onclick="steal()">Amount due</p><script>steal()</script></body></html>`,
+		BodyMimeType: "text/html",
+		HeaderList:   []interfaces.Header{{Name: "Cc", Value: "accounts@example.com"}},
+		Attachments: []interfaces.Attachment{
+			{
+				Filename: "invoice.pdf",
+				MimeType: "application/pdf",
+				Fetch: func(ctx context.Context, w io.Writer) (int64, error) {
+					n, err := io.WriteString(w, "%PDF-1.4 invoice")
+					return int64(n), err
+				},
+			},
+			{Filename: "scan.tiff", MimeType: "image/tiff", Size: 1 << 30, SkipReason: "larger than 10MB"},
+		},
+	}
+}
+
+// writePrintTest writes the test email and returns the email folder
+func writePrintTest(t *testing.T, renderer *fakeRenderer, log *testLogger) string {
+	t.Helper()
+	outputDir := t.TempDir()
+	writer, err := NewWriter(log, OutputFiles, Options{PDFRenderer: renderer})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if err := writer.WriteEmail(context.Background(), printTestEmail(), outputDir); err != nil {
+		t.Fatalf("WriteEmail: %v", err)
+	}
+
+	folders, err := filepath.Glob(filepath.Join(outputDir, "2024-*"))
+	if err != nil || len(folders) != 1 {
+		t.Fatalf("expected one email folder, got %v (%v)", folders, err)
+	}
+	return folders[0]
+}
+
+func readPrintPage(t *testing.T, folder string) string {
+	t.Helper()
+	pages, _ := filepath.Glob(filepath.Join(folder, "*"+PrintHTMLSuffix))
+	if len(pages) != 1 {
+		t.Fatalf("expected one printable page, got %v", pages)
+	}
+	data, err := os.ReadFile(pages[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestWritePrintable(t *testing.T) {
+	renderer := &fakeRenderer{}
+	log := &testLogger{}
+	folder := writePrintTest(t, renderer, log)
+	page := readPrintPage(t, folder)
+
+	for _, want := range []string{
+		`<table class="getgmail-header">`,
+		`<td class="getgmail-subject">Invoice 42</td>`,
+		`<td>Billing &lt;billing@example.com&gt;</td>`,
+		`<td>accounts@example.com</td>`,
+		`invoice.pdf</a> (application/pdf, 16 bytes)`,
+		`scan.tiff (image/tiff, 1073741824 bytes) - not saved: larger than 10MB`,
+		`p { color: red; }`,
+		`Amount due`,
+		`Content-Security-Policy`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("printable page lacks %q", want)
+		}
+	}
+	for _, unwanted := range []string{"<script", "onclick", "steal()"} {
+		if strings.Contains(page, unwanted) {
+			t.Errorf("printable page contains %q", unwanted)
+		}
+	}
+
+	if len(renderer.pages) != 1 || !strings.HasSuffix(renderer.pages[0], PrintHTMLSuffix) {
+		t.Errorf("renderer got pages %v, want the printable page", renderer.pages)
+	}
+	pdfs, _ := filepath.Glob(filepath.Join(folder, "*"+PrintPDFSuffix))
+	if len(pdfs) != 2 {
+		// The attachment invoice.pdf and the rendered page
+		t.Errorf("expected the attachment and the rendered PDF, got %v", pdfs)
+	}
+	if len(log.warnings) != 1 {
+		// Only the skipped attachment
+		t.Errorf("unexpected warnings: %v", log.warnings)
+	}
+}
+
+func TestWritePrintableRendererError(t *testing.T) {
+	renderer := &fakeRenderer{err: errors.New("chrome crashed")}
+	log := &testLogger{}
+	folder := writePrintTest(t, renderer, log)
+
+	readPrintPage(t, folder)
+	if matches, _ := filepath.Glob(filepath.Join(folder, "*_metadata.json")); len(matches) != 1 {
+		t.Errorf("email was not completed after the renderer failed")
+	}
+
+	logged := false
+	for _, warning := range log.warnings {
+		if strings.Contains(warning, "chrome crashed") {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Errorf("renderer error was not logged, warnings: %v", log.warnings)
+	}
+}
@@ -0,0 +1,164 @@
+package output
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Filename sanitization policies
+const (
+	// FilenamesUnicode keeps letters, digits and symbols of every script
+	FilenamesUnicode = "unicode"
+	// FilenamesASCII transliterates to ASCII, e.g. å -> a, ß -> ss
+	FilenamesASCII = "ascii"
+	// FilenamesWindows is FilenamesUnicode plus Windows restrictions on
+	// reserved device names and trailing dots
+	FilenamesWindows = "windows"
+)
+
+// maxFilenameBytes is the name length limit of common filesystems (ext4,
+// APFS, NTFS in UTF-16 units is more lenient)
+const maxFilenameBytes = 255
+
+var (
+	whitespaceRe = regexp.MustCompile(`\s+`)
+	dashesRe     = regexp.MustCompile(`-+`)
+
+	// windowsReservedRe matches device names Windows refuses as file names,
+	// with or without an extension
+	windowsReservedRe = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[0-9]|lpt[0-9])(\..*)?$`)
+
+	// asciiReplacements covers letters that do not decompose into an ASCII
+	// base letter plus combining marks
+	asciiReplacements = strings.NewReplacer(
+		"ß", "ss", "æ", "ae", "Æ", "AE", "ø", "o", "Ø", "O", "œ", "oe", "Œ", "OE",
+		"ł", "l", "Ł", "L", "đ", "d", "Đ", "D", "ð", "d", "Ð", "D", "þ", "th", "Þ", "TH",
+		"ı", "i", "ŋ", "ng", "Ŋ", "NG",
+	)
+)
+
+// Sanitizer turns subjects, label names and attachment names into safe file
+// names according to a policy
+type Sanitizer struct {
+	policy string
+}
+
+// NewSanitizer creates a sanitizer for one of the Filenames* policies
+func NewSanitizer(policy string) (*Sanitizer, error) {
+	switch policy {
+	case "":
+		policy = FilenamesUnicode
+	case FilenamesUnicode, FilenamesASCII, FilenamesWindows:
+	default:
+		return nil, fmt.Errorf("invalid filename policy %q, expected %s, %s or %s", policy, FilenamesUnicode, FilenamesASCII, FilenamesWindows)
+	}
+	return &Sanitizer{policy: policy}, nil
+}
+
+// mustSanitizer returns the sanitizer for a policy, falling back to the
+// Unicode policy for unknown values. Policies are validated by NewWriter.
+func mustSanitizer(policy string) *Sanitizer {
+	s, err := NewSanitizer(policy)
+	if err != nil {
+		s, _ = NewSanitizer(FilenamesUnicode)
+	}
+	return s
+}
+
+// Clean removes characters that are unsafe in file names, replaces runs of
+// whitespace with a single dash and keeps dots for extensions
+func (s *Sanitizer) Clean(name string) string {
+	name = norm.NFC.String(name)
+	if s.policy == FilenamesASCII {
+		name = transliterate(name)
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		if s.allowed(r) {
+			b.WriteRune(r)
+		}
+	}
+
+	// Replace spaces and multiple dashes with single dash
+	cleaned := whitespaceRe.ReplaceAllString(b.String(), "-")
+	cleaned = dashesRe.ReplaceAllString(cleaned, "-")
+
+	// Trim dashes from start and end
+	cleaned = strings.Trim(cleaned, "-")
+
+	if s.policy == FilenamesWindows {
+		// Windows drops trailing dots and spaces and refuses device names
+		cleaned = strings.TrimRight(cleaned, ". ")
+		if windowsReservedRe.MatchString(cleaned) {
+			cleaned = "_" + cleaned
+		}
+	}
+
+	return cleaned
+}
+
+// allowed reports whether a rune may appear in a file name
+func (s *Sanitizer) allowed(r rune) bool {
+	switch {
+	case r == '.' || r == '-' || r == '_':
+		return true
+	case unicode.IsSpace(r):
+		return true
+	case r < utf8.RuneSelf:
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	case s.policy == FilenamesASCII:
+		return false
+	}
+	// Letters, digits and combining marks of any script plus symbols like
+	// emoji; punctuation and control characters are dropped
+	return unicode.In(r, unicode.L, unicode.M, unicode.N, unicode.So) && unicode.IsPrint(r)
+}
+
+// transliterate maps text to ASCII by decomposing accented letters and
+// dropping the combining marks (å -> a) plus a few explicit replacements
+func transliterate(s string) string {
+	s = asciiReplacements.Replace(s)
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	result, _, err := transform.String(t, s)
+	if err != nil {
+		return s
+	}
+	return result
+}
+
+// truncateBytes shortens s to at most max bytes without splitting a rune
+func truncateBytes(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	if max <= 0 {
+		return ""
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut]
+}
+
+// truncateFilename shortens a file name to at most max bytes, keeping its
+// extension when the extension itself is reasonably short
+func truncateFilename(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > 16 || len(ext) >= max {
+		return truncateBytes(name, max)
+	}
+	return truncateBytes(strings.TrimSuffix(name, ext), max-len(ext)) + ext
+}
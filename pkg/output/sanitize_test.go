@@ -0,0 +1,75 @@
+package output
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateBytes(t *testing.T) {
+	tests := []struct {
+		s    string
+		max  int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 5, "hello"},
+		{"hello", 3, "hel"},
+		{"hello", 0, ""},
+		{"hello", -1, ""},
+		{"", 0, ""},
+		{"åäö", 6, "åäö"},
+		{"åäö", 5, "åä"},
+		{"åäö", 4, "åä"},
+		{"åäö", 3, "å"},
+		{"åäö", 1, ""},
+		{"a€b", 3, "a"},
+		{"a€b", 4, "a€"},
+		{"日本語", 8, "日本"},
+		{"x😀y", 4, "x"},
+		{"x😀y", 5, "x😀"},
+	}
+	for _, test := range tests {
+		got := truncateBytes(test.s, test.max)
+		if got != test.want {
+			t.Errorf("truncateBytes(%q, %d) = %q, want %q", test.s, test.max, got, test.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("truncateBytes(%q, %d) = %q is not valid UTF-8", test.s, test.max, got)
+		}
+	}
+}
+
+func TestTruncateBytesNeverSplitsRunes(t *testing.T) {
+	s := strings.Repeat("aå€😀", 20)
+	for max := 0; max <= len(s); max++ {
+		got := truncateBytes(s, max)
+		if len(got) > max || !utf8.ValidString(got) || !strings.HasPrefix(s, got) {
+			t.Fatalf("truncateBytes(s, %d) = %q", max, got)
+		}
+		if max-len(got) >= utf8.UTFMax {
+			t.Fatalf("truncateBytes(s, %d) cut %d bytes more than needed", max, max-len(got))
+		}
+	}
+}
+
+func TestTruncateFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		max  int
+		want string
+	}{
+		{"report.pdf", 20, "report.pdf"},
+		{"quarterly-report.pdf", 12, "quarterl.pdf"},
+		{"årsrapport.pdf", 8, "års.pdf"},
+		{"åäö.pdf", 7, "å.pdf"},
+		{"räkning.pdf", 6, "r.pdf"},
+		{"archive.verylongextensionname", 10, "archive.ve"},
+		{"noextension", 5, "noext"},
+	}
+	for _, test := range tests {
+		if got := truncateFilename(test.name, test.max); got != test.want {
+			t.Errorf("truncateFilename(%q, %d) = %q, want %q", test.name, test.max, got, test.want)
+		}
+	}
+}
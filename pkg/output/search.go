@@ -0,0 +1,93 @@
+package output
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+// searchDocument describes a saved email for the search index. textPath is
+// its saved plain-text body, if any, and body the text that is indexed.
+func searchDocument(logger interfaces.Logger, metadata *Metadata, outputDir, folderPath, textPath, body string) interfaces.SearchDocument {
+	doc := interfaces.SearchDocument{
+		ID:       metadata.ID,
+		ThreadID: metadata.ThreadID,
+		Folder:   relativeTo(outputDir, folderPath),
+		Subject:  metadata.Subject,
+		From:     metadata.From,
+		To:       metadata.To,
+		Labels:   metadata.Labels,
+		Snippet:  html.UnescapeString(metadata.Snippet), // Gmail escapes snippets
+		Body:     body,
+	}
+	if textPath != "" {
+		doc.TextFile = relativeTo(outputDir, textPath)
+	}
+	if metadata.InternalDate > 0 {
+		doc.Date = time.UnixMilli(metadata.InternalDate)
+	} else {
+		doc.Date = parseEmailDate(logger, metadata.Date)
+	}
+
+	for _, attachment := range metadata.Attachments {
+		doc.Attachments = append(doc.Attachments, attachment.OriginalFilename)
+	}
+	for _, attachment := range metadata.SkippedAttachments {
+		doc.Attachments = append(doc.Attachments, attachment.OriginalFilename)
+	}
+	return doc
+}
+
+// ReadSearchDocument loads the searchable content of the email whose
+// {prefix}_metadata.json is at metadataPath. The body text comes from the
+// saved _body.txt, the HTML body, or the Gmail snippet, whichever exists.
+func ReadSearchDocument(logger interfaces.Logger, outputDir, metadataPath string) (interfaces.SearchDocument, error) {
+	metadata, err := ReadMetadata(metadataPath)
+	if err != nil {
+		return interfaces.SearchDocument{}, err
+	}
+	folderPath := filepath.Dir(metadataPath)
+	prefix := strings.TrimSuffix(filepath.Base(metadataPath), "_metadata.json")
+
+	textPath := filepath.Join(folderPath, prefix+"_body.txt")
+	body := ""
+	if data, err := os.ReadFile(textPath); err == nil {
+		body = string(data)
+	} else {
+		textPath = ""
+		if data, err := os.ReadFile(filepath.Join(folderPath, prefix+"_body.html")); err == nil {
+			body = HTMLToText(string(data))
+		} else {
+			body = html.UnescapeString(metadata.Snippet)
+		}
+	}
+	return searchDocument(logger, metadata, outputDir, folderPath, textPath, body), nil
+}
+
+// indexForSearch adds a written email to the search index. A failure is
+// logged but does not fail the email, `getgmail index` picks it up later.
+func (w *FileWriter) indexForSearch(email *interfaces.EmailMessage, metadata *Metadata, outputDir, folderPath, filePrefix string) {
+	textPath := ""
+	if w.options.Format != FormatEML {
+		textPath = filepath.Join(folderPath, filePrefix+"_body.txt")
+	}
+	doc := searchDocument(w.logger, metadata, outputDir, folderPath, textPath, PlainTextBody(email))
+	if err := w.options.SearchIndexer.AddDocument(doc); err != nil {
+		w.logger.Warn(fmt.Sprintf("Failed to add email %s to the search index: %v", email.ID, err))
+	}
+}
+
+// relativeTo returns path relative to the output directory, or path itself
+// when it is not below it
+func relativeTo(outputDir, path string) string {
+	rel, err := filepath.Rel(outputDir, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
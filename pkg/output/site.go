@@ -0,0 +1,387 @@
+package output
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+// The static archive browser: index.html in the output directory, and the
+// label, month and thread pages in SiteDirName below it
+const (
+	SiteIndexFileName = "index.html"
+	SiteDirName       = "_site"
+)
+
+// SiteResult summarizes a generated site
+type SiteResult struct {
+	Emails  int
+	Labels  int
+	Months  int
+	Threads int
+}
+
+// siteEmail is one email listed on the site. Links are file paths relative
+// to the output directory; the templates escape them and prefix the page's Root.
+type siteEmail struct {
+	ID          string
+	Subject     string
+	From        string
+	To          string
+	Snippet     string
+	Time        time.Time
+	Labels      []siteLink
+	BodyLink    string
+	Attachments []siteLink
+
+	// ThreadLink points at the thread page when the conversation has more
+	// than one downloaded message
+	ThreadID   string
+	ThreadLink string
+	ThreadSize int
+}
+
+type siteLink struct {
+	Name  string
+	Link  string
+	Count int
+}
+
+// sitePage is the data one page is rendered from
+type sitePage struct {
+	Title  string
+	Root   string // relative path from the page to the output directory
+	Labels []siteLink
+	Months []siteLink
+	Emails []*siteEmail
+
+	// ThreadHTML links the thread.html written by download --threads
+	ThreadHTML string
+	IsThread   bool
+}
+
+var siteTemplate = template.Must(template.New("page").Funcs(template.FuncMap{"url": relativeURL}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; margin: 0; color: #222; display: flex; }
+nav { width: 220px; flex-shrink: 0; padding: 16px; background: #f6f6f6; border-right: 1px solid #ddd; min-height: 100vh; font-size: 13px; }
+nav h3 { margin: 16px 0 6px 0; font-size: 13px; text-transform: uppercase; color: #666; }
+nav a { display: block; padding: 2px 0; text-decoration: none; color: #1a4fa0; overflow: hidden; text-overflow: ellipsis; white-space: nowrap; }
+main { flex-grow: 1; padding: 16px 24px; min-width: 0; }
+table { border-collapse: collapse; width: 100%; font-size: 13px; }
+th { text-align: left; border-bottom: 2px solid #ccc; padding: 6px; cursor: pointer; user-select: none; white-space: nowrap; }
+th[data-sort]::after { content: " \2195"; color: #aaa; }
+td { border-bottom: 1px solid #eee; padding: 6px; vertical-align: top; }
+td.date { white-space: nowrap; }
+.labels a, .attachments a { display: inline-block; margin: 0 6px 2px 0; font-size: 12px; }
+.labels a { background: #e8eef8; border-radius: 3px; padding: 0 4px; text-decoration: none; }
+.message { border: 1px solid #ddd; border-radius: 6px; margin: 12px 0; padding: 10px 14px; }
+.message .headers { color: #555; font-size: 13px; margin-bottom: 6px; }
+.snippet { color: #444; font-size: 14px; }
+</style>
+</head>
+<body>
+<nav>
+<a href="{{.Root}}index.html"><strong>All mail</strong></a>
+{{if .Labels}}<h3>Labels</h3>
+{{range .Labels}}<a href="{{$.Root}}{{url .Link}}">{{.Name}} ({{.Count}})</a>
+{{end}}{{end}}{{if .Months}}<h3>Months</h3>
+{{range .Months}}<a href="{{$.Root}}{{url .Link}}">{{.Name}} ({{.Count}})</a>
+{{end}}{{end}}</nav>
+<main>
+<h1>{{.Title}}</h1>
+{{if .IsThread}}{{if .ThreadHTML}}<p><a href="{{.Root}}{{url .ThreadHTML}}">Open conversation page</a></p>
+{{end}}{{range .Emails}}<div class="message">
+<div class="headers"><strong>{{.From}}</strong> to {{.To}}<br>{{.Time.Format "2006-01-02 15:04"}}</div>
+<div>{{if .BodyLink}}<a href="{{$.Root}}{{url .BodyLink}}">{{.Subject}}</a>{{else}}{{.Subject}}{{end}}</div>
+<div class="snippet">{{.Snippet}}</div>
+{{if .Attachments}}<div class="attachments">{{range .Attachments}}<a href="{{$.Root}}{{url .Link}}">{{.Name}}</a>{{end}}</div>{{end}}
+</div>
+{{end}}{{else}}<p>{{len .Emails}} emails. Click a column heading to sort.</p>
+<table id="emails">
+<thead><tr><th data-sort="date">Date</th><th data-sort="from">From</th><th data-sort="subject">Subject</th><th>Labels</th><th>Attachments</th></tr></thead>
+<tbody>
+{{range .Emails}}<tr data-date="{{.Time.Unix}}" data-from="{{.From}}" data-subject="{{.Subject}}">
+<td class="date">{{.Time.Format "2006-01-02 15:04"}}</td>
+<td>{{.From}}</td>
+<td>{{if .BodyLink}}<a href="{{$.Root}}{{url .BodyLink}}">{{.Subject}}</a>{{else}}{{.Subject}}{{end}}{{if .ThreadLink}} <a href="{{$.Root}}{{url .ThreadLink}}" title="Conversation">({{.ThreadSize}})</a>{{end}}</td>
+<td class="labels">{{range .Labels}}<a href="{{$.Root}}{{url .Link}}">{{.Name}}</a>{{end}}</td>
+<td class="attachments">{{range .Attachments}}<a href="{{$.Root}}{{url .Link}}">{{.Name}}</a>{{end}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+<script>
+(function () {
+  var table = document.getElementById("emails");
+  var current = "date", descending = true;
+  table.querySelectorAll("th[data-sort]").forEach(function (th) {
+    th.addEventListener("click", function () {
+      var key = th.getAttribute("data-sort");
+      descending = key === current ? !descending : key === "date";
+      current = key;
+      var body = table.tBodies[0];
+      var rows = Array.prototype.slice.call(body.rows);
+      rows.sort(function (a, b) {
+        var x = a.getAttribute("data-" + key), y = b.getAttribute("data-" + key);
+        var c = key === "date" ? Number(x) - Number(y) : x.toLowerCase().localeCompare(y.toLowerCase());
+        return descending ? -c : c;
+      });
+      rows.forEach(function (row) { body.appendChild(row); });
+    });
+  });
+})();
+</script>
+{{end}}</main>
+</body>
+</html>
+`))
+
+// GenerateSite writes a static HTML browser for the emails in outputDir:
+// index.html with every email, and pages per label, per month and per
+// conversation under SiteDirName. The pages only use relative links, so the
+// site works when opened from file://. Earlier generated pages are replaced.
+func GenerateSite(logger interfaces.Logger, outputDir string) (SiteResult, error) {
+	var result SiteResult
+
+	emails, err := loadSiteEmails(logger, outputDir)
+	if err != nil {
+		return result, err
+	}
+	sort.SliceStable(emails, func(i, j int) bool { return emails[i].Time.After(emails[j].Time) })
+
+	siteDir := filepath.Join(outputDir, SiteDirName)
+	if err := os.RemoveAll(siteDir); err != nil {
+		return result, fmt.Errorf("failed to remove old site: %v", err)
+	}
+	for _, dir := range []string{"labels", "months", "threads"} {
+		if err := os.MkdirAll(filepath.Join(siteDir, dir), 0755); err != nil {
+			return result, fmt.Errorf("failed to create site folder: %v", err)
+		}
+	}
+
+	sanitizer := mustSanitizer(FilenamesUnicode)
+	names := make(map[string]bool)
+	pageName := func(dir, name string) string {
+		base := sanitizer.Clean(strings.ReplaceAll(name, "/", "-"))
+		if base == "" {
+			base = dir
+		}
+		file := base
+		for i := 2; names[dir+"/"+strings.ToLower(file)]; i++ {
+			file = fmt.Sprintf("%s-%d", base, i)
+		}
+		names[dir+"/"+strings.ToLower(file)] = true
+		return filepath.Join(SiteDirName, dir, file+".html")
+	}
+
+	// Group the emails by label, month and thread, newest first like the index
+	var labelOrder, monthOrder, threadOrder []string
+	byLabel := make(map[string][]*siteEmail)
+	byMonth := make(map[string][]*siteEmail)
+	byThread := make(map[string][]*siteEmail)
+	for _, email := range emails {
+		for _, label := range email.Labels {
+			if byLabel[label.Name] == nil {
+				labelOrder = append(labelOrder, label.Name)
+			}
+			byLabel[label.Name] = append(byLabel[label.Name], email)
+		}
+		month := email.Time.Format("2006-01")
+		if byMonth[month] == nil {
+			monthOrder = append(monthOrder, month)
+		}
+		byMonth[month] = append(byMonth[month], email)
+		if email.ThreadID != "" {
+			if byThread[email.ThreadID] == nil {
+				threadOrder = append(threadOrder, email.ThreadID)
+			}
+			byThread[email.ThreadID] = append(byThread[email.ThreadID], email)
+		}
+	}
+	sort.Slice(labelOrder, func(i, j int) bool { return strings.ToLower(labelOrder[i]) < strings.ToLower(labelOrder[j]) })
+
+	var labels, months []siteLink
+	labelLinks := make(map[string]string)
+	for _, label := range labelOrder {
+		link := pageName("labels", label)
+		labelLinks[label] = link
+		labels = append(labels, siteLink{Name: label, Link: link, Count: len(byLabel[label])})
+	}
+	for _, month := range monthOrder {
+		months = append(months, siteLink{Name: month, Link: pageName("months", month), Count: len(byMonth[month])})
+	}
+	for _, email := range emails {
+		for i := range email.Labels {
+			email.Labels[i].Link = labelLinks[email.Labels[i].Name]
+		}
+	}
+
+	threadLinks := make(map[string]string)
+	for _, threadID := range threadOrder {
+		if len(byThread[threadID]) > 1 {
+			threadLinks[threadID] = pageName("threads", threadID)
+		}
+	}
+	for _, email := range emails {
+		if link, ok := threadLinks[email.ThreadID]; ok {
+			email.ThreadLink = link
+			email.ThreadSize = len(byThread[email.ThreadID])
+		}
+	}
+
+	page := func(title, root string, list []*siteEmail) sitePage {
+		return sitePage{Title: title, Root: root, Labels: labels, Months: months, Emails: list}
+	}
+
+	if err := writeSitePage(filepath.Join(outputDir, SiteIndexFileName), page("All mail", "", emails)); err != nil {
+		return result, err
+	}
+	for _, label := range labels {
+		if err := writeSitePage(filepath.Join(outputDir, label.Link), page(label.Name, "../../", byLabel[label.Name])); err != nil {
+			return result, err
+		}
+	}
+	for _, month := range months {
+		if err := writeSitePage(filepath.Join(outputDir, month.Link), page(month.Name, "../../", byMonth[month.Name])); err != nil {
+			return result, err
+		}
+	}
+	for threadID, link := range threadLinks {
+		// Conversations read oldest first
+		messages := append([]*siteEmail(nil), byThread[threadID]...)
+		sort.SliceStable(messages, func(i, j int) bool { return messages[i].Time.Before(messages[j].Time) })
+
+		p := page(messages[0].Subject, "../../", messages)
+		p.IsThread = true
+		p.ThreadHTML = threadHTMLLink(outputDir, messages[0])
+		if err := writeSitePage(filepath.Join(outputDir, link), p); err != nil {
+			return result, err
+		}
+	}
+
+	result.Emails = len(emails)
+	result.Labels = len(labels)
+	result.Months = len(months)
+	result.Threads = len(threadLinks)
+	return result, nil
+}
+
+// loadSiteEmails reads the metadata of every email below outputDir
+func loadSiteEmails(logger interfaces.Logger, outputDir string) ([]*siteEmail, error) {
+	var emails []*siteEmail
+	err := filepath.WalkDir(outputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			switch d.Name() {
+			case AttachmentStoreDir, SiteDirName, StagingDirName:
+				if filepath.Dir(path) == filepath.Clean(outputDir) {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if !strings.HasSuffix(d.Name(), "_metadata.json") {
+			return nil
+		}
+
+		metadata, err := ReadMetadata(path)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("Skipping %s: %v", path, err))
+			return nil
+		}
+		folder, err := filepath.Rel(outputDir, filepath.Dir(path))
+		if err != nil {
+			return nil
+		}
+		prefix := strings.TrimSuffix(d.Name(), "_metadata.json")
+		emails = append(emails, newSiteEmail(logger, outputDir, folder, prefix, metadata))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan metadata files: %v", err)
+	}
+	return emails, nil
+}
+
+func newSiteEmail(logger interfaces.Logger, outputDir, folder, prefix string, metadata *Metadata) *siteEmail {
+	email := &siteEmail{
+		ID:       metadata.ID,
+		Subject:  metadata.Subject,
+		From:     metadata.From,
+		To:       metadata.To,
+		Snippet:  html.UnescapeString(metadata.Snippet), // Gmail escapes snippets
+		ThreadID: metadata.ThreadID,
+	}
+	if email.Subject == "" {
+		email.Subject = "(no subject)"
+	}
+	if metadata.InternalDate > 0 {
+		email.Time = time.UnixMilli(metadata.InternalDate).Local()
+	} else {
+		email.Time = parseEmailDate(logger, metadata.Date).Local()
+	}
+
+	for _, label := range metadata.Labels {
+		email.Labels = append(email.Labels, siteLink{Name: label})
+	}
+
+	// Link the body, or the next best readable file
+	for _, suffix := range []string{"_body.html", PrintHTMLSuffix, ".eml", "_body.txt"} {
+		name := prefix + suffix
+		if _, err := os.Stat(filepath.Join(outputDir, folder, name)); err == nil {
+			email.BodyLink = filepath.Join(folder, name)
+			break
+		}
+	}
+
+	for _, attachment := range metadata.Attachments {
+		path := filepath.Join(folder, attachment.Filename)
+		if attachment.Filename == "" {
+			path = filepath.FromSlash(attachment.Store)
+		}
+		email.Attachments = append(email.Attachments, siteLink{Name: attachment.OriginalFilename, Link: path})
+	}
+	return email
+}
+
+// threadHTMLLink returns the thread.html of a conversation that was written
+// into a thread folder, relative to the output directory
+func threadHTMLLink(outputDir string, email *siteEmail) string {
+	if email.BodyLink == "" {
+		return ""
+	}
+	// Message folders sit directly in the thread folder
+	threadDir := filepath.Dir(filepath.Dir(email.BodyLink))
+	if threadFolderID(filepath.Join(outputDir, threadDir)) != email.ThreadID {
+		return ""
+	}
+	return filepath.Join(threadDir, ThreadHTMLFileName)
+}
+
+func writeSitePage(path string, page sitePage) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to write site page: %v", err)
+	}
+	if err := siteTemplate.Execute(f, page); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to render site page: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write site page: %v", err)
+	}
+	return nil
+}
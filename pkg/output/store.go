@@ -0,0 +1,223 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+// Attachment store modes. With a store every attachment is saved once under
+// attachments/sha256/ in the output directory, named by its SHA-256, and the
+// email folders link to it or only reference it from the metadata.
+const (
+	AttachmentStoreNone      = "none"
+	AttachmentStoreHardlink  = "hardlink"
+	AttachmentStoreSymlink   = "symlink"
+	AttachmentStoreReference = "reference"
+)
+
+// AttachmentStoreDir is the content-addressed attachment store in the output
+// directory
+const AttachmentStoreDir = "attachments"
+
+// ValidateAttachmentStore checks that mode is one of the AttachmentStore* modes
+func ValidateAttachmentStore(mode string) error {
+	switch mode {
+	case "", AttachmentStoreNone, AttachmentStoreHardlink, AttachmentStoreSymlink, AttachmentStoreReference:
+		return nil
+	}
+	return fmt.Errorf("invalid attachment store %q, expected %s, %s, %s or %s", mode,
+		AttachmentStoreNone, AttachmentStoreHardlink, AttachmentStoreSymlink, AttachmentStoreReference)
+}
+
+// usesStore reports whether attachments go to the content-addressed store
+func (w *FileWriter) usesStore() bool {
+	return w.options.AttachmentStore != "" && w.options.AttachmentStore != AttachmentStoreNone
+}
+
+// storePath returns the store location of content with the given SHA-256,
+// relative to the output directory: attachments/sha256/ab/cd/abcd...
+func storePath(sum string) string {
+	return filepath.Join(AttachmentStoreDir, "sha256", sum[:2], sum[2:4], sum)
+}
+
+// storeAttachment moves a fetched attachment into the store, or drops it when
+// the store already holds the same content, and returns its store path
+// relative to the output directory
+func storeAttachment(attachment *interfaces.Attachment, outputDir string) (string, error) {
+	if len(attachment.SHA256) < 4 {
+		return "", fmt.Errorf("attachment has no content hash")
+	}
+	relPath := storePath(attachment.SHA256)
+	path := filepath.Join(outputDir, relPath)
+
+	if _, err := os.Stat(path); err == nil {
+		os.Remove(attachment.Path)
+		attachment.Path = ""
+		return relPath, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create attachment store folder: %v", err)
+	}
+	if err := os.Rename(attachment.Path, path); err != nil {
+		return "", fmt.Errorf("failed to move attachment into the store: %v", err)
+	}
+	// Store files are shared, so they are kept read-only
+	os.Chmod(path, 0444)
+	attachment.Path = ""
+	return relPath, nil
+}
+
+// linkStored makes the stored file at storeFile (relative to outputDir)
+// appear at path, as a hard link or a relative symbolic link. Hard links fall
+// back to a copy on filesystems without link support.
+func (w *FileWriter) linkStored(outputDir, storeFile, path string) error {
+	target := filepath.Join(outputDir, storeFile)
+
+	if w.options.AttachmentStore == AttachmentStoreSymlink {
+		rel, err := filepath.Rel(filepath.Dir(path), target)
+		if err != nil {
+			return fmt.Errorf("failed to link attachment: %v", err)
+		}
+		if err := os.Symlink(rel, path); err != nil {
+			return fmt.Errorf("failed to link attachment: %v", err)
+		}
+		return nil
+	}
+
+	if err := os.Link(target, path); err == nil {
+		return nil
+	} else {
+		w.logger.Warn(fmt.Sprintf("Failed to hard link attachment, copying instead: %v", err))
+	}
+	return copyFile(target, path)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to copy attachment: %v", err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to copy attachment: %v", err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("failed to copy attachment: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to copy attachment: %v", err)
+	}
+	return nil
+}
+
+// GCResult summarizes a garbage collection of the attachment store
+type GCResult struct {
+	Referenced int
+	Removed    int
+	FreedBytes int64
+}
+
+// CollectGarbage removes files from the attachment store that no
+// *_metadata.json file in the output directory refers to any more, for
+// example after email folders were deleted. With dryRun nothing is removed.
+func CollectGarbage(outputDir string, dryRun bool) (GCResult, error) {
+	var result GCResult
+	storeRoot := filepath.Join(outputDir, AttachmentStoreDir)
+
+	referenced := make(map[string]bool)
+	err := filepath.WalkDir(outputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == storeRoot || d.Name() == StagingDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(d.Name(), "_metadata.json") {
+			return nil
+		}
+
+		metadata, err := ReadMetadata(path)
+		if err != nil {
+			// A metadata file that cannot be read might still reference
+			// attachments, so nothing can safely be collected
+			return err
+		}
+		for _, attachment := range metadata.Attachments {
+			if attachment.Store != "" {
+				referenced[filepath.FromSlash(attachment.Store)] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to scan metadata files: %v", err)
+	}
+	result.Referenced = len(referenced)
+
+	err = filepath.WalkDir(storeRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == storeRoot {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(outputDir, path)
+		if err != nil || referenced[rel] {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+		result.Removed++
+		result.FreedBytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to clean attachment store: %v", err)
+	}
+
+	if !dryRun {
+		removeEmptyDirs(filepath.Join(storeRoot, "sha256"))
+	}
+	return result, nil
+}
+
+// removeEmptyDirs removes the empty folders below root, deepest first
+func removeEmptyDirs(root string) {
+	var dirs []string
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		// Remove fails for folders that still have files
+		os.Remove(dirs[i])
+	}
+}
@@ -0,0 +1,141 @@
+package output
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+// htmlBlockElements start on a new line when converting HTML to text
+var htmlBlockElements = map[string]bool{
+	"p": true, "div": true, "tr": true, "li": true, "ul": true, "ol": true,
+	"table": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"blockquote": true, "pre": true, "hr": true, "section": true, "article": true,
+	"header": true, "footer": true,
+}
+
+// htmlParagraphElements are followed by an empty line
+var htmlParagraphElements = map[string]bool{
+	"p": true, "ul": true, "ol": true, "table": true, "blockquote": true, "pre": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+// htmlSkippedElements have no readable text content
+var htmlSkippedElements = map[string]bool{
+	"script": true, "style": true, "head": true, "title": true, "noscript": true,
+}
+
+var (
+	blankLinesRe   = regexp.MustCompile(`\n[ \t]*\n(?:[ \t]*\n)+`)
+	inlineSpacesRe = regexp.MustCompile(`[ \t\r\f\v]+`)
+)
+
+// PlainTextBody returns the text/plain alternative of the email, or a text
+// rendering of the HTML body when the message has no plain part
+func PlainTextBody(email *interfaces.EmailMessage) string {
+	for _, part := range email.BodyParts {
+		if part.MimeType == "text/plain" {
+			return part.Content
+		}
+	}
+	return HTMLToText(email.Body)
+}
+
+// HTMLToText renders HTML as readable plain text, keeping line breaks for
+// block elements and link targets after the link text
+func HTMLToText(source string) string {
+	var b strings.Builder
+	newline := func() {
+		if b.Len() > 0 && !strings.HasSuffix(b.String(), "\n") {
+			b.WriteString("\n")
+		}
+	}
+	tokenizer := html.NewTokenizer(strings.NewReader(source))
+	skipDepth := 0
+	var hrefs []string
+
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return tidyText(b.String())
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if htmlSkippedElements[token.Data] {
+				if token.Type == html.StartTagToken {
+					skipDepth++
+				}
+				continue
+			}
+			if htmlBlockElements[token.Data] {
+				newline()
+			}
+			switch token.Data {
+			case "br":
+				b.WriteString("\n")
+			case "li":
+				b.WriteString("- ")
+			case "td", "th":
+				b.WriteString("\t")
+			case "img":
+				if alt := attr(token, "alt"); alt != "" {
+					b.WriteString("[" + alt + "]")
+				}
+			case "a":
+				if token.Type == html.StartTagToken {
+					hrefs = append(hrefs, attr(token, "href"))
+				}
+			}
+
+		case html.EndTagToken:
+			token := tokenizer.Token()
+			if htmlSkippedElements[token.Data] {
+				if skipDepth > 0 {
+					skipDepth--
+				}
+				continue
+			}
+			if token.Data == "a" && len(hrefs) > 0 {
+				href := hrefs[len(hrefs)-1]
+				hrefs = hrefs[:len(hrefs)-1]
+				if strings.HasPrefix(href, "http") {
+					b.WriteString(" <" + href + ">")
+				}
+			}
+			if htmlBlockElements[token.Data] {
+				newline()
+			}
+			if htmlParagraphElements[token.Data] {
+				b.WriteString("\n")
+			}
+
+		case html.TextToken:
+			if skipDepth == 0 {
+				b.WriteString(inlineSpacesRe.ReplaceAllString(strings.ReplaceAll(string(tokenizer.Text()), "\n", " "), " "))
+			}
+		}
+	}
+}
+
+func attr(token html.Token, name string) string {
+	for _, a := range token.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// tidyText trims every line and collapses runs of blank lines
+func tidyText(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	s = strings.Join(lines, "\n")
+	s = blankLinesRe.ReplaceAllString(s, "\n\n")
+	return strings.TrimSpace(s) + "\n"
+}
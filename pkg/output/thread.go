@@ -0,0 +1,254 @@
+package output
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+// Files written to the folder of a conversation next to its message folders
+const (
+	ThreadHTMLFileName     = "thread.html"
+	ThreadMetadataFileName = "thread.json"
+)
+
+// ThreadMetadata is the structure of thread.json, listing the messages of a
+// conversation oldest first
+type ThreadMetadata struct {
+	ThreadID string          `json:"threadId"`
+	Subject  string          `json:"subject"`
+	Messages []ThreadMessage `json:"messages"`
+}
+
+// ThreadMessage is one message of a conversation. Folder is relative to the
+// thread folder.
+type ThreadMessage struct {
+	ID      string `json:"id"`
+	Folder  string `json:"folder"`
+	Subject string `json:"subject"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Date    string `json:"date"`
+}
+
+// threadPage is the data thread.html is rendered from
+type threadPage struct {
+	Subject  string
+	Messages []threadPageMessage
+}
+
+type threadPageMessage struct {
+	ThreadMessage
+	Text string
+	Link string
+}
+
+var threadTemplate = template.Must(template.New("thread").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Subject}}</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; max-width: 900px; margin: 20px auto; padding: 0 20px; color: #222; }
+.message { border: 1px solid #ddd; border-radius: 6px; margin: 16px 0; }
+.headers { background: #f6f6f6; padding: 10px 14px; border-bottom: 1px solid #ddd; font-size: 14px; }
+.headers div { margin: 2px 0; }
+.body { padding: 14px; white-space: pre-wrap; word-wrap: break-word; font-size: 14px; line-height: 1.5; }
+</style>
+</head>
+<body>
+<h1>{{.Subject}}</h1>
+{{range .Messages}}<div class="message" id="{{.ID}}">
+<div class="headers">
+<div><strong>From:</strong> {{.From}}</div>
+<div><strong>To:</strong> {{.To}}</div>
+<div><strong>Date:</strong> {{.Date}}</div>
+<div><strong>Subject:</strong> {{.Subject}}</div>
+{{if .Link}}<div><a href="{{.Link}}">Open message</a></div>{{end}}
+</div>
+<div class="body">{{.Text}}</div>
+</div>
+{{end}}</body>
+</html>
+`))
+
+// WriteThread writes a conversation into one folder holding a numbered
+// folder per message, oldest first, plus thread.html and thread.json.
+// Messages already written to the thread folder are kept as they are, so a
+// conversation that grows is updated in place.
+func (w *FileWriter) WriteThread(ctx context.Context, thread *interfaces.EmailThread, outputDir string) error {
+	if len(thread.Messages) == 0 {
+		return fmt.Errorf("thread %s has no messages", thread.ID)
+	}
+
+	threadPath, err := w.createThreadFolder(thread, outputDir)
+	if err != nil {
+		return err
+	}
+
+	first := thread.Messages[0]
+	metadata := ThreadMetadata{ThreadID: thread.ID, Subject: first.Subject}
+	page := threadPage{Subject: first.Subject}
+	if page.Subject == "" {
+		page.Subject = "(no subject)"
+	}
+
+	for i, email := range thread.Messages {
+		folderName, ok := w.threadMessageFolder(email.ID, threadPath)
+		if !ok {
+			folderName = fmt.Sprintf("%03d_%s", i+1, w.generateFilePrefix(email))
+			folderPath := filepath.Join(threadPath, folderName)
+			if err := os.MkdirAll(folderPath, 0755); err != nil {
+				return fmt.Errorf("failed to create email folder: %v", err)
+			}
+			if err := w.writeEmailFiles(ctx, email, outputDir, folderPath); err != nil {
+				return err
+			}
+		}
+
+		message := ThreadMessage{
+			ID:      email.ID,
+			Folder:  folderName,
+			Subject: email.Subject,
+			From:    email.From,
+			To:      email.To,
+			Date:    email.Date,
+		}
+		metadata.Messages = append(metadata.Messages, message)
+
+		text := PlainTextBody(email)
+		if text == "" {
+			text = email.Snippet
+		}
+		page.Messages = append(page.Messages, threadPageMessage{
+			ThreadMessage: message,
+			Text:          text,
+			Link:          threadMessageLink(threadPath, folderName),
+		})
+	}
+
+	f, err := os.Create(filepath.Join(threadPath, ThreadHTMLFileName))
+	if err != nil {
+		return fmt.Errorf("failed to write thread page: %v", err)
+	}
+	if err := threadTemplate.Execute(f, page); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to render thread page: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write thread page: %v", err)
+	}
+
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode thread metadata: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(threadPath, ThreadMetadataFileName), data, 0644); err != nil {
+		return fmt.Errorf("failed to write thread metadata: %v", err)
+	}
+
+	// Date the thread folder by its latest message
+	date := parseEmailDate(w.logger, thread.Messages[len(thread.Messages)-1].Date)
+	if err := os.Chtimes(threadPath, date, date); err != nil {
+		w.logger.Warn(fmt.Sprintf("Failed to set thread folder timestamp: %v", err))
+	}
+
+	w.logger.Info(fmt.Sprintf("Wrote thread %s with %d messages to %s", thread.ID, len(thread.Messages), threadPath))
+	return nil
+}
+
+// IsThreadDownloaded reports whether every message of the conversation is
+// already stored in its thread folder
+func (w *FileWriter) IsThreadDownloaded(thread *interfaces.Thread) bool {
+	if w.index == nil || len(thread.MessageIDs) == 0 {
+		return false
+	}
+	for _, id := range thread.MessageIDs {
+		folder, ok := w.index.Lookup(id)
+		if !ok || threadFolderID(filepath.Join(w.index.dir, filepath.Dir(folder))) != thread.ID {
+			return false
+		}
+	}
+	return true
+}
+
+// createThreadFolder finds the folder a conversation was written to before,
+// or creates one named by the folder layout of its first message. The thread
+// ID is appended when that folder belongs to another thread or email.
+func (w *FileWriter) createThreadFolder(thread *interfaces.EmailThread, outputDir string) (string, error) {
+	if w.index != nil && w.index.dir == outputDir {
+		for _, email := range thread.Messages {
+			folder, ok := w.index.Lookup(email.ID)
+			if !ok {
+				continue
+			}
+			threadPath := filepath.Join(outputDir, filepath.Dir(folder))
+			if threadFolderID(threadPath) == thread.ID {
+				return threadPath, nil
+			}
+		}
+	}
+
+	folderName := w.GenerateFolderName(thread.Messages[0])
+	threadPath := filepath.Join(outputDir, folderName)
+	existingID := threadFolderID(threadPath)
+	taken := existingID != "" && existingID != thread.ID
+	if existingID == "" && folderEmailID(threadPath) != "" {
+		// The folder holds a single email written without --threads
+		taken = true
+	}
+	if taken {
+		parent, leaf := filepath.Split(folderName)
+		leaf = truncateBytes(leaf, maxFilenameBytes-len(thread.ID)-1)
+		threadPath = filepath.Join(outputDir, parent, leaf+"_"+thread.ID)
+	}
+
+	if err := os.MkdirAll(threadPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to create thread folder: %v", err)
+	}
+	return threadPath, nil
+}
+
+// threadMessageFolder returns the folder name of a message that is already
+// stored in the thread folder
+func (w *FileWriter) threadMessageFolder(messageID, threadPath string) (string, bool) {
+	if w.index == nil {
+		return "", false
+	}
+	folder, ok := w.index.Lookup(messageID)
+	if !ok || filepath.Join(w.index.dir, filepath.Dir(folder)) != threadPath {
+		return "", false
+	}
+	return filepath.Base(folder), true
+}
+
+// threadMessageLink points thread.html at the saved body of a message, or
+// at its .eml file when no body was saved, relative to the thread folder
+func threadMessageLink(threadPath, folderName string) string {
+	for _, pattern := range []string{"*_body.html", "*.eml"} {
+		matches, err := filepath.Glob(filepath.Join(threadPath, folderName, pattern))
+		if err == nil && len(matches) > 0 {
+			return filepath.ToSlash(filepath.Join(folderName, filepath.Base(matches[0])))
+		}
+	}
+	return ""
+}
+
+// threadFolderID returns the thread ID recorded in a thread folder, or ""
+// when the folder does not hold a thread
+func threadFolderID(threadPath string) string {
+	data, err := os.ReadFile(filepath.Join(threadPath, ThreadMetadataFileName))
+	if err != nil {
+		return ""
+	}
+	var metadata ThreadMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return ""
+	}
+	return metadata.ThreadID
+}
@@ -0,0 +1,91 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+// UpdateLabels replaces the labels in the JSON metadata of saved emails and
+// refreshes their search index entries. Email folders stay where they were
+// written, even when the folder layout renders a label.
+func (w *FileWriter) UpdateLabels(ctx context.Context, emails []*interfaces.EmailMessage, outputDir string) error {
+	for _, email := range emails {
+		err := w.updateMetadata(outputDir, email.ID, func(m *Metadata) {
+			m.LabelIDs = email.LabelIDs
+			m.Labels = email.Labels
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkDeleted records in the JSON metadata of saved emails when they were
+// found deleted in Gmail. Their files are kept.
+func (w *FileWriter) MarkDeleted(ctx context.Context, messageIDs []string, outputDir string) error {
+	now := time.Now()
+	for _, id := range messageIDs {
+		err := w.updateMetadata(outputDir, id, func(m *Metadata) {
+			if m.DeletedAt == nil {
+				m.DeletedAt = &now
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateMetadata applies change to the JSON metadata of a saved email and
+// passes the result on to the search index
+func (w *FileWriter) updateMetadata(outputDir, messageID string, change func(m *Metadata)) error {
+	if w.index == nil || w.index.dir != outputDir {
+		return fmt.Errorf("message index of %s not loaded", outputDir)
+	}
+	folder, ok := w.index.Lookup(messageID)
+	if !ok {
+		return nil
+	}
+
+	metadataPath, metadata := findMetadata(filepath.Join(outputDir, folder), messageID)
+	if metadataPath == "" {
+		w.logger.Warn(fmt.Sprintf("No metadata.json for email %s in %s, not updated", messageID, folder))
+		return nil
+	}
+	change(metadata)
+	if err := metadata.write(metadataPath); err != nil {
+		return err
+	}
+
+	if w.options.SearchIndexer != nil {
+		doc, err := ReadSearchDocument(w.logger, outputDir, metadataPath)
+		if err == nil {
+			err = w.options.SearchIndexer.AddDocument(doc)
+		}
+		if err != nil {
+			w.logger.Warn(fmt.Sprintf("Failed to update email %s in the search index: %v", messageID, err))
+		}
+	}
+	return nil
+}
+
+// findMetadata returns the {prefix}_metadata.json of a message in an email
+// or thread folder, or "" when there is none
+func findMetadata(folderPath, messageID string) (string, *Metadata) {
+	matches, err := filepath.Glob(filepath.Join(folderPath, "*_metadata.json"))
+	if err != nil {
+		return "", nil
+	}
+	for _, path := range matches {
+		if metadata, err := ReadMetadata(path); err == nil && metadata.ID == messageID {
+			return path, metadata
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,172 @@
+package output
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+// rawTestEmail returns a message with a raw body for the mbox and Maildir writers
+func rawTestEmail(id string, labelIDs, labels []string) *interfaces.EmailMessage {
+	return &interfaces.EmailMessage{
+		ID:       id,
+		LabelIDs: labelIDs,
+		Labels:   labels,
+		Subject:  "Hello " + id,
+		Date:     "Thu, 1 Aug 2024 04:39:03 +0000",
+		Raw:      []byte("Subject: Hello " + id + "\r\n\r\nFrom the body of " + id + "\r\n"),
+	}
+}
+
+// newTestWriter creates a writer of the output format with its index loaded
+func newTestWriter(t *testing.T, outputFormat string, options Options) (interfaces.OutputWriter, string) {
+	t.Helper()
+	outputDir := t.TempDir()
+	writer, err := NewWriter(&testLogger{}, outputFormat, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.LoadIndex(outputDir); err != nil {
+		t.Fatal(err)
+	}
+	return writer, outputDir
+}
+
+func TestFileWriterUpdate(t *testing.T) {
+	writer, outputDir := newTestWriter(t, OutputFiles, Options{})
+	email := printTestEmail()
+	email.LabelIDs = []string{"INBOX", "UNREAD"}
+	email.Labels = []string{"INBOX", "UNREAD"}
+	if err := writer.WriteEmail(context.Background(), email, outputDir); err != nil {
+		t.Fatal(err)
+	}
+	updater := writer.(interfaces.MailboxUpdater)
+
+	relabeled := &interfaces.EmailMessage{ID: email.ID, LabelIDs: []string{"Label_7"}, Labels: []string{"Invoices"}}
+	unknown := &interfaces.EmailMessage{ID: "unknown", LabelIDs: []string{"INBOX"}, Labels: []string{"INBOX"}}
+	if err := updater.UpdateLabels(context.Background(), []*interfaces.EmailMessage{relabeled, unknown}, outputDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := updater.MarkDeleted(context.Background(), []string{email.ID}, outputDir); err != nil {
+		t.Fatal(err)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(outputDir, "*", "*_metadata.json"))
+	if len(matches) != 1 {
+		t.Fatalf("expected one metadata file, got %v", matches)
+	}
+	metadata, err := ReadMetadata(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata.Labels, []string{"Invoices"}) || !reflect.DeepEqual(metadata.LabelIDs, []string{"Label_7"}) {
+		t.Errorf("labels = %v %v, want the updated labels", metadata.LabelIDs, metadata.Labels)
+	}
+	if metadata.DeletedAt == nil {
+		t.Errorf("deletedAt was not set")
+	}
+	if metadata.Subject != email.Subject || len(metadata.Attachments) != 1 {
+		t.Errorf("updating the labels changed the rest of the metadata: %+v", metadata)
+	}
+}
+
+func TestMaildirWriterUpdate(t *testing.T) {
+	writer, outputDir := newTestWriter(t, OutputMaildir, Options{})
+	ctx := context.Background()
+	email := rawTestEmail("18c2f0a1", []string{"INBOX", "UNREAD"}, []string{"INBOX", "UNREAD"})
+	if err := writer.WriteEmail(ctx, email, outputDir); err != nil {
+		t.Fatal(err)
+	}
+	updater := writer.(interfaces.MailboxUpdater)
+
+	// Read in a mail client, which also set the replied flag
+	files, _ := filepath.Glob(filepath.Join(outputDir, "*", "*G18c2f0a1*"))
+	if len(files) != 1 {
+		t.Fatalf("expected one delivered message, got %v", files)
+	}
+	replied := filepath.Join(outputDir, "cur", strings.SplitN(filepath.Base(files[0]), ":", 2)[0]+":2,RS")
+	if err := os.Rename(files[0], replied); err != nil {
+		t.Fatal(err)
+	}
+
+	// Archived out of the inbox into Work/2024, read and starred
+	relabeled := &interfaces.EmailMessage{ID: email.ID, LabelIDs: []string{"Label_1", "STARRED"}, Labels: []string{"Work/2024", "STARRED"}}
+	if err := updater.UpdateLabels(ctx, []*interfaces.EmailMessage{relabeled}, outputDir); err != nil {
+		t.Fatal(err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(outputDir, "cur", "*")); len(left) != 0 {
+		t.Errorf("message was kept in the inbox: %v", left)
+	}
+	moved, _ := filepath.Glob(filepath.Join(outputDir, ".Work.2024", "cur", "*G18c2f0a1*"))
+	if len(moved) != 1 || !strings.HasSuffix(moved[0], ":2,FRS") {
+		t.Fatalf("expected the message in .Work.2024 flagged FRS, got %v", moved)
+	}
+	if data, err := os.ReadFile(moved[0]); err != nil || string(data) != string(email.Raw) {
+		t.Errorf("moved message content = %q, %v", data, err)
+	}
+
+	if err := updater.MarkDeleted(ctx, []string{email.ID}, outputDir); err != nil {
+		t.Fatal(err)
+	}
+	trashed, _ := filepath.Glob(filepath.Join(outputDir, ".Work.2024", "cur", "*G18c2f0a1*"))
+	if len(trashed) != 1 || !strings.HasSuffix(trashed[0], ":2,FRST") {
+		t.Errorf("expected the message flagged FRST, got %v", trashed)
+	}
+}
+
+func TestMboxWriterUpdate(t *testing.T) {
+	writer, outputDir := newTestWriter(t, OutputMbox, Options{MboxPerLabel: true})
+	ctx := context.Background()
+	first := rawTestEmail("aaa1", []string{"INBOX"}, []string{"INBOX"})
+	second := rawTestEmail("bbb2", []string{"INBOX"}, []string{"INBOX"})
+	for _, email := range []*interfaces.EmailMessage{first, second} {
+		if err := writer.WriteEmail(ctx, email, outputDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	updater := writer.(interfaces.MailboxUpdater)
+
+	relabeled := &interfaces.EmailMessage{ID: "aaa1", LabelIDs: []string{"Label_1", "UNREAD"}, Labels: []string{"Work", "UNREAD"}}
+	if err := updater.UpdateLabels(ctx, []*interfaces.EmailMessage{relabeled}, outputDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := updater.MarkDeleted(ctx, []string{"bbb2"}, outputDir); err != nil {
+		t.Fatal(err)
+	}
+
+	inbox := readFile(t, filepath.Join(outputDir, "INBOX.mbox"))
+	if strings.Contains(inbox, "aaa1") {
+		t.Errorf("relabeled email is still in INBOX.mbox:\n%s", inbox)
+	}
+	wantInbox := "From bbb2@getgmail Thu Aug  1 04:39:03 2024\nX-Status: D\nX-Gmail-Labels: INBOX\nSubject: Hello bbb2\n\n>From the body of bbb2\n\n"
+	if inbox != wantInbox {
+		t.Errorf("INBOX.mbox = %q, want %q", inbox, wantInbox)
+	}
+
+	work := readFile(t, filepath.Join(outputDir, "Work.mbox"))
+	wantWork := "From aaa1@getgmail Thu Aug  1 04:39:03 2024\nX-Gmail-Labels: Work,UNREAD\nSubject: Hello aaa1\n\n>From the body of aaa1\n\n"
+	if work != wantWork {
+		t.Errorf("Work.mbox = %q, want %q", work, wantWork)
+	}
+
+	if err := writer.LoadIndex(outputDir); err != nil {
+		t.Fatal(err)
+	}
+	if !writer.IsDownloaded("aaa1") || !writer.IsDownloaded("bbb2") {
+		t.Errorf("updated emails are no longer known to the index")
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
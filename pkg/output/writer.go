@@ -3,54 +3,247 @@ package output
 import (
 	"context"
 	"fmt"
+	"html/template"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/perarneng/getgmail/pkg/interfaces"
 )
 
+// Email formats FileWriter can save
+const (
+	FormatHTML = "html"
+	FormatEML  = "eml"
+	FormatBoth = "both"
+)
+
+// Output formats selecting the OutputWriter implementation
+const (
+	OutputFiles   = "files"
+	OutputMbox    = "mbox"
+	OutputMaildir = "maildir"
+)
+
+// Options controls what the writers write for each email
+type Options struct {
+	// Format selects the email representations FileWriter saves: the
+	// readable HTML body with attachments, the original message as .eml, or both
+	Format string
+
+	// FilenamePolicy selects how subjects, labels and attachment names are
+	// turned into file names, see the Filenames* constants
+	FilenamePolicy string
+
+	// Layout is the text/template FileWriter renders the email folder path
+	// from, see LayoutData. Empty means DefaultLayout.
+	Layout string
+
+	// MaxAttachmentSize skips attachments larger than this many bytes,
+	// recording them in the metadata instead. Zero means no limit.
+	MaxAttachmentSize int64
+
+	// AttachmentStore makes FileWriter save each attachment once in a
+	// content-addressed store under the output directory, see the
+	// AttachmentStore* modes. Empty means AttachmentStoreNone.
+	AttachmentStore string
+
+	// InlineImages selects whether cid: references in the saved HTML body
+	// link to the saved inline images or embed them as data: URIs, see the
+	// InlineImages* modes. Empty means InlineImagesLink.
+	InlineImages string
+
+	// SanitizeHTML makes FileWriter strip active content from the saved HTML
+	// body and block or localize its remote resources, see the
+	// HTMLSanitize* modes. Empty means HTMLSanitizeOff.
+	SanitizeHTML string
+
+	// Print makes FileWriter also write {prefix}_print.html, a printable
+	// page with a header table, the attachment list and the body, rendered
+	// from PrintTemplate (html/template, see PrintData). Empty PrintTemplate
+	// means DefaultPrintTemplate; setting one implies Print.
+	Print         bool
+	PrintTemplate string
+
+	// PDFRenderer, when set, converts each printable page to {prefix}.pdf.
+	// It implies Print.
+	PDFRenderer interfaces.PDFRenderer
+
+	// SearchIndexer, when set, receives every email FileWriter saves so the
+	// full-text search index stays current
+	SearchIndexer interfaces.SearchIndexer
+
+	// MboxPerLabel makes MboxWriter append each email to one mbox file per
+	// Gmail label instead of a single mailbox.mbox
+	MboxPerLabel bool
+}
+
 type FileWriter struct {
-	logger interfaces.Logger
+	logger    interfaces.Logger
+	options   Options
+	sanitizer *Sanitizer
+	layout    *Layout
+	index     *messageIndex
+
+	printTemplate *template.Template
+
+	// staging is the staging subfolder of this run, see stagingDir
+	stagingMu sync.Mutex
+	staging   string
 }
 
-func NewFileWriter(logger interfaces.Logger) interfaces.OutputWriter {
+func NewFileWriter(logger interfaces.Logger, options Options) interfaces.OutputWriter {
+	if options.Format == "" {
+		options.Format = FormatHTML
+	}
+	sanitizer := mustSanitizer(options.FilenamePolicy)
 	return &FileWriter{
-		logger: logger,
+		logger:    logger,
+		options:   options,
+		sanitizer: sanitizer,
+		layout:    mustLayout(options.Layout, sanitizer),
+
+		printTemplate: mustPrintTemplate(options.PrintTemplate),
 	}
 }
 
+// NewWriter creates the OutputWriter for the given output format
+func NewWriter(logger interfaces.Logger, outputFormat string, options Options) (interfaces.OutputWriter, error) {
+	sanitizer, err := NewSanitizer(options.FilenamePolicy)
+	if err != nil {
+		return nil, err
+	}
+	if options.Layout != "" {
+		if outputFormat != OutputFiles && outputFormat != "" {
+			return nil, fmt.Errorf("a folder layout can only be used with the %s output format", OutputFiles)
+		}
+		if _, err := NewLayout(options.Layout, sanitizer); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ValidateAttachmentStore(options.AttachmentStore); err != nil {
+		return nil, err
+	}
+	if options.AttachmentStore != "" && options.AttachmentStore != AttachmentStoreNone && outputFormat != OutputFiles && outputFormat != "" {
+		return nil, fmt.Errorf("an attachment store can only be used with the %s output format", OutputFiles)
+	}
+
+	if err := ValidateInlineImages(options.InlineImages); err != nil {
+		return nil, err
+	}
+	if options.InlineImages == InlineImagesEmbed && outputFormat != OutputFiles && outputFormat != "" {
+		return nil, fmt.Errorf("inline images can only be embedded with the %s output format", OutputFiles)
+	}
+
+	if err := ValidateHTMLSanitize(options.SanitizeHTML); err != nil {
+		return nil, err
+	}
+	if options.SanitizeHTML != "" && options.SanitizeHTML != HTMLSanitizeOff && outputFormat != OutputFiles && outputFormat != "" {
+		return nil, fmt.Errorf("HTML sanitizing can only be used with the %s output format", OutputFiles)
+	}
+
+	if options.Print || options.PrintTemplate != "" || options.PDFRenderer != nil {
+		if outputFormat != OutputFiles && outputFormat != "" {
+			return nil, fmt.Errorf("printable pages can only be written with the %s output format", OutputFiles)
+		}
+		if options.Format == FormatEML {
+			return nil, fmt.Errorf("printable pages need the %s or %s format", FormatHTML, FormatBoth)
+		}
+		if _, err := NewPrintTemplate(options.PrintTemplate); err != nil {
+			return nil, err
+		}
+	}
+
+	switch outputFormat {
+	case OutputFiles, "":
+		return NewFileWriter(logger, options), nil
+	case OutputMbox:
+		return NewMboxWriter(logger, options), nil
+	case OutputMaildir:
+		return NewMaildirWriter(logger, options), nil
+	}
+	return nil, fmt.Errorf("invalid output format %q, expected %s, %s or %s", outputFormat, OutputFiles, OutputMbox, OutputMaildir)
+}
+
+// RequiresRaw reports whether the output format is built from the raw
+// RFC 822 message rather than the parsed body and attachments
+func RequiresRaw(outputFormat string) bool {
+	return outputFormat == OutputMbox || outputFormat == OutputMaildir
+}
+
+// ValidateFormat checks that format is one of the supported email formats
+func ValidateFormat(format string) error {
+	switch format {
+	case FormatHTML, FormatEML, FormatBoth:
+		return nil
+	}
+	return fmt.Errorf("invalid format %q, expected %s, %s or %s", format, FormatHTML, FormatEML, FormatBoth)
+}
+
 func (w *FileWriter) ValidateOutputDir(outputDir string) error {
+	return validateOutputDir(w.logger, outputDir)
+}
+
+func validateOutputDir(logger interfaces.Logger, outputDir string) error {
 	info, err := os.Stat(outputDir)
 	if err != nil {
 		if os.IsNotExist(err) {
-			w.logger.Error(fmt.Sprintf("Output directory does not exist: %s", outputDir))
+			logger.Error(fmt.Sprintf("Output directory does not exist: %s", outputDir))
 			return fmt.Errorf("output directory does not exist: %s", outputDir)
 		}
 		return fmt.Errorf("error checking output directory: %v", err)
 	}
 
 	if !info.IsDir() {
-		w.logger.Error(fmt.Sprintf("Output path is not a directory: %s", outputDir))
+		logger.Error(fmt.Sprintf("Output path is not a directory: %s", outputDir))
 		return fmt.Errorf("output path is not a directory: %s", outputDir)
 	}
 
-	w.logger.Info(fmt.Sprintf("Output directory validated: %s", outputDir))
+	logger.Info(fmt.Sprintf("Output directory validated: %s", outputDir))
+	return nil
+}
+
+// LoadIndex loads the message ID index of the output directory, rebuilding it
+// from existing metadata files if it does not exist yet
+func (w *FileWriter) LoadIndex(outputDir string) error {
+	if err := cleanStaging(outputDir); err != nil {
+		return err
+	}
+
+	idx, rebuilt, err := loadMessageIndex(outputDir, scanMetadataFiles)
+	if err != nil {
+		return err
+	}
+	if rebuilt {
+		w.logger.Info(fmt.Sprintf("Rebuilt message index with %d emails", len(idx.folders)))
+	}
+	w.index = idx
 	return nil
 }
 
+// IsDownloaded reports whether the message is already present in the loaded index
+func (w *FileWriter) IsDownloaded(messageID string) bool {
+	if w.index == nil {
+		return false
+	}
+	_, ok := w.index.Lookup(messageID)
+	return ok
+}
+
 // generateFilePrefix creates a consistent prefix for all files in an email directory
 // Format: YYYY-MM-DD_HH-MM-SS_subject
 // Ensures total length doesn't exceed 255 characters for filesystem compatibility
 func (w *FileWriter) generateFilePrefix(email *interfaces.EmailMessage) string {
 	// Parse date
-	date := w.parseEmailDate(email.Date)
+	date := parseEmailDate(w.logger, email.Date)
 	dateStr := date.Format("2006-01-02_15-04-05")
 
 	// Clean subject for filesystem
-	subject := w.sanitizeForFilename(email.Subject)
+	subject := w.sanitizer.Clean(email.Subject)
 	if subject == "" {
 		subject = "no-subject"
 	}
@@ -58,20 +251,43 @@ func (w *FileWriter) generateFilePrefix(email *interfaces.EmailMessage) string {
 	// Calculate max subject length to keep total under 255 chars
 	// Account for: dateStr (19) + "_" (1) + longest suffix ("_metadata.txt" = 13) = 33
 	// Leave some buffer for attachment filenames
+	// Lengths are in bytes and cuts never split a multi-byte character
 	maxSubjectLen := 200 - len(dateStr) - 1 // 200 to leave room for suffixes
-	if len(subject) > maxSubjectLen {
-		subject = subject[:maxSubjectLen]
-	}
+	subject = strings.TrimRight(truncateBytes(subject, maxSubjectLen), "-")
 
 	return fmt.Sprintf("%s_%s", dateStr, subject)
 }
 
+// GenerateFolderName renders the folder layout for the email. The result is
+// relative to the output directory and may contain subfolders.
 func (w *FileWriter) GenerateFolderName(email *interfaces.EmailMessage) string {
-	return w.generateFilePrefix(email)
+	folderName, err := w.layout.FolderPath(email, parseEmailDate(w.logger, email.Date))
+	if err != nil {
+		w.logger.Warn(fmt.Sprintf("Failed to render folder layout for email %s, using default: %v", email.ID, err))
+		return w.generateFilePrefix(email)
+	}
+	return folderName
 }
 
-func (w *FileWriter) CreateEmailFolder(email *interfaces.EmailMessage, outputDir string) (string, error) {
+// resolveFolderName returns the layout folder of the email, or that folder
+// with the message ID appended when it already holds a different email, so
+// that emails with the same date and subject never overwrite each other
+func (w *FileWriter) resolveFolderName(email *interfaces.EmailMessage, outputDir string) string {
 	folderName := w.GenerateFolderName(email)
+
+	existingID := folderEmailID(filepath.Join(outputDir, folderName))
+	if existingID == "" || existingID == email.ID {
+		return folderName
+	}
+
+	parent, leaf := filepath.Split(folderName)
+	leaf = strings.TrimRight(truncateBytes(leaf, maxFilenameBytes-len(email.ID)-1), "-")
+	w.logger.Info(fmt.Sprintf("Folder %s already holds email %s, using the message ID to keep %s apart", folderName, existingID, email.ID))
+	return filepath.Join(parent, leaf+"_"+email.ID)
+}
+
+func (w *FileWriter) CreateEmailFolder(email *interfaces.EmailMessage, outputDir string) (string, error) {
+	folderName := w.resolveFolderName(email, outputDir)
 	folderPath := filepath.Join(outputDir, folderName)
 
 	// Create folder if it doesn't exist
@@ -91,66 +307,57 @@ func (w *FileWriter) WriteEmail(ctx context.Context, email *interfaces.EmailMess
 	if err != nil {
 		return err
 	}
+	return w.writeEmailFiles(ctx, email, outputDir, folderPath)
+}
+
+// writeEmailFiles writes all files of an email into its existing folder,
+// dates the folder and records it in the message index
+func (w *FileWriter) writeEmailFiles(ctx context.Context, email *interfaces.EmailMessage, outputDir, folderPath string) error {
+	var err error
 
 	// Generate consistent file prefix
 	filePrefix := w.generateFilePrefix(email)
 
-	// Write email metadata
-	metadataPath := filepath.Join(folderPath, filePrefix+"_metadata.txt")
-	metadataContent := fmt.Sprintf(`Email ID: %s
-Subject: %s
-From: %s
-To: %s
-Date: %s
-Body MIME Type: %s
-Attachments: %d
-
-Headers:
-`, email.ID, email.Subject, email.From, email.To, email.Date, email.BodyMimeType, len(email.Attachments))
-
-	for key, value := range email.Headers {
-		metadataContent += fmt.Sprintf("%s: %s\n", key, value)
-	}
-
-	// Add attachment details to metadata
-	if len(email.Attachments) > 0 {
-		metadataContent += "\nAttachments:\n"
-		for i, attachment := range email.Attachments {
-			metadataContent += fmt.Sprintf("  %d. %s (%s, %d bytes)\n", 
-				i+1, attachment.Filename, attachment.MimeType, attachment.Size)
+	// Write the original message so the archive can be re-imported into any mail client
+	if w.options.Format != FormatHTML && len(email.Raw) > 0 {
+		emlPath := filepath.Join(folderPath, filePrefix+".eml")
+		if err := os.WriteFile(emlPath, email.Raw, 0644); err != nil {
+			return fmt.Errorf("failed to write eml file: %v", err)
 		}
 	}
 
-	err = os.WriteFile(metadataPath, []byte(metadataContent), 0644)
-	if err != nil {
-		return fmt.Errorf("failed to write metadata: %v", err)
-	}
+	metadata := newMetadata(email)
 
-	// Write email body - always save as HTML since we now wrap plain text in HTML
-	bodyPath := filepath.Join(folderPath, filePrefix+"_body.html")
-	err = os.WriteFile(bodyPath, []byte(email.Body), 0644)
-	if err != nil {
-		return fmt.Errorf("failed to write email body: %v", err)
-	}
+	// Saved inline images by lower-case Content-ID, for rewriting the body
+	images := make(map[string]inlineImage)
 
 	// Write attachments directly in email directory with prefix
 	if len(email.Attachments) > 0 {
-		for i, attachment := range email.Attachments {
+		for i := range email.Attachments {
+			attachment := &email.Attachments[i]
+			skipOversized(attachment, w.options.MaxAttachmentSize)
+			if attachment.SkipReason != "" {
+				w.logger.Warn(fmt.Sprintf("Skipped attachment %s: %s", attachment.Filename, attachment.SkipReason))
+				metadata.addSkippedAttachment(*attachment)
+				continue
+			}
+
 			filename := attachment.Filename
 			if filename == "" {
 				filename = fmt.Sprintf("attachment_%d", i+1)
 			}
-			
+
 			// Sanitize filename
-			filename = w.sanitizeForFilename(filename)
+			filename = w.sanitizer.Clean(filename)
 			if filename == "" {
 				filename = fmt.Sprintf("attachment_%d", i+1)
 			}
 
-			// Create attachment path with prefix
+			// Create attachment path with prefix, leaving room for a duplicate counter
+			filename = truncateFilename(filename, maxFilenameBytes-len(filePrefix)-1-8)
 			attachmentFilename := fmt.Sprintf("%s_%s", filePrefix, filename)
 			attachmentPath := filepath.Join(folderPath, attachmentFilename)
-			
+
 			// Handle duplicate filenames by adding a counter
 			originalPath := attachmentPath
 			counter := 1
@@ -164,20 +371,112 @@ Headers:
 				counter++
 			}
 
-			err = os.WriteFile(attachmentPath, attachment.Data, 0644)
+			storeFile, err := w.saveAttachment(ctx, attachment, attachmentPath, outputDir)
 			if err != nil {
 				w.logger.Warn(fmt.Sprintf("Failed to write attachment %s: %v", attachmentFilename, err))
+				attachment.SkipReason = err.Error()
+				metadata.addSkippedAttachment(*attachment)
 				continue
 			}
-			
-			w.logger.Info(fmt.Sprintf("Wrote attachment: %s (%d bytes)", attachmentFilename, len(attachment.Data)))
+
+			savedName := filepath.Base(attachmentPath)
+			if w.options.AttachmentStore == AttachmentStoreReference {
+				// Only the metadata points at the stored file
+				savedName = ""
+			}
+			metadata.addAttachment(*attachment, savedName, storeFile)
+			if attachment.ContentID != "" {
+				images[strings.ToLower(attachment.ContentID)] = newInlineImage(folderPath, attachmentPath, storeFile, outputDir, attachment.MimeType)
+			}
+			w.logger.Info(fmt.Sprintf("Wrote attachment: %s (%d bytes)", attachmentFilename, attachment.Size))
+		}
+
+		w.logger.Info(fmt.Sprintf("Wrote %d attachments to %s", len(metadata.Attachments), folderPath))
+	}
+
+	// Write email body - always save as HTML since we now wrap plain text in HTML.
+	// It comes after the attachments so cid: references can point at them.
+	if w.options.Format != FormatEML {
+		body := w.rewriteCIDs(email.Body, images)
+		if w.sanitizesHTML() {
+			// Keep the body as received next to the sanitized one
+			origPath := filepath.Join(folderPath, filePrefix+OriginalBodySuffix)
+			if err := os.WriteFile(origPath, []byte(email.Body), 0644); err != nil {
+				return fmt.Errorf("failed to write original email body: %v", err)
+			}
+			if body, metadata.RemoteImages, err = w.sanitizeBody(ctx, body, w.options.SanitizeHTML, folderPath, filePrefix); err != nil {
+				return err
+			}
+		}
+
+		bodyPath := filepath.Join(folderPath, filePrefix+"_body.html")
+		err = os.WriteFile(bodyPath, []byte(body), 0644)
+		if err != nil {
+			return fmt.Errorf("failed to write email body: %v", err)
+		}
+
+		// Write the plain-text alternative for grep and indexing tools
+		textPath := filepath.Join(folderPath, filePrefix+"_body.txt")
+		err = os.WriteFile(textPath, []byte(PlainTextBody(email)), 0644)
+		if err != nil {
+			return fmt.Errorf("failed to write email text body: %v", err)
+		}
+
+		if w.printsEmails() {
+			if err := w.writePrintable(ctx, email, metadata, body, outputDir, folderPath, filePrefix); err != nil {
+				return err
+			}
 		}
-		
-		w.logger.Info(fmt.Sprintf("Wrote %d attachments to %s", len(email.Attachments), folderPath))
+	}
+
+	// Write email metadata last, so that its presence marks a complete email
+	metadataPath := filepath.Join(folderPath, filePrefix+"_metadata.txt")
+	metadataContent := fmt.Sprintf(`Email ID: %s
+Subject: %s
+From: %s
+To: %s
+Date: %s
+Body MIME Type: %s
+Body Charset: %s
+Attachments: %d
+
+Headers:
+`, email.ID, email.Subject, email.From, email.To, email.Date, email.BodyMimeType, bodyCharset(email), len(metadata.Attachments))
+
+	// Emit every header in message order so repeated headers like Received
+	// keep their full chain
+	for _, header := range email.HeaderList {
+		metadataContent += fmt.Sprintf("%s: %s\n", header.Name, header.Value)
+	}
+
+	// Add attachment details to metadata
+	if len(metadata.Attachments) > 0 {
+		metadataContent += "\nAttachments:\n"
+		for i, attachment := range metadata.Attachments {
+			metadataContent += fmt.Sprintf("  %d. %s (%s, %d bytes)\n",
+				i+1, attachment.OriginalFilename, attachment.MimeType, attachment.Size)
+		}
+	}
+	if len(metadata.SkippedAttachments) > 0 {
+		metadataContent += "\nSkipped Attachments:\n"
+		for i, attachment := range metadata.SkippedAttachments {
+			metadataContent += fmt.Sprintf("  %d. %s (%s, %d bytes): %s\n",
+				i+1, attachment.OriginalFilename, attachment.MimeType, attachment.Size, attachment.Reason)
+		}
+	}
+
+	err = os.WriteFile(metadataPath, []byte(metadataContent), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write metadata: %v", err)
+	}
+
+	// Write structured metadata once the attachment manifest is complete
+	if err := metadata.write(filepath.Join(folderPath, filePrefix+"_metadata.json")); err != nil {
+		return err
 	}
 
 	// Set folder modification time to email date AFTER writing all files
-	date := w.parseEmailDate(email.Date)
+	date := parseEmailDate(w.logger, email.Date)
 	w.logger.Debug(fmt.Sprintf("Setting folder timestamp to: %s", date.Format(time.RFC3339)))
 	err = os.Chtimes(folderPath, date, date)
 	if err != nil {
@@ -186,14 +485,27 @@ Headers:
 		w.logger.Debug(fmt.Sprintf("Successfully set folder timestamp"))
 	}
 
+	if w.index != nil && w.index.dir == outputDir {
+		folder, err := filepath.Rel(outputDir, folderPath)
+		if err != nil {
+			folder = filepath.Base(folderPath)
+		}
+		if err := w.index.Add(email.ID, folder); err != nil {
+			w.logger.Warn(fmt.Sprintf("Failed to index email %s: %v", email.ID, err))
+		}
+	}
+	if w.options.SearchIndexer != nil {
+		w.indexForSearch(email, metadata, outputDir, folderPath, filePrefix)
+	}
+
 	w.logger.Info(fmt.Sprintf("Wrote email %s to %s", email.ID, folderPath))
 	return nil
 }
 
-func (w *FileWriter) parseEmailDate(dateStr string) time.Time {
+func parseEmailDate(logger interfaces.Logger, dateStr string) time.Time {
 	// Clean up date string - remove timezone suffixes like (UTC), (GMT), etc.
 	cleanDateStr := regexp.MustCompile(`\s*\([^)]+\)\s*$`).ReplaceAllString(dateStr, "")
-	
+
 	// Try common email date formats
 	formats := []string{
 		"Mon, 2 Jan 2006 15:04:05 -0700",
@@ -201,8 +513,8 @@ func (w *FileWriter) parseEmailDate(dateStr string) time.Time {
 		"2 Jan 2006 15:04:05 -0700",
 		"02 Jan 2006 15:04:05 -0700",
 		"Mon, 2 Jan 2006 15:04:05 MST",
-		time.RFC1123Z,  // "Mon, 02 Jan 2006 15:04:05 -0700"
-		time.RFC1123,   // "Mon, 02 Jan 2006 15:04:05 MST"
+		time.RFC1123Z, // "Mon, 02 Jan 2006 15:04:05 -0700"
+		time.RFC1123,  // "Mon, 02 Jan 2006 15:04:05 MST"
 		time.RFC3339,
 	}
 
@@ -213,21 +525,6 @@ func (w *FileWriter) parseEmailDate(dateStr string) time.Time {
 	}
 
 	// If all parsing fails, return current time
-	w.logger.Warn(fmt.Sprintf("Could not parse date '%s', using current time", dateStr))
+	logger.Warn(fmt.Sprintf("Could not parse date '%s', using current time", dateStr))
 	return time.Now()
 }
-
-func (w *FileWriter) sanitizeForFilename(s string) string {
-	// Remove or replace invalid characters for filenames, but keep dots for extensions
-	reg := regexp.MustCompile(`[^\w\s.-]`)
-	cleaned := reg.ReplaceAllString(s, "")
-	
-	// Replace spaces and multiple dashes with single dash
-	cleaned = regexp.MustCompile(`\s+`).ReplaceAllString(cleaned, "-")
-	cleaned = regexp.MustCompile(`-+`).ReplaceAllString(cleaned, "-")
-	
-	// Trim dashes from start and end
-	cleaned = strings.Trim(cleaned, "-")
-	
-	return cleaned
-}
\ No newline at end of file
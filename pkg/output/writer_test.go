@@ -0,0 +1,61 @@
+package output
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+func TestResolveFolderNameCollisions(t *testing.T) {
+	long := strings.Repeat("Quarterly report ", 20)
+	tests := []struct {
+		name    string
+		subject string
+	}{
+		{"short subject", "Invoice 42"},
+		{"long subject", long},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writer, outputDir := newTestWriter(t, OutputFiles, Options{})
+			w := writer.(*FileWriter)
+
+			newEmail := func(id string) *interfaces.EmailMessage {
+				return &interfaces.EmailMessage{ID: id, Subject: test.subject, Date: "Thu, 1 Aug 2024 04:39:03 +0000", Body: "Body of " + id}
+			}
+			first, second := newEmail("18c2f0a1b2c3d4e5"), newEmail("18c2f0a1b2c3d4f6")
+
+			base := w.resolveFolderName(first, outputDir)
+			if err := w.WriteEmail(context.Background(), first, outputDir); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.resolveFolderName(first, outputDir); got != base {
+				t.Errorf("the same email resolves to %q, want its own folder %q", got, base)
+			}
+
+			got := w.resolveFolderName(second, outputDir)
+			if !strings.HasSuffix(got, "_"+second.ID) {
+				t.Errorf("colliding email resolves to %q, want the message ID appended", got)
+			}
+			if len(filepath.Base(got)) > maxFilenameBytes {
+				t.Errorf("folder name %q is longer than %d bytes", got, maxFilenameBytes)
+			}
+			if err := w.WriteEmail(context.Background(), second, outputDir); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, email := range []*interfaces.EmailMessage{first, second} {
+				folder, ok := w.index.Lookup(email.ID)
+				if !ok {
+					t.Fatalf("email %s is not indexed", email.ID)
+				}
+				if id := folderEmailID(filepath.Join(outputDir, folder)); id != email.ID {
+					t.Errorf("folder %s holds email %q, want %s", folder, id, email.ID)
+				}
+			}
+		})
+	}
+}
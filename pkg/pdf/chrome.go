@@ -0,0 +1,94 @@
+package pdf
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+// chromeCandidates are the Chrome and Chromium executables looked up in PATH
+// when CHROME_PATH is not set
+var chromeCandidates = []string{
+	"chromium", "chromium-browser", "google-chrome", "google-chrome-stable", "chrome",
+	"/Applications/Google Chrome.app/Contents/MacOS/Google Chrome",
+	"/Applications/Chromium.app/Contents/MacOS/Chromium",
+}
+
+// renderTimeout bounds one conversion: starting Chrome and printing the
+// local page with the files it references
+const renderTimeout = 60 * time.Second
+
+// ChromeRenderer converts HTML pages to PDF with headless Chrome or Chromium
+type ChromeRenderer struct {
+	binary    string
+	noSandbox bool
+}
+
+// NoSandboxEnv is the environment variable that, set to "true", runs Chrome
+// without its sandbox. Chrome refuses to start as root otherwise, e.g. in a
+// container, but the sandbox is what contains a page that exploits it.
+const NoSandboxEnv = "CHROME_NO_SANDBOX"
+
+// NewChromeRenderer finds a Chrome or Chromium executable, preferring the
+// CHROME_PATH environment variable. Running as root requires NoSandboxEnv.
+func NewChromeRenderer() (interfaces.PDFRenderer, error) {
+	noSandbox := os.Getenv(NoSandboxEnv) == "true"
+	if os.Geteuid() == 0 && !noSandbox {
+		return nil, fmt.Errorf("Chrome cannot print PDFs as root with its sandbox enabled, run as another user or set %s=true to disable the sandbox", NoSandboxEnv)
+	}
+
+	if binary := os.Getenv("CHROME_PATH"); binary != "" {
+		if _, err := exec.LookPath(binary); err != nil {
+			return nil, fmt.Errorf("CHROME_PATH is not executable: %v", err)
+		}
+		return &ChromeRenderer{binary: binary, noSandbox: noSandbox}, nil
+	}
+
+	for _, candidate := range chromeCandidates {
+		if binary, err := exec.LookPath(candidate); err == nil {
+			return &ChromeRenderer{binary: binary, noSandbox: noSandbox}, nil
+		}
+	}
+	return nil, fmt.Errorf("PDF output needs Chrome or Chromium, none was found in PATH (set CHROME_PATH to its executable)")
+}
+
+// RenderPDF prints the page at htmlPath to pdfPath
+func (r *ChromeRenderer) RenderPDF(ctx context.Context, htmlPath, pdfPath string) error {
+	htmlPath, err := filepath.Abs(htmlPath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve page path: %v", err)
+	}
+	pdfPath, err = filepath.Abs(pdfPath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve PDF path: %v", err)
+	}
+	pageURL := (&url.URL{Scheme: "file", Path: filepath.ToSlash(htmlPath)}).String()
+
+	renderCtx, cancel := context.WithTimeout(ctx, renderTimeout)
+	defer cancel()
+
+	// Printable pages need no scripts, keep them off even though the body is sanitized
+	args := []string{"--headless", "--disable-gpu", "--no-pdf-header-footer",
+		"--blink-settings=scriptEnabled=false", "--print-to-pdf=" + pdfPath}
+	if r.noSandbox {
+		args = append(args, "--no-sandbox")
+	}
+	args = append(args, pageURL)
+
+	out, err := exec.CommandContext(renderCtx, r.binary, args...).CombinedOutput()
+	if err != nil {
+		os.Remove(pdfPath)
+		return fmt.Errorf("chrome failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if info, err := os.Stat(pdfPath); err != nil || info.Size() == 0 {
+		return fmt.Errorf("chrome did not write %s", pdfPath)
+	}
+	return nil
+}
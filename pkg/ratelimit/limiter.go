@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Gmail API quota costs per method, in quota units
+// See https://developers.google.com/gmail/api/reference/quota
+const (
+	DefaultUnitsPerSecond = 250
+
+	CostMessagesList   = 5
+	CostMessagesGet    = 5
+	CostAttachmentsGet = 5
+	CostThreadsList    = 10
+	CostThreadsGet     = 10
+	CostHistoryList    = 2
+	CostGetProfile     = 1
+	CostLabelsList     = 1
+	CostLabelsGet      = 1
+)
+
+// Limiter is a token bucket measured in Gmail quota units. It is safe for
+// concurrent use and adapts its rate additively-increase/multiplicatively-decrease
+// style: Backoff halves the rate after a 429, Success slowly restores it.
+type Limiter struct {
+	mu          sync.Mutex
+	maxRate     float64
+	minRate     float64
+	rate        float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+// NewLimiter creates a limiter allowing unitsPerSecond quota units per second
+// with a burst of one second's worth of units
+func NewLimiter(unitsPerSecond float64) *Limiter {
+	return &Limiter{
+		maxRate: unitsPerSecond,
+		minRate: unitsPerSecond / 32,
+		rate:    unitsPerSecond,
+		tokens:  unitsPerSecond,
+		last:    time.Now(),
+	}
+}
+
+// Wait blocks until units quota units are available or ctx is done
+func (l *Limiter) Wait(ctx context.Context, units int) error {
+	for {
+		delay := l.reserve(float64(units))
+		if delay <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reserve takes the units if available and otherwise returns how long to
+// wait before trying again
+func (l *Limiter) reserve(units float64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	// A request larger than the bucket can still go once the bucket is full
+	if l.tokens >= units || l.tokens >= l.rate {
+		l.tokens -= units
+		return 0
+	}
+
+	return time.Duration((units - l.tokens) / l.rate * float64(time.Second))
+}
+
+// Backoff halves the rate and pauses all callers briefly, used when Gmail
+// answers with a rate limit error
+func (l *Limiter) Backoff() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate /= 2
+	if l.rate < l.minRate {
+		l.rate = l.minRate
+	}
+	l.tokens = 0
+	l.pausedUntil = time.Now().Add(time.Second)
+}
+
+// Success nudges the rate back towards the maximum after a successful call
+func (l *Limiter) Success() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate += l.maxRate / 100
+	if l.rate > l.maxRate {
+		l.rate = l.maxRate
+	}
+}
+
+// Rate returns the current rate in quota units per second
+func (l *Limiter) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
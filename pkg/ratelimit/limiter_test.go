@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiterBurst(t *testing.T) {
+	l := NewLimiter(100)
+	if delay := l.reserve(100); delay > 0 {
+		t.Fatalf("a full bucket made the first request wait %v", delay)
+	}
+	// The bucket is empty, 50 units take about half a second to refill
+	delay := l.reserve(50)
+	if delay < 400*time.Millisecond || delay > 500*time.Millisecond {
+		t.Errorf("reserve(50) on an empty bucket waits %v, want about 500ms", delay)
+	}
+}
+
+func TestLimiterBackoff(t *testing.T) {
+	tests := []struct {
+		backoffs  int
+		successes int
+		want      float64
+	}{
+		{backoffs: 1, want: 50},
+		{backoffs: 2, want: 25},
+		// The rate never drops below 1/32 of the maximum
+		{backoffs: 10, want: 100.0 / 32},
+		// Each success restores 1% of the maximum, up to the maximum
+		{backoffs: 1, successes: 10, want: 60},
+		{backoffs: 1, successes: 200, want: 100},
+	}
+	for _, test := range tests {
+		l := NewLimiter(100)
+		for i := 0; i < test.backoffs; i++ {
+			l.Backoff()
+		}
+		for i := 0; i < test.successes; i++ {
+			l.Success()
+		}
+		if got := l.Rate(); got < test.want-0.001 || got > test.want+0.001 {
+			t.Errorf("after %d backoffs and %d successes the rate is %v, want %v", test.backoffs, test.successes, got, test.want)
+		}
+	}
+}
+
+func TestLimiterBackoffPausesCallers(t *testing.T) {
+	l := NewLimiter(100)
+	l.Backoff()
+
+	// Even a one unit request waits for the pause to end
+	if delay := l.reserve(1); delay < 900*time.Millisecond {
+		t.Errorf("reserve(1) right after a backoff waits %v, want about a second", delay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait during the pause returned %v, want the context error", err)
+	}
+}
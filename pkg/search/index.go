@@ -0,0 +1,697 @@
+package search
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+	"github.com/perarneng/getgmail/pkg/output"
+)
+
+// IndexDirName is the directory below the output directory holding the
+// search index. index.json and its postings file are written by `getgmail
+// index`, and emails saved afterwards are appended to pending.jsonl until the
+// next rebuild.
+//
+// The index is a plain inverted index rather than an embedded engine such as
+// bleve or SQLite FTS5: bleve pulls in a large dependency tree and FTS5 needs
+// cgo, while the archive only needs term, prefix and field matching.
+const IndexDirName = ".getgmail_search"
+
+const (
+	indexFileName   = "index.json"
+	pendingFileName = "pending.jsonl"
+	indexVersion    = 3
+
+	// rotatedPendingPattern matches pending logs set aside by Build
+	rotatedPendingPattern = "pending-*.jsonl"
+	// postingsPattern matches the postings files of index.json, a new one
+	// is written by every build
+	postingsPattern = "postings-*.json"
+
+	// postingShards is the number of separately readable parts of the
+	// postings file. Terms are assigned by their first shardKeyLength
+	// characters, so a prefix of that length is found in a single shard.
+	postingShards  = 256
+	shardKeyLength = 2
+)
+
+// Searchable fields. Terms without a field match any of them.
+const (
+	FieldSubject    = "subject"
+	FieldFrom       = "from"
+	FieldTo         = "to"
+	FieldBody       = "body"
+	FieldAttachment = "attachment"
+	FieldLabel      = "label"
+)
+
+// maxTermLength drops tokens of more characters, which are mostly encoded
+// data and URLs
+const maxTermLength = 40
+
+// Document is an indexed email. Folder and TextFile are relative to the
+// output directory.
+type Document struct {
+	ID          string   `json:"id"`
+	ThreadID    string   `json:"threadId,omitempty"`
+	Folder      string   `json:"folder"`
+	TextFile    string   `json:"textFile,omitempty"`
+	Subject     string   `json:"subject"`
+	From        string   `json:"from"`
+	To          string   `json:"to"`
+	Date        int64    `json:"date"` // Unix milliseconds
+	Labels      []string `json:"labels,omitempty"`
+	Attachments []string `json:"attachments,omitempty"`
+	Snippet     string   `json:"snippet,omitempty"`
+}
+
+// Time returns the date of the email
+func (d Document) Time() time.Time {
+	return time.UnixMilli(d.Date)
+}
+
+// indexFile is the layout of index.json: the documents, and the postings
+// file with the byte range of each shard in it. A shard holds, per field,
+// the ascending document numbers each of its terms occurs in.
+type indexFile struct {
+	Version  int        `json:"version"`
+	Docs     []Document `json:"docs"`
+	Postings string     `json:"postings"`
+	Shards   [][2]int64 `json:"shards"`
+}
+
+// postings are the document numbers of each term, per field
+type postings map[string]map[string][]int
+
+// pendingEntry is one line of pending.jsonl, an email saved after the index
+// was built, with its terms per field
+type pendingEntry struct {
+	Doc   Document            `json:"doc"`
+	Terms map[string][]string `json:"terms"`
+}
+
+// Index is a search index. The documents are held in memory, the postings
+// of a loaded index are read from its postings file one shard at a time as
+// searches need them.
+type Index struct {
+	docs     []Document
+	byID     map[string]int
+	replaced map[int]bool
+
+	// postings of the documents added in memory, by a build or from the
+	// pending logs
+	postings postings
+
+	// postingsPath and shardRanges locate the stored shards, shards caches
+	// the ones read so far
+	postingsPath string
+	shardRanges  [][2]int64
+	shards       map[int]postings
+}
+
+func newIndex() *Index {
+	return &Index{
+		postings: make(postings),
+		byID:     make(map[string]int),
+		replaced: make(map[int]bool),
+		shards:   make(map[int]postings),
+	}
+}
+
+// add appends a document. A document with the same message ID replaces the
+// earlier one.
+func (idx *Index) add(doc Document, terms map[string][]string) {
+	if n, ok := idx.byID[doc.ID]; ok {
+		idx.replaced[n] = true
+	}
+	n := len(idx.docs)
+	idx.docs = append(idx.docs, doc)
+	idx.byID[doc.ID] = n
+
+	for field, list := range terms {
+		postings := idx.postings[field]
+		if postings == nil {
+			postings = make(map[string][]int)
+			idx.postings[field] = postings
+		}
+		for _, term := range list {
+			postings[term] = append(postings[term], n)
+		}
+	}
+}
+
+// Len returns the number of indexed emails
+func (idx *Index) Len() int {
+	return len(idx.docs) - len(idx.replaced)
+}
+
+// Exists reports whether the output directory has a search index
+func Exists(outputDir string) bool {
+	_, err := os.Stat(filepath.Join(outputDir, IndexDirName, indexFileName))
+	return err == nil
+}
+
+// Load reads the documents of the search index of an output directory,
+// including the emails saved since it was built. Posting lists are read by
+// Search, only from the shards holding the terms of the query.
+func Load(outputDir string) (*Index, error) {
+	dir := filepath.Join(outputDir, IndexDirName)
+	data, err := os.ReadFile(filepath.Join(dir, indexFileName))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no search index in %s, run `getgmail index` first", outputDir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read search index: %v", err)
+	}
+
+	var file indexFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse search index: %v", err)
+	}
+	if file.Version != indexVersion {
+		return nil, fmt.Errorf("search index version %d is not supported, run `getgmail index` to rebuild it", file.Version)
+	}
+
+	if len(file.Shards) != postingShards || file.Postings != filepath.Base(file.Postings) {
+		return nil, fmt.Errorf("failed to parse search index: invalid postings file")
+	}
+
+	idx := newIndex()
+	idx.docs = file.Docs
+	for n, doc := range idx.docs {
+		idx.byID[doc.ID] = n
+	}
+	idx.postingsPath = filepath.Join(dir, file.Postings)
+	idx.shardRanges = file.Shards
+
+	logs, err := pendingLogs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range logs {
+		if err := idx.addPending(path); err != nil {
+			return nil, err
+		}
+	}
+	return idx, nil
+}
+
+// termShard returns the shard of the postings file a term is stored in
+func termShard(term string) int {
+	key := []rune(term)
+	if len(key) > shardKeyLength {
+		key = key[:shardKeyLength]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(string(key)))
+	return int(h.Sum32() % postingShards)
+}
+
+// shard returns the stored postings of a shard, reading them on first use
+func (idx *Index) shard(n int) (postings, error) {
+	if idx.postingsPath == "" {
+		return nil, nil
+	}
+	if shard, ok := idx.shards[n]; ok {
+		return shard, nil
+	}
+
+	f, err := os.Open(idx.postingsPath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("the search index was rebuilt during the search, run it again")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read search index: %v", err)
+	}
+	defer f.Close()
+
+	var shard postings
+	section := io.NewSectionReader(f, idx.shardRanges[n][0], idx.shardRanges[n][1])
+	if err := json.NewDecoder(section).Decode(&shard); err != nil {
+		return nil, fmt.Errorf("failed to parse search index: %v", err)
+	}
+	idx.shards[n] = shard
+	return shard, nil
+}
+
+// loadPostings reads every stored shard into the in-memory postings. The
+// stored documents come first, so the lists stay in ascending order.
+func (idx *Index) loadPostings() error {
+	if idx.postingsPath == "" {
+		return nil
+	}
+	all := make(postings)
+	for n := 0; n < postingShards; n++ {
+		shard, err := idx.shard(n)
+		if err != nil {
+			return err
+		}
+		all.merge(shard)
+	}
+	all.merge(idx.postings)
+
+	idx.postings = all
+	idx.postingsPath = ""
+	idx.shardRanges = nil
+	idx.shards = make(map[int]postings)
+	return nil
+}
+
+// merge appends the lists of other to p
+func (p postings) merge(other postings) {
+	for field, terms := range other {
+		if p[field] == nil {
+			p[field] = make(map[string][]int)
+		}
+		for term, list := range terms {
+			p[field][term] = append(p[field][term], list...)
+		}
+	}
+}
+
+// pendingLogs returns the pending logs of the index directory, oldest first:
+// logs set aside by a running or interrupted Build, then pending.jsonl
+func pendingLogs(dir string) ([]string, error) {
+	rotated, err := filepath.Glob(filepath.Join(dir, rotatedPendingPattern))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pending search entries: %v", err)
+	}
+	sort.Strings(rotated)
+	return append(rotated, filepath.Join(dir, pendingFileName)), nil
+}
+
+// addPending adds the entries of a pending log, if it exists
+func (idx *Index) addPending(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read search index: %v", err)
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var entry pendingEntry
+		if err := decoder.Decode(&entry); err != nil {
+			// io.EOF, or a line cut short by an interrupted write, ends the log
+			return nil
+		}
+		idx.add(entry.Doc, entry.Terms)
+	}
+}
+
+// rotatePending moves pending.jsonl aside, so emails saved from now on go to
+// a new log, and returns the path it was moved to
+func rotatePending(dir string) (string, error) {
+	rotated := filepath.Join(dir, fmt.Sprintf("pending-%d.jsonl", time.Now().UnixNano()))
+	err := os.Rename(filepath.Join(dir, pendingFileName), rotated)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to rotate pending search entries: %v", err)
+	}
+	return rotated, nil
+}
+
+// BuildResult summarizes a rebuilt search index
+type BuildResult struct {
+	Emails int
+	Terms  int
+}
+
+// Build indexes every email saved below outputDir, replacing any existing
+// index. Only the files output format writes the metadata it reads.
+//
+// Emails a concurrent download saves are not lost: the pending log is set
+// aside before the walk, which covers everything in it, and the entries
+// logged during the walk are merged in before the index is saved.
+func Build(logger interfaces.Logger, outputDir string) (BuildResult, error) {
+	dir := filepath.Join(outputDir, IndexDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return BuildResult{}, fmt.Errorf("failed to create search index directory: %v", err)
+	}
+	if _, err := rotatePending(dir); err != nil {
+		return BuildResult{}, err
+	}
+
+	idx := newIndex()
+	root := filepath.Clean(outputDir)
+	err := filepath.WalkDir(outputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			switch d.Name() {
+			case output.AttachmentStoreDir, output.SiteDirName, output.StagingDirName, IndexDirName:
+				if filepath.Dir(path) == root {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if !strings.HasSuffix(d.Name(), "_metadata.json") {
+			return nil
+		}
+
+		doc, err := output.ReadSearchDocument(logger, outputDir, path)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("Skipping %s: %v", path, err))
+			return nil
+		}
+		if _, ok := idx.byID[doc.ID]; ok {
+			logger.Warn(fmt.Sprintf("Skipping %s: email %s is already indexed", path, doc.ID))
+			return nil
+		}
+		idx.add(newDocument(doc), documentTerms(doc))
+		return nil
+	})
+	if err != nil {
+		return BuildResult{}, fmt.Errorf("failed to scan metadata files: %v", err)
+	}
+
+	// Emails saved during the walk; the ones it already found are replaced
+	// by their logged copy
+	merged, err := rotatePending(dir)
+	if err != nil {
+		return BuildResult{}, err
+	}
+	if merged != "" {
+		if err := idx.addPending(merged); err != nil {
+			return BuildResult{}, err
+		}
+	}
+
+	if err := idx.save(dir); err != nil {
+		return BuildResult{}, err
+	}
+
+	result := BuildResult{Emails: idx.Len()}
+	terms := make(map[string]bool)
+	for _, postings := range idx.postings {
+		for term := range postings {
+			terms[term] = true
+		}
+	}
+	result.Terms = len(terms)
+	return result, nil
+}
+
+// save compacts the index, writes a new postings file and index.json, and
+// removes the older postings files and the rotated pending logs it now
+// includes. pending.jsonl, which emails saved after the last rotation went
+// to, is kept.
+func (idx *Index) save(dir string) error {
+	if err := idx.loadPostings(); err != nil {
+		return err
+	}
+	idx.compact()
+
+	postingsName, shards, err := idx.writePostings(dir)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(indexFile{Version: indexVersion, Docs: idx.docs, Postings: postingsName, Shards: shards})
+	if err != nil {
+		return fmt.Errorf("failed to encode search index: %v", err)
+	}
+	tmpPath := filepath.Join(dir, indexFileName+".tmp")
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write search index: %v", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dir, indexFileName)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write search index: %v", err)
+	}
+
+	// Searches that loaded the previous index.json fail rather than read
+	// the new postings with the old document numbers
+	old, err := filepath.Glob(filepath.Join(dir, postingsPattern))
+	if err != nil {
+		return fmt.Errorf("failed to clear old search postings: %v", err)
+	}
+	for _, path := range old {
+		if filepath.Base(path) == postingsName {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to clear old search postings: %v", err)
+		}
+	}
+
+	rotated, err := filepath.Glob(filepath.Join(dir, rotatedPendingPattern))
+	if err != nil {
+		return fmt.Errorf("failed to clear pending search entries: %v", err)
+	}
+	for _, path := range rotated {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to clear pending search entries: %v", err)
+		}
+	}
+	return nil
+}
+
+// writePostings writes the postings, split into shards, to a new postings
+// file and returns its name and the byte range of each shard
+func (idx *Index) writePostings(dir string) (string, [][2]int64, error) {
+	shards := make([]postings, postingShards)
+	for field, terms := range idx.postings {
+		for term, list := range terms {
+			n := termShard(term)
+			if shards[n] == nil {
+				shards[n] = make(postings)
+			}
+			if shards[n][field] == nil {
+				shards[n][field] = make(map[string][]int)
+			}
+			shards[n][field][term] = list
+		}
+	}
+
+	var data []byte
+	ranges := make([][2]int64, postingShards)
+	for n, shard := range shards {
+		encoded, err := json.Marshal(shard)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to encode search index: %v", err)
+		}
+		ranges[n] = [2]int64{int64(len(data)), int64(len(encoded))}
+		data = append(data, encoded...)
+		data = append(data, '\n')
+	}
+
+	name := fmt.Sprintf("postings-%d.json", time.Now().UnixNano())
+	tmpPath := filepath.Join(dir, name+".tmp")
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return "", nil, fmt.Errorf("failed to write search index: %v", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dir, name)); err != nil {
+		os.Remove(tmpPath)
+		return "", nil, fmt.Errorf("failed to write search index: %v", err)
+	}
+	return name, ranges, nil
+}
+
+// compact drops replaced documents and renumbers the postings
+func (idx *Index) compact() {
+	if len(idx.replaced) == 0 {
+		return
+	}
+	renumbered := make([]int, len(idx.docs))
+	var docs []Document
+	for n, doc := range idx.docs {
+		if idx.replaced[n] {
+			renumbered[n] = -1
+			continue
+		}
+		renumbered[n] = len(docs)
+		docs = append(docs, doc)
+	}
+
+	for _, postings := range idx.postings {
+		for term, list := range postings {
+			kept := list[:0]
+			for _, n := range list {
+				if renumbered[n] >= 0 {
+					kept = append(kept, renumbered[n])
+				}
+			}
+			if len(kept) == 0 {
+				delete(postings, term)
+			} else {
+				postings[term] = kept
+			}
+		}
+	}
+
+	idx.docs = docs
+	idx.byID = make(map[string]int, len(docs))
+	for n, doc := range docs {
+		idx.byID[doc.ID] = n
+	}
+	idx.replaced = make(map[int]bool)
+}
+
+// Indexer appends saved emails to the pending log of an existing search index
+type Indexer struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewIndexer creates the indexer that keeps the search index of outputDir
+// current as emails are saved
+func NewIndexer(outputDir string) interfaces.SearchIndexer {
+	return &Indexer{path: filepath.Join(outputDir, IndexDirName, pendingFileName)}
+}
+
+// AddDocument appends an email to the pending log
+func (i *Indexer) AddDocument(doc interfaces.SearchDocument) error {
+	data, err := json.Marshal(pendingEntry{Doc: newDocument(doc), Terms: documentTerms(doc)})
+	if err != nil {
+		return fmt.Errorf("failed to encode search entry: %v", err)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	f, err := os.OpenFile(i.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open search index: %v", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write search index: %v", err)
+	}
+	return f.Close()
+}
+
+func newDocument(doc interfaces.SearchDocument) Document {
+	return Document{
+		ID:          doc.ID,
+		ThreadID:    doc.ThreadID,
+		Folder:      filepath.ToSlash(doc.Folder),
+		TextFile:    filepath.ToSlash(doc.TextFile),
+		Subject:     doc.Subject,
+		From:        doc.From,
+		To:          doc.To,
+		Date:        doc.Date.UnixMilli(),
+		Labels:      doc.Labels,
+		Attachments: doc.Attachments,
+		Snippet:     doc.Snippet,
+	}
+}
+
+// documentTerms returns the distinct terms of each field of an email
+func documentTerms(doc interfaces.SearchDocument) map[string][]string {
+	terms := map[string][]string{
+		FieldSubject:    uniqueTerms(doc.Subject),
+		FieldFrom:       uniqueTerms(doc.From),
+		FieldTo:         uniqueTerms(doc.To),
+		FieldBody:       uniqueTerms(doc.Body),
+		FieldAttachment: uniqueTerms(strings.Join(doc.Attachments, " ")),
+		FieldLabel:      uniqueTerms(strings.Join(doc.Labels, " ")),
+	}
+	for field, list := range terms {
+		if len(list) == 0 {
+			delete(terms, field)
+		}
+	}
+	return terms
+}
+
+func uniqueTerms(text string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, term := range Tokenize(text) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	sort.Strings(terms)
+	return terms
+}
+
+// Tokenize splits text into lower-case terms at anything that is not a
+// letter or digit, folding accents so "café" matches "cafe". Chinese,
+// Japanese and Korean text, which is not split by spaces, is indexed as
+// overlapping pairs of characters, so "東京都" yields "東京" and "京都".
+func Tokenize(text string) []string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.Predicate(isAccent)), norm.NFC)
+	if folded, _, err := transform.String(t, text); err == nil {
+		text = folded
+	}
+
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		for _, run := range splitCJK([]rune(word)) {
+			switch {
+			case !isCJK(run[0]):
+				if len(run) <= maxTermLength {
+					terms = append(terms, string(run))
+				}
+			case len(run) == 1:
+				terms = append(terms, string(run))
+			default:
+				for i := 0; i+1 < len(run); i++ {
+					terms = append(terms, string(run[i:i+2]))
+				}
+			}
+		}
+	}
+	return terms
+}
+
+// isAccent reports whether r is a combining mark Tokenize drops. The kana
+// voicing marks are kept, they tell apart different syllables.
+func isAccent(r rune) bool {
+	return unicode.Is(unicode.Mn, r) && r != '\u3099' && r != '\u309a'
+}
+
+// isCJK reports whether r belongs to a script written without spaces
+// between words
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// splitCJK splits a word into runs of CJK and of other characters
+func splitCJK(word []rune) [][]rune {
+	var runs [][]rune
+	start := 0
+	for i := 1; i <= len(word); i++ {
+		if i == len(word) || isCJK(word[i]) != isCJK(word[start]) {
+			runs = append(runs, word[start:i])
+			start = i
+		}
+	}
+	return runs
+}
+
+// isCJKCharacter reports whether a term is a single CJK character. The index
+// holds character pairs, so such a term is matched as a prefix.
+func isCJKCharacter(term string) bool {
+	r, size := utf8.DecodeRuneInString(term)
+	return size == len(term) && isCJK(r)
+}
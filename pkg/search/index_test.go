@@ -0,0 +1,184 @@
+package search
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Info(string)  {}
+func (nopLogger) Error(string) {}
+func (nopLogger) Warn(string)  {}
+func (nopLogger) Debug(string) {}
+
+func searchIDs(t *testing.T, idx *Index, query string) []string {
+	t.Helper()
+	parsed, err := ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits, err := idx.Search(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, doc := range hits {
+		ids = append(ids, doc.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestLoadPendingLogs(t *testing.T) {
+	outputDir := t.TempDir()
+	if _, err := Build(nopLogger{}, outputDir); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(outputDir, IndexDirName)
+	indexer := NewIndexer(outputDir)
+	date := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+	// A log set aside by an interrupted build, then entries saved since
+	if err := indexer.AddDocument(interfaces.SearchDocument{ID: "a", Subject: "Quarterly report draft", Date: date}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotatePending(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, doc := range []interfaces.SearchDocument{
+		{ID: "a", Subject: "Quarterly report final", Date: date},
+		{ID: "b", Subject: "Another report", Date: date},
+	} {
+		if err := indexer.AddDocument(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A line cut short by an interrupted write
+	f, err := os.OpenFile(filepath.Join(dir, pendingFileName), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"doc":{"id":"c","subj`)
+	f.Close()
+
+	idx, err := Load(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := searchIDs(t, idx, "report"), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("report matched %v, want %v", got, want)
+	}
+	if got := searchIDs(t, idx, "draft"); len(got) != 0 {
+		t.Errorf("the replaced entry still matches: %v", got)
+	}
+
+	// Saving compacts the replaced entry away and clears the rotated log
+	if err := idx.save(dir); err != nil {
+		t.Fatal(err)
+	}
+	if rotated, _ := filepath.Glob(filepath.Join(dir, rotatedPendingPattern)); len(rotated) != 0 {
+		t.Errorf("rotated logs were kept: %v", rotated)
+	}
+	if len(idx.docs) != 2 || idx.Len() != 2 {
+		t.Errorf("saved %d documents with %d live, want 2", len(idx.docs), idx.Len())
+	}
+	os.Remove(filepath.Join(dir, pendingFileName))
+
+	reloaded, err := Load(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := searchIDs(t, reloaded, "quarterly"), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("quarterly matched %v after saving, want %v", got, want)
+	}
+	if got := searchIDs(t, reloaded, "draft"); len(got) != 0 {
+		t.Errorf("the replaced entry matches after saving: %v", got)
+	}
+}
+
+func TestRebuildAndPendingLog(t *testing.T) {
+	outputDir := t.TempDir()
+	if _, err := Build(nopLogger{}, outputDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// A logged email whose folder was deleted since is dropped by a rebuild,
+	// which starts from the emails on disk
+	indexer := NewIndexer(outputDir)
+	if err := indexer.AddDocument(interfaces.SearchDocument{ID: "gone", Subject: "Deleted"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Build(nopLogger{}, outputDir); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := Load(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.Len() != 0 {
+		t.Errorf("rebuild kept %d emails that are not on disk", idx.Len())
+	}
+
+	// Emails logged after a build are picked up by the next search
+	if err := indexer.AddDocument(interfaces.SearchDocument{ID: "new", Subject: "Fresh"}); err != nil {
+		t.Fatal(err)
+	}
+	idx, err = Load(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := searchIDs(t, idx, "fresh"), []string{"new"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fresh matched %v, want %v", got, want)
+	}
+}
+
+func TestLoadReadsShardsOnDemand(t *testing.T) {
+	outputDir := t.TempDir()
+	dir := filepath.Join(outputDir, IndexDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	idx := newIndex()
+	for _, doc := range []interfaces.SearchDocument{
+		{ID: "a", Subject: "Invoice for January", Body: "Thank you for your payment"},
+		{ID: "b", Subject: "Lunch", Body: "Meet near the office"},
+	} {
+		idx.add(newDocument(doc), documentTerms(doc))
+	}
+	// Saving twice leaves only the postings file of the second save
+	for i := 0; i < 2; i++ {
+		if err := idx.save(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, postingsPattern)); len(files) != 1 {
+		t.Errorf("expected one postings file, got %v", files)
+	}
+
+	loaded, err := Load(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.shards) != 0 {
+		t.Errorf("Load read %d shards, want none", len(loaded.shards))
+	}
+	if got, want := searchIDs(t, loaded, "invoice"), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("invoice matched %v, want %v", got, want)
+	}
+	if len(loaded.shards) != 1 {
+		t.Errorf("a one-term search read %d shards, want 1", len(loaded.shards))
+	}
+	if got, want := searchIDs(t, loaded, "of*"), []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("of* matched %v, want %v", got, want)
+	}
+	if got, want := searchIDs(t, loaded, "p*"), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("p* matched %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,361 @@
+package search
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// queryFields maps the field filters of a query to index fields
+var queryFields = map[string]string{
+	"subject":    FieldSubject,
+	"from":       FieldFrom,
+	"to":         FieldTo,
+	"body":       FieldBody,
+	"attachment": FieldAttachment,
+	"filename":   FieldAttachment,
+	"label":      FieldLabel,
+	"in":         FieldLabel,
+}
+
+// queryDateFormats are the accepted values of before: and after:
+var queryDateFormats = []string{"2006-01-02", "2006/01/02"}
+
+// maxSnippetLength bounds the text shown for a hit, in characters
+const maxSnippetLength = 160
+
+// Query is a parsed search query. All clauses have to match.
+type Query struct {
+	clauses []clause
+}
+
+// clause is one condition of a query: terms in a field, a date bound or an
+// attachment check
+type clause struct {
+	negate bool
+
+	// field is empty for terms matching any field
+	field string
+	terms []string
+	// prefix makes the last term match any term starting with it
+	prefix bool
+
+	before        time.Time
+	after         time.Time
+	hasAttachment bool
+}
+
+// ParseQuery parses a query such as
+//
+//	invoice from:billing@example.com after:2024-01-01 -label:spam
+//
+// Words match any field, field:value matches one field, a leading - excludes
+// matches, "quoted values" may contain spaces and a trailing * matches
+// prefixes. before: and after: take a YYYY-MM-DD date, has:attachment
+// matches emails with attachments.
+func ParseQuery(text string) (*Query, error) {
+	query := &Query{}
+	for _, word := range splitQuery(text) {
+		c := clause{}
+		if strings.HasPrefix(word, "-") && len(word) > 1 {
+			c.negate = true
+			word = word[1:]
+		}
+
+		value := word
+		if name, rest, ok := strings.Cut(word, ":"); ok && rest != "" {
+			switch name = strings.ToLower(name); name {
+			case "before", "after":
+				date, err := parseQueryDate(rest)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s: date %q, expected YYYY-MM-DD", name, rest)
+				}
+				if name == "before" {
+					c.before = date
+				} else {
+					c.after = date
+				}
+				query.clauses = append(query.clauses, c)
+				continue
+			case "has":
+				if v := strings.ToLower(rest); v != "attachment" && v != "attachments" {
+					return nil, fmt.Errorf("invalid has:%s, only has:attachment is supported", rest)
+				}
+				c.hasAttachment = true
+				query.clauses = append(query.clauses, c)
+				continue
+			default:
+				if field, ok := queryFields[name]; ok {
+					c.field = field
+					value = rest
+				}
+			}
+		}
+
+		c.prefix = strings.HasSuffix(value, "*")
+		c.terms = Tokenize(value)
+		if len(c.terms) == 0 {
+			continue
+		}
+		query.clauses = append(query.clauses, c)
+	}
+
+	if len(query.clauses) == 0 {
+		return nil, fmt.Errorf("empty search query")
+	}
+	return query, nil
+}
+
+// splitQuery splits a query at spaces outside double quotes, dropping the quotes
+func splitQuery(text string) []string {
+	var words []string
+	var word strings.Builder
+	quoted := false
+	for _, r := range text {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if word.Len() > 0 {
+				words = append(words, word.String())
+				word.Reset()
+			}
+		default:
+			word.WriteRune(r)
+		}
+	}
+	if word.Len() > 0 {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+func parseQueryDate(value string) (time.Time, error) {
+	for _, format := range queryDateFormats {
+		if t, err := time.ParseInLocation(format, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+// Search returns the emails matching query, newest first
+func (idx *Index) Search(query *Query) ([]Document, error) {
+	// Start from the documents of the term clauses, the other conditions filter them
+	var candidates map[int]bool
+	var excluded []map[int]bool
+	for _, c := range query.clauses {
+		if len(c.terms) == 0 {
+			continue
+		}
+		matches, err := idx.match(c)
+		if err != nil {
+			return nil, err
+		}
+		if c.negate {
+			excluded = append(excluded, matches)
+			continue
+		}
+		if candidates == nil {
+			candidates = matches
+			continue
+		}
+		for n := range candidates {
+			if !matches[n] {
+				delete(candidates, n)
+			}
+		}
+	}
+	if candidates == nil {
+		candidates = make(map[int]bool, len(idx.docs))
+		for n := range idx.docs {
+			candidates[n] = true
+		}
+	}
+
+	var hits []Document
+	for n := range candidates {
+		if idx.replaced[n] || isExcluded(n, excluded) || !matchesFilters(idx.docs[n], query.clauses) {
+			continue
+		}
+		hits = append(hits, idx.docs[n])
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		return hits[i].Date > hits[j].Date
+	})
+	return hits, nil
+}
+
+// match returns the documents containing all terms of a clause
+func (idx *Index) match(c clause) (map[int]bool, error) {
+	var result map[int]bool
+	for i, term := range c.terms {
+		prefix := c.prefix && i == len(c.terms)-1 || isCJKCharacter(term)
+
+		// A prefix shorter than the shard key may be in any shard
+		shards := []int{termShard(term)}
+		if prefix && utf8.RuneCountInString(term) < shardKeyLength {
+			shards = shards[:0]
+			for n := 0; n < postingShards; n++ {
+				shards = append(shards, n)
+			}
+		}
+
+		docs := make(map[int]bool)
+		for _, n := range shards {
+			stored, err := idx.shard(n)
+			if err != nil {
+				return nil, err
+			}
+			matchTerm(docs, stored, c.field, term, prefix)
+		}
+		matchTerm(docs, idx.postings, c.field, term, prefix)
+
+		if result == nil {
+			result = docs
+			continue
+		}
+		for n := range result {
+			if !docs[n] {
+				delete(result, n)
+			}
+		}
+	}
+	return result, nil
+}
+
+// matchTerm adds the documents holding term in field, or in any field when
+// field is empty
+func matchTerm(docs map[int]bool, p postings, field, term string, prefix bool) {
+	for name, terms := range p {
+		if field != "" && name != field {
+			continue
+		}
+		if !prefix {
+			for _, n := range terms[term] {
+				docs[n] = true
+			}
+			continue
+		}
+		for candidate, list := range terms {
+			if strings.HasPrefix(candidate, term) {
+				for _, n := range list {
+					docs[n] = true
+				}
+			}
+		}
+	}
+}
+
+func isExcluded(n int, excluded []map[int]bool) bool {
+	for _, docs := range excluded {
+		if docs[n] {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesFilters checks the date and attachment clauses of a query
+func matchesFilters(doc Document, clauses []clause) bool {
+	date := doc.Time()
+	for _, c := range clauses {
+		matches := true
+		switch {
+		case !c.before.IsZero():
+			matches = date.Before(c.before)
+		case !c.after.IsZero():
+			matches = !date.Before(c.after)
+		case c.hasAttachment:
+			matches = len(doc.Attachments) > 0
+		default:
+			continue
+		}
+		if matches == c.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// Snippet returns the line of the email's saved text that first contains a
+// term of the query, falling back to the Gmail snippet and then to the
+// start of the text
+func Snippet(outputDir string, doc Document, query *Query) string {
+	text := ""
+	if doc.TextFile != "" {
+		if data, err := os.ReadFile(filepath.Join(outputDir, filepath.FromSlash(doc.TextFile))); err == nil {
+			text = string(data)
+			if line := matchingLine(text, query); line != "" {
+				return line
+			}
+		}
+	}
+	if doc.Snippet == "" {
+		return truncateSnippet(strings.Join(strings.Fields(text), " "), 0)
+	}
+	return truncateSnippet(strings.Join(strings.Fields(doc.Snippet), " "), 0)
+}
+
+// matchingLine finds the first line of text holding a term of a positive
+// body or free-text clause, cut to a window around the term
+func matchingLine(text string, query *Query) string {
+	var terms []string
+	for _, c := range query.clauses {
+		if !c.negate && (c.field == "" || c.field == FieldBody) {
+			terms = append(terms, c.terms...)
+		}
+	}
+	if len(terms) == 0 {
+		return ""
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" {
+			continue
+		}
+		lower := strings.ToLower(line)
+		for _, term := range terms {
+			if pos := strings.Index(lower, term); pos >= 0 && len(lower) == len(line) {
+				return truncateSnippet(line, pos)
+			}
+			for _, token := range Tokenize(line) {
+				if strings.HasPrefix(token, term) {
+					return truncateSnippet(line, 0)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// truncateSnippet shortens text to maxSnippetLength characters, keeping the
+// byte offset pos in view
+func truncateSnippet(text string, pos int) string {
+	if utf8.RuneCountInString(text) <= maxSnippetLength {
+		return text
+	}
+	start := 0
+	if before := utf8.RuneCountInString(text[:pos]); before > maxSnippetLength/3 {
+		start = before - maxSnippetLength/3
+	}
+	r := []rune(text)
+	end := start + maxSnippetLength
+	if end > len(r) {
+		end = len(r)
+		start = end - maxSnippetLength
+	}
+	snippet := string(r[start:end])
+	if start > 0 {
+		snippet = "..." + snippet
+	}
+	if end < len(r) {
+		snippet += "..."
+	}
+	return snippet
+}
@@ -0,0 +1,191 @@
+package search
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perarneng/getgmail/pkg/interfaces"
+)
+
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 0, 0, 0, 0, time.Local)
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []clause
+	}{
+		{"invoice", []clause{{terms: []string{"invoice"}}}},
+		{"Café  Receipt", []clause{{terms: []string{"cafe"}}, {terms: []string{"receipt"}}}},
+		{"-spam", []clause{{negate: true, terms: []string{"spam"}}}},
+		{"-", nil},
+		{"from:billing@vendor.com", []clause{{field: FieldFrom, terms: []string{"billing", "vendor", "com"}}}},
+		{"-label:promotions", []clause{{negate: true, field: FieldLabel, terms: []string{"promotions"}}}},
+		{"in:inbox filename:report", []clause{{field: FieldLabel, terms: []string{"inbox"}}, {field: FieldAttachment, terms: []string{"report"}}}},
+		{`from:"Jane Doe" "big deal"`, []clause{{field: FieldFrom, terms: []string{"jane", "doe"}}, {terms: []string{"big", "deal"}}}},
+		{`subject:"unterminated quote`, []clause{{field: FieldSubject, terms: []string{"unterminated", "quote"}}}},
+		{"pay*", []clause{{terms: []string{"pay"}, prefix: true}}},
+		{"subject:inv*", []clause{{field: FieldSubject, terms: []string{"inv"}, prefix: true}}},
+		{"re:hello", []clause{{terms: []string{"re", "hello"}}}},
+		{"from:", []clause{{terms: []string{"from"}}}},
+		{"before:2024-06-01", []clause{{before: day(2024, time.June, 1)}}},
+		{"AFTER:2024/01/31", []clause{{after: day(2024, time.January, 31)}}},
+		{"-after:2024-01-01", []clause{{negate: true, after: day(2024, time.January, 1)}}},
+		{"has:attachment", []clause{{hasAttachment: true}}},
+	}
+	for _, test := range tests {
+		query, err := ParseQuery(test.query)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("ParseQuery(%q) = %+v, want an error", test.query, query.clauses)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseQuery(%q): %v", test.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(query.clauses, test.want) {
+			t.Errorf("ParseQuery(%q) = %+v, want %+v", test.query, query.clauses, test.want)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, query := range []string{"", "   ", `""`, "before:yesterday", "after:2024-13-01", "has:star"} {
+		if _, err := ParseQuery(query); err == nil {
+			t.Errorf("ParseQuery(%q) succeeded, want an error", query)
+		}
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Re: Café invoice #42", []string{"re", "cafe", "invoice", "42"}},
+		{"Привет, МИР", []string{"привет", "мир"}},
+		{"Ελληνικά", []string{"ελληνικα"}},
+		{"東京都の会議", []string{"東京", "京都", "都の", "の会", "会議"}},
+		{"会議 2024年", []string{"会議", "2024", "年"}},
+		{"がか", []string{"がか"}},
+		{"안녕하세요 world", []string{"안녕", "녕하", "하세", "세요", "world"}},
+		{strings.Repeat("a", maxTermLength+1) + " ok", []string{"ok"}},
+		// The limit counts characters, not bytes
+		{strings.Repeat("я", maxTermLength), []string{strings.Repeat("я", maxTermLength)}},
+	}
+	for _, test := range tests {
+		if got := Tokenize(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Tokenize(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestSearchCJK(t *testing.T) {
+	idx := newIndex()
+	for _, doc := range []interfaces.SearchDocument{
+		{ID: "a", Subject: "東京都の会議について", Body: "明日の会議は十時からです"},
+		{ID: "b", Subject: "京都旅行", Body: "Привет из Киото"},
+		{ID: "c", Subject: "회의 일정", Body: "다음 주 회의"},
+	} {
+		idx.add(newDocument(doc), documentTerms(doc))
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"会議", []string{"a"}},
+		{"京都", []string{"a", "b"}},
+		{"東京都", []string{"a"}},
+		{"subject:旅行", []string{"b"}},
+		{"京", []string{"a", "b"}},
+		{"киото", []string{"b"}},
+		{"회의", []string{"c"}},
+		{"大阪", nil},
+	}
+	for _, test := range tests {
+		if got := searchIDs(t, idx, test.query); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Search(%q) = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	idx := newIndex()
+	for _, doc := range []interfaces.SearchDocument{
+		{ID: "a", Subject: "Invoice for January", From: "Billing <billing@vendor.com>", Body: "Thank you for your payment",
+			Date: day(2024, time.January, 5), Labels: []string{"INBOX"}, Attachments: []string{"invoice-2024.pdf"}},
+		{ID: "b", Subject: "Lunch", From: "Bob <bob@friend.org>", Body: "Meet near the invoice office",
+			Date: day(2024, time.January, 10), Labels: []string{"INBOX", "Personal"}},
+		{ID: "c", Subject: "Second invoice", From: "Billing <billing@vendor.com>", Body: "Another payment",
+			Date: day(2024, time.January, 20), Labels: []string{"CATEGORY_PROMOTIONS"}, Attachments: []string{"receipt.pdf"}},
+	} {
+		idx.add(newDocument(doc), documentTerms(doc))
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"invoice", []string{"c", "b", "a"}},
+		{"invoice from:billing", []string{"c", "a"}},
+		{"invoice -from:bob", []string{"c", "a"}},
+		{"subject:invoice", []string{"c", "a"}},
+		{"from:\"bob friend\"", []string{"b"}},
+		{"filename:receipt", []string{"c"}},
+		{"pay*", []string{"c", "a"}},
+		{"label:personal", []string{"b"}},
+		{"-label:inbox", []string{"c"}},
+		{"after:2024-01-10", []string{"c", "b"}},
+		{"before:2024-01-10", []string{"a"}},
+		{"after:2024-01-06 before:2024-01-20", []string{"b"}},
+		{"-after:2024-01-06", []string{"a"}},
+		{"has:attachment", []string{"c", "a"}},
+		{"-has:attachment", []string{"b"}},
+		{"missing", nil},
+	}
+	for _, test := range tests {
+		query, err := ParseQuery(test.query)
+		if err != nil {
+			t.Fatalf("ParseQuery(%q): %v", test.query, err)
+		}
+		hits, err := idx.Search(query)
+		if err != nil {
+			t.Fatalf("Search(%q): %v", test.query, err)
+		}
+		var got []string
+		for _, doc := range hits {
+			got = append(got, doc.ID)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Search(%q) = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestSearchReplacedDocument(t *testing.T) {
+	idx := newIndex()
+	first := interfaces.SearchDocument{ID: "a", Subject: "Draft", Date: day(2024, time.March, 1)}
+	second := interfaces.SearchDocument{ID: "a", Subject: "Final", Date: day(2024, time.March, 1)}
+	idx.add(newDocument(first), documentTerms(first))
+	idx.add(newDocument(second), documentTerms(second))
+
+	for query, want := range map[string]int{"draft": 0, "final": 1} {
+		parsed, _ := ParseQuery(query)
+		hits, err := idx.Search(parsed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(hits); got != want {
+			t.Errorf("Search(%q) found %d emails, want %d", query, got, want)
+		}
+	}
+	if idx.Len() != 1 {
+		t.Errorf("Len() = %d, want 1", idx.Len())
+	}
+}
@@ -0,0 +1,56 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StateFileName is the name of the sync state file kept in the output directory
+const StateFileName = ".getgmail_state.json"
+
+// SyncState records where the last sync of a mailbox left off
+type SyncState struct {
+	Mailbox   string    `json:"mailbox"`
+	HistoryID uint64    `json:"historyId"`
+	LastSync  time.Time `json:"lastSync"`
+}
+
+// Load reads the sync state from the output directory. A missing state file
+// is not an error and returns nil.
+func Load(outputDir string) (*SyncState, error) {
+	data, err := os.ReadFile(filepath.Join(outputDir, StateFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read sync state: %v", err)
+	}
+
+	var s SyncState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse sync state: %v", err)
+	}
+	return &s, nil
+}
+
+// Save writes the sync state to the output directory, replacing the file
+// atomically so an interrupted run never leaves a truncated state behind
+func Save(outputDir string, s *SyncState) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode sync state: %v", err)
+	}
+
+	path := filepath.Join(outputDir, StateFileName)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write sync state: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to save sync state: %v", err)
+	}
+	return nil
+}